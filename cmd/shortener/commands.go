@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"os"
+	"shortener/internal/config"
+	"shortener/internal/store"
+	"shortener/internal/transfer"
+	"strings"
+)
+
+// runCommand runs the subcommand against the configured storage
+func runCommand(ctx context.Context, opts *config.Options) error {
+	if opts.Command == "verify-migration" {
+		return verifyMigration(ctx, opts)
+	}
+	backend, err := store.OpenBackend(opts)
+	if err != nil {
+		return err
+	}
+
+	switch opts.Command {
+	case "export":
+		out := os.Stdout
+		if opts.Export.Output != "" {
+			out, err = os.Create(opts.Export.Output)
+			if err != nil {
+				return err
+			}
+		}
+		n, err := transfer.Export(ctx, backend, out, opts.Export.Format)
+		if out != os.Stdout {
+			if errClose := out.Close(); err == nil {
+				err = errClose
+			}
+		}
+		if err != nil {
+			return err
+		}
+		log.Info().Msgf("Exported %d links with their previous targets", n)
+	case "import":
+		in := os.Stdin
+		if opts.Import.Input != "" {
+			in, err = os.Open(opts.Import.Input)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+		}
+		stats, err := transfer.Import(ctx, backend, in, opts.Import.Format, store.ConflictPolicy(opts.Import.OnConflict))
+		if err != nil {
+			return err
+		}
+		log.Info().Msgf("Imported %d of %d links, %d skipped, %d overwritten, previous targets of %d",
+			stats.Written, stats.Read, stats.Skipped, stats.Overwritten, stats.Histories)
+	default:
+		return fmt.Errorf("unknown command %q", opts.Command)
+	}
+	return nil
+}
+
+// verifyMigration compares the file with the database, links and their previous targets.
+// An error is returned if they differ.
+func verifyMigration(ctx context.Context, opts *config.Options) error {
+	file, db := store.NewFileBackend(opts.FileStore), store.NewDBBackend(store.DB)
+	diffs, err := store.Compare(ctx, file, db)
+	if err != nil {
+		return err
+	}
+	historyDiffs, err := store.CompareHistory(ctx, file, db)
+	if err != nil {
+		return err
+	}
+	printed := 0
+	for _, diff := range diffs {
+		if printed == opts.Verify.MaxDiffs {
+			break
+		}
+		printed++
+		switch {
+		case diff.Left == nil:
+			fmt.Printf("%s: missing in the file\n", diff.Key)
+		case diff.Right == nil:
+			fmt.Printf("%s: missing in the database\n", diff.Key)
+		default:
+			// The values are not printed, they may be secret
+			fmt.Printf("%s: %s differ\n", diff.Key, strings.Join(diff.Fields(), ", "))
+		}
+	}
+	for _, diff := range historyDiffs {
+		if printed == opts.Verify.MaxDiffs {
+			break
+		}
+		printed++
+		fmt.Printf("%s: previous targets differ in %s\n", diff.Key, strings.Join(diff.Fields(), ", "))
+	}
+	if total := len(diffs) + len(historyDiffs); printed < total {
+		fmt.Printf("... and %d more\n", total-printed)
+	}
+	if len(diffs) > 0 || len(historyDiffs) > 0 {
+		return fmt.Errorf("%d links and %d histories differ", len(diffs), len(historyDiffs))
+	}
+	log.Info().Msg("The file and the database hold the same links and previous targets")
+	return nil
+}
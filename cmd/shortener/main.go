@@ -2,15 +2,18 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"fmt"
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq" // Anonymous import for PostgreSQL driver
+	"github.com/jessevdk/go-flags"
 	"github.com/rs/zerolog/log"
 	"net"
 	"net/http"
+	"os"
 	"shortener/internal/config"
+	"shortener/internal/domainrules"
 	"shortener/internal/handlers"
+	"shortener/internal/jobs"
 	"shortener/internal/logger"
 	"shortener/internal/middlewares"
 	"shortener/internal/store"
@@ -19,10 +22,22 @@ import (
 func main() {
 	opts, err := config.ParseOptions()
 	if err != nil {
-		log.Fatal().Err(err)
+		// go-flags has already printed its errors and the help
+		flagsErr, ok := err.(*flags.Error)
+		if ok && flagsErr.Type == flags.ErrHelp {
+			os.Exit(0)
+		}
+		if !ok {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+	// Setup log with debug level, subcommands log to stderr as they may write data to stdout
+	logOutput := os.Stdout
+	if opts.Command != "" {
+		logOutput = os.Stderr
 	}
-	// Setup log with debug level
-	logger.SetupLog(true)
+	logger.SetupLog(true, logOutput)
 
 	// Initialize the in-memory store
 	store.New()
@@ -33,20 +48,79 @@ func main() {
 		if errLoad != nil {
 			log.Info().Msgf("Failed to load from file store: %s", errLoad)
 		}
+		if errLoad = store.Store.LoadHistory(store.HistoryPath(opts.FileStore)); errLoad != nil {
+			log.Error().Err(errLoad).Msg("Failed to load the history of the links")
+		}
 	}
 	// Initialize the database store if exists
 	if opts.ConnectionString != "" {
-		// Open the database connection
-		store.DB, err = sql.Open("postgres", opts.ConnectionString)
+		// Open the database connection and initialize the database, waiting for it if it is not up yet
+		store.DB, err = store.ConnectDB(context.Background(), opts)
 		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to open database connection")
+			log.Fatal().Err(err).Msg("Failed to connect to the database")
 		}
 		defer store.DB.Close()
-		// Initialize the database
-		err = store.InitDB(store.DB)
+		store.QueryTimeout = opts.DBTimeout
+		store.Retries = opts.DBRetries
+		// Keep serving while the database is down, journaling new links if a journal is set
+		store.DBBreaker = store.NewBreaker(opts.DBBreakerThreshold, opts.DBBreakerCooldown)
+		store.Cache = store.NewLinkCache(opts.DBCacheSize)
+		if opts.DBJournal != "" {
+			store.DBJournal, err = store.OpenJournal(opts.DBJournal)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to open the database journal")
+			}
+			if pending := store.DBJournal.Pending(); pending > 0 {
+				log.Info().Msgf("%d links of the last run are waiting in the database journal", pending)
+			}
+		}
+	}
+
+	// Run the subcommand instead of the server if one is given
+	if opts.Command != "" {
+		if err = runCommand(context.Background(), opts); err != nil {
+			log.Error().Err(err).Msgf("Failed to %s", opts.Command)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Replay the links journaled while the database was down
+	if store.DBJournal != nil {
+		go store.ReplayJournal(context.Background(), opts.DBBreakerCooldown)
+	}
+
+	// Copy the links missing in the new storage while both are written
+	if opts.Migrating() {
+		from, to := store.NewMemoryBackend(opts), store.NewDBBackend(store.DB)
+		if opts.Migration == config.MigrationDBToFile {
+			from, to = to, from
+		}
+		go func() {
+			if err := store.RunBackfill(context.Background(), from, to, &store.Backfill); err != nil {
+				log.Error().Err(err).Msg("Failed to copy links to the new storage")
+			}
+		}()
+	}
+
+	// Load the domain allow and deny lists if set, and reload them on change
+	if opts.DomainRulesFile != "" {
+		domainrules.Rules, err = domainrules.Load(opts.DomainRulesFile)
 		if err != nil {
-			log.Fatal().Msgf("Failed to initialize database: %v", err)
+			log.Fatal().Err(err).Msg("Failed to load domain rules")
 		}
+		go domainrules.Rules.Watch(context.Background(), opts.DomainRulesReload)
+	}
+
+	// Process the batch jobs in the background, resuming the ones left by the last run
+	jobStore, err := openJobStore(opts)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open job store")
+	}
+	queue := jobs.NewQueue(jobStore, handlers.ProcessBatchJob(opts), opts.JobWorkers, opts.JobQueueSize, opts.JobRetention)
+	err = queue.Start(context.Background())
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to start jobs")
 	}
 
 	r := mux.NewRouter()
@@ -54,12 +128,13 @@ func main() {
 	r.Use(middlewares.LoggingMiddleware)
 	r.Use(middlewares.GzipAcceptMiddleware)
 	r.Use(middlewares.GzipSendMiddleware)
-	// Handlers
-	r.HandleFunc("/", handlers.ShortenURL(opts)).Methods("POST")
-	r.HandleFunc("/api/shorten", handlers.ShortenURLFromJSON(opts)).Methods("POST")
-	r.HandleFunc("/ping", handlers.Ping).Methods("GET")
-	r.HandleFunc("/{shortURL}", handlers.RedirectToURL(opts)).Methods("GET")
-	r.HandleFunc("/api/shorten/batch", handlers.BatchInsert(opts)).Methods("POST")
+	// Handlers are mounted under the path of the base URL, so the links we return resolve
+	routes := r
+	if prefix := opts.PathPrefix(); prefix != "" {
+		r.HandleFunc(prefix, handlers.ShortenURL(opts)).Methods("POST")
+		routes = r.PathPrefix(prefix).Subrouter()
+	}
+	registerRoutes(routes, opts, queue)
 
 	// Start the server
 	log.Info().Msgf("Starting server on %s\n", opts.ServerAddress)
@@ -79,3 +154,43 @@ func main() {
 		return
 	}
 }
+
+// openJobStore returns the store of batch jobs: the database if configured, a directory next to the file store otherwise.
+// Jobs only survive a restart with one of them.
+func openJobStore(opts *config.Options) (jobs.Store, error) {
+	switch {
+	case opts.ConnectionString != "":
+		return jobs.NewDBStore(store.DB)
+	case opts.FileStore != "":
+		return jobs.NewFileStore(opts.FileStore + ".jobs")
+	}
+	return jobs.NewMemoryStore(), nil
+}
+
+// registerRoutes registers the handlers, routes catching any short URL go last
+func registerRoutes(r *mux.Router, opts *config.Options, queue *jobs.Queue) {
+	r.HandleFunc("/", handlers.ShortenURL(opts)).Methods("POST")
+	r.HandleFunc("/api/shorten", handlers.ShortenURLFromJSON(opts)).Methods("POST")
+	r.HandleFunc("/api/shorten/batch", handlers.BatchInsert(opts)).Methods("POST")
+	r.HandleFunc("/api/import", handlers.Import(opts)).Methods("POST")
+	r.HandleFunc("/api/jobs/shorten", handlers.SubmitBatchJob(opts, queue)).Methods("POST")
+	r.HandleFunc("/api/jobs/{id}", handlers.BatchJob(queue)).Methods("GET")
+	r.HandleFunc("/api/jobs/{id}/results", handlers.BatchJobResults(queue)).Methods("GET")
+	r.HandleFunc("/api/admin/links", handlers.ListLinks(opts)).Methods("GET")
+	r.HandleFunc("/api/admin/links/{shortURL}", handlers.GetLink(opts)).Methods("GET")
+	r.HandleFunc("/api/admin/links/{shortURL}", handlers.UpdateLink(opts)).Methods("PATCH")
+	r.HandleFunc("/api/admin/links/{shortURL}", handlers.DeleteLink(opts)).Methods("DELETE")
+	r.HandleFunc("/api/admin/links/{shortURL}/history", handlers.LinkHistory(opts)).Methods("GET")
+	r.HandleFunc("/api/admin/links/{shortURL}/rollback", handlers.RollbackLink(opts)).Methods("POST")
+	r.HandleFunc("/api/expand", handlers.BatchExpand(opts)).Methods("POST")
+	r.HandleFunc("/api/expand/{shortURL}", handlers.Expand(opts)).Methods("GET")
+	r.HandleFunc("/ping", handlers.Ping).Methods("GET")
+	r.HandleFunc("/healthz", handlers.Healthz).Methods("GET")
+	r.HandleFunc("/readyz", handlers.Readyz(opts, queue)).Methods("GET")
+	r.HandleFunc("/{shortURL}/qr", handlers.QRCode(opts)).Methods("GET")
+	r.HandleFunc("/{shortURL:[^/+]+}+", handlers.Preview(opts)).Methods("GET")
+	r.HandleFunc("/{shortURL}", handlers.RedirectToURL(opts)).Methods("GET")
+	r.HandleFunc("/{shortURL}", handlers.UnlockURL(opts)).Methods("POST")
+	r.HandleFunc("/{shortURL}/{rest:.+}", handlers.RedirectToURL(opts)).Methods("GET")
+	r.HandleFunc("/{shortURL}/{rest:.+}", handlers.UnlockURL(opts)).Methods("POST")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"shortener/internal/config"
+	"shortener/internal/jobs"
+	"shortener/internal/store"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRoutesUnderBaseURLPath(t *testing.T) {
+	store.New()
+	opts := &config.Options{BaseURL: "http://example.com/s", RedirectStatus: http.StatusTemporaryRedirect}
+	r := mux.NewRouter()
+	queue := jobs.NewQueue(jobs.NewMemoryStore(), func(context.Context, *jobs.Job, func([]json.RawMessage) error) error { return nil }, 1, 1, 0)
+	registerRoutes(r.PathPrefix(opts.PathPrefix()).Subrouter(), opts, queue)
+
+	// Shorten
+	req := httptest.NewRequest("POST", "/s/", bytes.NewBufferString("http://example.com/very/long/url"))
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("shorten returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	link := rr.Body.String()
+	if !strings.HasPrefix(link, "http://example.com/s/") {
+		t.Fatalf("shorten returned unexpected link: %v", link)
+	}
+
+	// The returned link resolves, and the routes catching any short URL don't shadow the rest
+	path := strings.TrimPrefix(link, "http://example.com")
+	tests := []struct {
+		method string
+		target string
+		body   string
+		want   int
+	}{
+		{method: "GET", target: path, want: http.StatusTemporaryRedirect},
+		{method: "GET", target: path + "/qr", want: http.StatusOK},
+		{method: "GET", target: path + "+", want: http.StatusOK},
+		// A path after the short URL is not an alias of the link unless it is forwarded
+		{method: "GET", target: path + "/anything", want: http.StatusNotFound},
+		{method: "POST", target: path + "/anything", want: http.StatusNotFound},
+		{method: "GET", target: "/s/api/expand" + strings.TrimPrefix(path, "/s"), want: http.StatusOK},
+		{method: "POST", target: "/s/api/shorten/batch", body: `[`, want: http.StatusBadRequest},
+		{method: "GET", target: "/s/api/jobs/unknown", want: http.StatusNotFound},
+		{method: "GET", target: "/s/api/admin/links", want: http.StatusForbidden},
+		{method: "GET", target: "/" + strings.TrimPrefix(path, "/s/"), want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req = httptest.NewRequest(tt.method, tt.target, bytes.NewBufferString(tt.body))
+		rr = httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("%s %s returned wrong status code: got %v want %v", tt.method, tt.target, rr.Code, tt.want)
+		}
+	}
+
+	// Forwarding the path, the suffix goes to the target
+	opts.ForwardPath = true
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", path+"/anything", nil))
+	if rr.Code != http.StatusTemporaryRedirect || rr.Header().Get("Location") != "http://example.com/very/long/url/anything" {
+		t.Errorf("forwarded path returned %v %s", rr.Code, rr.Header().Get("Location"))
+	}
+}
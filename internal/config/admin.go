@@ -0,0 +1,27 @@
+package config
+
+import (
+	"crypto/subtle"
+	"strings"
+)
+
+// Name of the admin of a token given without one
+const defaultAdminName = "admin"
+
+// AdminUser returns the name of the admin the token belongs to, ok is false if it is none of the admin tokens.
+// AdminToken is a comma separated list of tokens, each may be named as name:token.
+func (o *Options) AdminUser(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	for _, entry := range strings.Split(o.AdminToken, ",") {
+		name, adminToken, named := strings.Cut(strings.TrimSpace(entry), ":")
+		if !named {
+			name, adminToken = defaultAdminName, name
+		}
+		if adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
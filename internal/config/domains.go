@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Domain a base URL links can be created on.
+// Links of every domain live in their own namespace, so the same short URL can exist on two domains.
+type Domain struct {
+	// Namespace the host of the domain, empty for the main BaseURL so links created before domains existed keep working
+	Namespace string
+	BaseURL   string
+}
+
+// MainDomain returns the domain of BaseURL
+func (o *Options) MainDomain() Domain {
+	return Domain{BaseURL: o.BaseURL}
+}
+
+// DomainByHost returns the configured domain serving the host, ok is false if there is none
+func (o *Options) DomainByHost(host string) (Domain, bool) {
+	host = strings.ToLower(host)
+	if host == "" {
+		return Domain{}, false
+	}
+	if host == baseURLHost(o.BaseURL) {
+		return o.MainDomain(), true
+	}
+	for _, baseURL := range strings.Split(o.Domains, ",") {
+		baseURL = strings.TrimSuffix(strings.TrimSpace(baseURL), "/")
+		if baseURL != "" && host == baseURLHost(baseURL) {
+			return Domain{Namespace: host, BaseURL: baseURL}, true
+		}
+	}
+	return Domain{}, false
+}
+
+// DomainByNamespace returns the domain of stored links, falling back to the main domain
+func (o *Options) DomainByNamespace(namespace string) Domain {
+	if domain, ok := o.DomainByHost(namespace); ok {
+		return domain
+	}
+	return o.MainDomain()
+}
+
+// Host returns the host of the domain, links of the main domain have none stored
+func (d Domain) Host() string {
+	return baseURLHost(d.BaseURL)
+}
+
+// PathPrefix returns the path all routes are mounted under, without the trailing slash
+func (o *Options) PathPrefix() string {
+	prefix := o.RoutePrefix
+	if prefix == "" {
+		if u, err := url.Parse(o.BaseURL); err == nil {
+			prefix = u.Path
+		}
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return prefix
+}
+
+// checkDomains checks that the links of every domain resolve, routes are mounted under a single path prefix
+func checkDomains(opts *Options) error {
+	prefix := opts.PathPrefix()
+	for _, baseURL := range strings.Split(opts.Domains, ",") {
+		baseURL = strings.TrimSpace(baseURL)
+		if baseURL == "" {
+			continue
+		}
+		u, err := url.Parse(baseURL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid domain %q", baseURL)
+		}
+		if path := strings.TrimSuffix(u.Path, "/"); path != prefix {
+			return fmt.Errorf("the path of domain %q must be %q, the one routes are mounted under", baseURL, prefix)
+		}
+	}
+	return nil
+}
+
+func baseURLHost(baseURL string) string {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Host)
+}
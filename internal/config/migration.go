@@ -0,0 +1,38 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Directions of a storage migration
+const (
+	MigrationFileToDB = "file-to-db"
+	MigrationDBToFile = "db-to-file"
+)
+
+var errMigrationStorage = errors.New("a storage migration needs both the file storage path and the database connection string")
+
+// checkMigration checks the migration mode, the env variable is not checked by go-flags
+func checkMigration(opts *Options) error {
+	if opts.Migration == "" && opts.Command != "verify-migration" {
+		return nil
+	}
+	if opts.Migration != "" && opts.Migration != MigrationFileToDB && opts.Migration != MigrationDBToFile {
+		return fmt.Errorf("invalid storage migration %q", opts.Migration)
+	}
+	if opts.FileStore == "" || opts.ConnectionString == "" {
+		return errMigrationStorage
+	}
+	return nil
+}
+
+// Migrating reports whether links are written to both storages and read from the other one if missing
+func (o *Options) Migrating() bool {
+	return o.Migration != ""
+}
+
+// PrefersDB reports whether links are read from the database first
+func (o *Options) PrefersDB() bool {
+	return o.ConnectionString != "" && o.Migration != MigrationDBToFile
+}
@@ -1,8 +1,14 @@
 package config
 
 import (
+	"fmt"
 	"github.com/jessevdk/go-flags"
 	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Options struct {
@@ -10,6 +16,95 @@ type Options struct {
 	BaseURL          string `short:"b" long:"url" description:"Base URL for shortened URLs" env:"BASE_URL" default:"http://localhost:8080"`
 	FileStore        string `short:"f" long:"file" description:"Base file storage path" env:"FILE_STORAGE_PATH" default:""`
 	ConnectionString string `short:"d" long:"database" description:"Data base connection string" env:"DATABASE_DSN" default:""`
+	// Limit of every database query of a request, requests fail with 504 when it is reached
+	DBTimeout time.Duration `long:"database-timeout" description:"Timeout of database queries, 0 for none" env:"DATABASE_TIMEOUT" default:"5s"`
+	// Waiting for the database at startup and retrying transient errors
+	DBConnectTimeout time.Duration `long:"database-connect-timeout" description:"How long to wait for the database at startup" env:"DATABASE_CONNECT_TIMEOUT" default:"30s"`
+	DBRetries        int           `long:"database-retries" description:"Retries of idempotent database queries after transient errors" env:"DATABASE_RETRIES" default:"2"`
+	// Database driver and connection pool
+	DBDriver          string        `long:"database-driver" description:"Postgres driver" env:"DATABASE_DRIVER" choice:"pq" choice:"pgx" default:"pq"`
+	DBMaxConns        int           `long:"database-max-conns" description:"Maximum open database connections, 0 for no limit" env:"DATABASE_MAX_CONNS" default:"20"`
+	DBMaxIdleConns    int           `long:"database-max-idle-conns" description:"Maximum idle database connections" env:"DATABASE_MAX_IDLE_CONNS" default:"5"`
+	DBConnMaxLifetime time.Duration `long:"database-conn-max-lifetime" description:"Maximum lifetime of a database connection, 0 for none" env:"DATABASE_CONN_MAX_LIFETIME" default:"30m"`
+	// Degraded mode while the database is down: redirects are served from a cache and new links are
+	// written to a local journal, replayed once the database is back
+	DBBreakerThreshold int           `long:"database-breaker-threshold" description:"Consecutive database failures before it is considered down" env:"DATABASE_BREAKER_THRESHOLD" default:"5"`
+	DBBreakerCooldown  time.Duration `long:"database-breaker-cooldown" description:"How long to wait before trying a database that is down again" env:"DATABASE_BREAKER_COOLDOWN" default:"10s"`
+	DBCacheSize        int           `long:"database-cache-size" description:"Number of links cached to serve redirects while the database is down, 0 for none" env:"DATABASE_CACHE_SIZE" default:"10000"`
+	DBJournal          string        `long:"database-journal" description:"File buffering new links while the database is down, writes fail then if not set" env:"DATABASE_JOURNAL"`
+
+	// Live migration between the file and the database, both have to be configured
+	Migration string `long:"migration" description:"Write to both storages, read the new one first and copy the missing links to it" env:"STORAGE_MIGRATION" choice:"file-to-db" choice:"db-to-file"`
+
+	// Path prefix to mount the routes under, the path of BaseURL if not set
+	RoutePrefix string `long:"route-prefix" description:"Path prefix of all routes, defaults to the path of the base URL" env:"ROUTE_PREFIX"`
+
+	// Additional base URLs, links are scoped to the domain they were created on
+	Domains string `long:"domains" description:"Comma separated list of additional base URLs, their path must be the one routes are mounted under" env:"DOMAINS"`
+
+	// Maximum number of items of a batch shorten request
+	MaxBatchSize int `long:"max-batch-size" description:"Maximum number of links in a batch request" env:"MAX_BATCH_SIZE" default:"1000"`
+	// Number of links of a streamed batch saved in one transaction
+	BatchChunkSize int `long:"batch-chunk-size" description:"Number of links of a streamed batch saved at once" env:"BATCH_CHUNK_SIZE" default:"500"`
+	// Maximum number of lines of a streamed batch, the correlation IDs of all of them are kept to find duplicates
+	MaxStreamLines int `long:"max-stream-lines" description:"Maximum number of lines in a streamed batch, unlimited if 0" env:"MAX_STREAM_LINES" default:"100000"`
+
+	// Batches processed in the background
+	MaxJobSize   int `long:"max-job-size" description:"Maximum number of links in a batch job" env:"MAX_JOB_SIZE" default:"50000"`
+	JobWorkers   int `long:"job-workers" description:"Number of batch jobs processed at the same time" env:"JOB_WORKERS" default:"2"`
+	JobQueueSize int `long:"job-queue-size" description:"Number of batch jobs waiting to be processed" env:"JOB_QUEUE_SIZE" default:"100"`
+	// How long finished jobs and their results are kept
+	JobRetention time.Duration `long:"job-retention" description:"How long finished batch jobs and their results are kept, forever if 0" env:"JOB_RETENTION" default:"168h"`
+
+	// URL validation
+	MaxURLLength int    `long:"max-url-length" description:"Maximum length of a URL to shorten" env:"MAX_URL_LENGTH" default:"2048"`
+	DenyPrivate  bool   `long:"deny-private" description:"Reject URLs pointing at loopback or private addresses" env:"DENY_PRIVATE"`
+	URLFragment  string `long:"url-fragment" description:"What to do with URL fragments" env:"URL_FRAGMENT" choice:"keep" choice:"strip" default:"keep"`
+
+	// Redirect defaults, links can override them
+	RedirectStatus         int    `long:"redirect-status" description:"Default redirect status code" env:"REDIRECT_STATUS" choice:"301" choice:"302" choice:"303" choice:"307" choice:"308" default:"307"`
+	RedirectCacheControl   string `long:"redirect-cache-control" description:"Default Cache-Control header of redirects" env:"REDIRECT_CACHE_CONTROL"`
+	RedirectReferrerPolicy string `long:"redirect-referrer-policy" description:"Default Referrer-Policy header of redirects" env:"REDIRECT_REFERRER_POLICY"`
+	RedirectRobotsTag      string `long:"redirect-robots-tag" description:"Default X-Robots-Tag header of redirects" env:"REDIRECT_ROBOTS_TAG"`
+
+	// Forwarding of the incoming request to the target for every link
+	ForwardQuery bool `long:"forward-query" description:"Merge the query string of short links into the target query" env:"FORWARD_QUERY"`
+	ForwardPath  bool `long:"forward-path" description:"Append the path after short links to the target path" env:"FORWARD_PATH"`
+
+	// Password protected links
+	PasswordMaxAttempts int           `long:"password-max-attempts" description:"Failed password attempts before a link is locked" env:"PASSWORD_MAX_ATTEMPTS" default:"5"`
+	PasswordLockout     time.Duration `long:"password-lockout" description:"How long a link stays locked after too many failed attempts" env:"PASSWORD_LOCKOUT" default:"15m"`
+
+	// Domain allow and deny lists
+	DomainRulesFile   string        `long:"domain-rules" description:"Path to the domain allow/deny rules file" env:"DOMAIN_RULES_FILE"`
+	DomainRulesReload time.Duration `long:"domain-rules-reload" description:"How often to check the domain rules file for changes" env:"DOMAIN_RULES_RELOAD" default:"10s"`
+
+	// Bearer tokens of the admin API, the API is disabled if not set. Named tokens tell who changed a link.
+	AdminToken string `long:"admin-token" description:"Comma separated bearer tokens of the admin API, as token or name:token, disabled if not set" env:"ADMIN_TOKEN"`
+
+	// Subcommands, the server is started if none is given
+	Export  ExportCommand `command:"export" description:"Export all links of the file or database storage"`
+	Import  ImportCommand `command:"import" description:"Import links into the file or database storage"`
+	Verify  VerifyCommand `command:"verify-migration" description:"Compare the links of the file and the database storage"`
+	Command string        `no-flag:"true"`
+}
+
+// ExportCommand options of the export subcommand
+type ExportCommand struct {
+	Format string `long:"format" description:"Output format" choice:"csv" choice:"jsonl" choice:"json" default:"jsonl"`
+	Output string `short:"o" long:"output" description:"File to write, stdout if not set"`
+}
+
+// ImportCommand options of the import subcommand
+type ImportCommand struct {
+	Format     string `long:"format" description:"Input format" choice:"csv" choice:"jsonl" choice:"json" default:"jsonl"`
+	Input      string `short:"i" long:"input" description:"File to read, stdin if not set"`
+	OnConflict string `long:"on-conflict" description:"What to do with links that already exist" choice:"skip" choice:"overwrite" choice:"fail" default:"fail"`
+}
+
+// VerifyCommand options of the verify-migration subcommand
+type VerifyCommand struct {
+	MaxDiffs int `long:"max-diffs" description:"Number of differences to print" default:"20"`
 }
 
 // ParseOptions parses the options from environment variables and command line arguments.
@@ -17,50 +112,81 @@ type Options struct {
 //
 // Returns a pointer to Options struct and an error.
 func ParseOptions() (*Options, error) {
-	var opts, args Options
+	var opts Options
 
-	// Define variables to store environment variables
-	serverAddressEnv := os.Getenv("SERVER_ADDRESS")
-	baseURLEnv := os.Getenv("BASE_URL")
-	fileStoreEnv := os.Getenv("FILE_STORAGE_PATH")
-	dataBaseEnv := os.Getenv("DATABASE_DSN")
-
-	// Check if environment variables are set and assign them to the options
-	if serverAddressEnv != "" {
-		opts.ServerAddress = serverAddressEnv
+	// Parse the command line arguments, go-flags fills the rest from env and defaults
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.SubcommandsOptional = true
+	_, err := parser.Parse()
+	if err != nil {
+		return nil, err
+	}
+	if parser.Active != nil {
+		opts.Command = parser.Active.Name
 	}
-	if baseURLEnv != "" {
-		opts.BaseURL = baseURLEnv
+
+	// Environment variables override command line arguments
+	err = applyEnv(&opts, parser)
+	if err != nil {
+		return nil, err
 	}
-	if fileStoreEnv != "" {
-		opts.FileStore = fileStoreEnv
+	if err = checkMigration(&opts); err != nil {
+		return nil, err
 	}
-	if dataBaseEnv != "" {
-		opts.ConnectionString = dataBaseEnv
+	// Links are built as BaseURL + "/" + short URL
+	opts.BaseURL = strings.TrimSuffix(opts.BaseURL, "/")
+	if err = checkDomains(&opts); err != nil {
+		return nil, err
 	}
 
-	// Parse the command line arguments only if environment variables are not set
-	if serverAddressEnv == "" || baseURLEnv == "" || fileStoreEnv == "" || dataBaseEnv == "" {
-		parser := flags.NewParser(&args, flags.Default)
-		_, err := parser.Parse()
-		if err != nil {
-			return nil, err
-		}
+	return &opts, nil
+}
 
-		// Assign the command line arguments to the options if some of them not set already
-		if serverAddressEnv == "" && args.ServerAddress != "" {
-			opts.ServerAddress = args.ServerAddress
+// applyEnv assigns every option that has its environment variable set, overriding command line arguments.
+// The values are checked against the choices of the option, like go-flags checks the arguments.
+func applyEnv(opts *Options, parser *flags.Parser) error {
+	v := reflect.ValueOf(opts).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("env")
+		if name == "" {
+			continue
 		}
-		if baseURLEnv == "" && args.BaseURL != "" {
-			opts.BaseURL = args.BaseURL
+		value, ok := os.LookupEnv(name)
+		if !ok || value == "" {
+			continue
 		}
-		if fileStoreEnv == "" && args.FileStore != "" {
-			opts.FileStore = args.FileStore
+		option := parser.FindOptionByLongName(t.Field(i).Tag.Get("long"))
+		if option != nil && len(option.Choices) > 0 && !slices.Contains(option.Choices, value) {
+			return fmt.Errorf("invalid value of %s: %q, allowed values are %s", name, value, strings.Join(option.Choices, ", "))
 		}
-		if dataBaseEnv == "" && args.ConnectionString != "" {
-			opts.ConnectionString = args.ConnectionString
+		field := v.Field(i)
+		if field.Type() == reflect.TypeOf(time.Duration(0)) {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid value of %s: %w", name, err)
+			}
+			field.SetInt(int64(d))
+			continue
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid value of %s: %w", name, err)
+			}
+			field.SetBool(b)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid value of %s: %w", name, err)
+			}
+			field.SetInt(int64(n))
+		default:
+			return fmt.Errorf("unsupported type of %s", name)
 		}
 	}
-
-	return &opts, nil
+	return nil
 }
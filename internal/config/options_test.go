@@ -0,0 +1,26 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func TestApplyEnvChoices(t *testing.T) {
+	var opts Options
+	parser := flags.NewParser(&opts, flags.None)
+
+	t.Setenv("REDIRECT_STATUS", "200")
+	if err := applyEnv(&opts, parser); err == nil {
+		t.Error("applyEnv() accepted REDIRECT_STATUS=200")
+	}
+	t.Setenv("REDIRECT_STATUS", "308")
+	t.Setenv("URL_FRAGMENT", "drop")
+	if err := applyEnv(&opts, parser); err == nil {
+		t.Error("applyEnv() accepted URL_FRAGMENT=drop")
+	}
+	t.Setenv("URL_FRAGMENT", "strip")
+	if err := applyEnv(&opts, parser); err != nil || opts.RedirectStatus != 308 || opts.URLFragment != "strip" {
+		t.Errorf("applyEnv() = %v, status %d, fragment %q", err, opts.RedirectStatus, opts.URLFragment)
+	}
+}
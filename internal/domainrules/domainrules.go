@@ -0,0 +1,198 @@
+package domainrules
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rules a global variable to hold the domain rules, nil means every domain is allowed
+var Rules *List
+
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+// Rule a single line of the rules file
+type Rule struct {
+	Action  string
+	Pattern string
+	Line    int
+	re      *regexp.Regexp
+}
+
+func (r Rule) String() string {
+	return fmt.Sprintf("%s %s (line %d)", r.Action, r.Pattern, r.Line)
+}
+
+// Match checks if the host matches the rule.
+// Patterns are an exact domain, a wildcard suffix like *.example.com or a regular expression between slashes.
+func (r Rule) Match(host string) bool {
+	switch {
+	case r.re != nil:
+		return r.re.MatchString(host)
+	case strings.HasPrefix(r.Pattern, "*."):
+		return strings.HasSuffix(host, r.Pattern[1:])
+	default:
+		return host == r.Pattern
+	}
+}
+
+// BlockedError is returned when a host is not allowed by the rules
+type BlockedError struct {
+	Host string
+	// Rule the deny rule that matched, nil when the host did not match any allow rule
+	Rule *Rule
+}
+
+func (e *BlockedError) Error() string {
+	if e.Rule == nil {
+		return fmt.Sprintf("domain %s is not in the allowlist", e.Host)
+	}
+	return fmt.Sprintf("domain %s is blocked by rule %s", e.Host, e.Rule)
+}
+
+// List allow and deny rules loaded from a file
+type List struct {
+	mu      sync.RWMutex
+	path    string
+	modTime time.Time
+	allow   []Rule
+	deny    []Rule
+}
+
+// Load reads the rules from a file.
+// Each line is "allow <pattern>" or "deny <pattern>", empty lines and lines starting with # are skipped.
+func Load(path string) (*List, error) {
+	l := &List{path: path}
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Check checks the host against the rules.
+// Deny rules win over allow rules, and when there are allow rules the host has to match one of them.
+func (l *List) Check(host string) error {
+	if l == nil {
+		return nil
+	}
+	host = strings.ToLower(host)
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for i := range l.deny {
+		if l.deny[i].Match(host) {
+			rule := l.deny[i]
+			return &BlockedError{Host: host, Rule: &rule}
+		}
+	}
+	if len(l.allow) == 0 {
+		return nil
+	}
+	for i := range l.allow {
+		if l.allow[i].Match(host) {
+			return nil
+		}
+	}
+	return &BlockedError{Host: host}
+}
+
+// Watch reloads the rules when the file changes until the context is done.
+// A broken file is logged and the previous rules are kept.
+func (l *List) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(l.path)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to stat domain rules file")
+				continue
+			}
+			l.mu.RLock()
+			changed := !info.ModTime().Equal(l.modTime)
+			l.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err = l.reload(); err != nil {
+				log.Error().Err(err).Msg("Failed to reload domain rules, keeping the previous ones")
+				continue
+			}
+			log.Info().Msgf("Domain rules reloaded from %s", l.path)
+		}
+	}
+}
+
+// reload parses the file and swaps the rules
+func (l *List) reload() error {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	var allow, deny []Rule
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseRule(line, lineNumber)
+		if err != nil {
+			return err
+		}
+		if rule.Action == ActionAllow {
+			allow = append(allow, rule)
+		} else {
+			deny = append(deny, rule)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.allow, l.deny, l.modTime = allow, deny, info.ModTime()
+	l.mu.Unlock()
+	return nil
+}
+
+func parseRule(line string, lineNumber int) (Rule, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return Rule{}, fmt.Errorf("line %d: expected \"allow|deny <pattern>\"", lineNumber)
+	}
+	rule := Rule{Action: strings.ToLower(fields[0]), Pattern: fields[1], Line: lineNumber}
+	if rule.Action != ActionAllow && rule.Action != ActionDeny {
+		return Rule{}, fmt.Errorf("line %d: unknown action %q", lineNumber, fields[0])
+	}
+	if len(rule.Pattern) > 2 && strings.HasPrefix(rule.Pattern, "/") && strings.HasSuffix(rule.Pattern, "/") {
+		re, err := regexp.Compile(rule.Pattern[1 : len(rule.Pattern)-1])
+		if err != nil {
+			return Rule{}, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		rule.re = re
+		return rule, nil
+	}
+	rule.Pattern = strings.ToLower(rule.Pattern)
+	return rule, nil
+}
@@ -0,0 +1,57 @@
+package domainrules
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	rules := `# company domains only
+allow example.com
+allow *.example.com
+deny /^phish[0-9]*\./
+deny login.example.com
+`
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	list, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host        string
+		allowed     bool
+		blockedLine int
+	}{
+		{host: "example.com", allowed: true},
+		{host: "docs.Example.com", allowed: true},
+		{host: "login.example.com", blockedLine: 5},
+		{host: "phish1.example.com", blockedLine: 4},
+		{host: "example.org"},
+	}
+	for _, tt := range tests {
+		err := list.Check(tt.host)
+		if tt.allowed {
+			if err != nil {
+				t.Errorf("Check(%q) = %v, want allowed", tt.host, err)
+			}
+			continue
+		}
+		var blocked *BlockedError
+		if !errors.As(err, &blocked) {
+			t.Fatalf("Check(%q) = %v, want BlockedError", tt.host, err)
+		}
+		line := 0
+		if blocked.Rule != nil {
+			line = blocked.Rule.Line
+		}
+		if line != tt.blockedLine {
+			t.Errorf("Check(%q) blocked by line %d, want %d", tt.host, line, tt.blockedLine)
+		}
+	}
+}
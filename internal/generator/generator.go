@@ -3,21 +3,20 @@ package generator
 import (
 	"crypto/sha1"
 	"encoding/base64"
-	"sync"
+	"strconv"
 )
 
-func ShortURL(originalURL string, store *sync.Map) string {
-	hash := sha1.New()
-	hash.Write([]byte(originalURL))
-	shortURL := base64.URLEncoding.EncodeToString(hash.Sum(nil))[:6]
+// ShortURL generates a short URL that is not taken yet
+func ShortURL(originalURL string, taken func(shortURL string) bool) string {
+	shortURL := ShortURLWithoutCheck(originalURL)
 
 	// Check for collisions and regenerate short URL if it already exists in the store
-	for {
-		if _, ok := store.Load(shortURL); !ok {
+	for i := 1; ; i++ {
+		if !taken(shortURL) {
 			break
 		}
-		// Regenerate short URL
-		shortURL = base64.URLEncoding.EncodeToString(hash.Sum([]byte("some")))[:6]
+		// Regenerate short URL, salting the hash with the attempt number
+		shortURL = ShortURLWithoutCheck(originalURL + strconv.Itoa(i))
 	}
 
 	return shortURL
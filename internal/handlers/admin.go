@@ -0,0 +1,376 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"shortener/internal/config"
+	"shortener/internal/problems"
+	"shortener/internal/store"
+	"shortener/internal/validator"
+	"strings"
+	"time"
+)
+
+// Page sizes of the link listing
+const (
+	defaultLinksPage = 50
+	maxLinksPage     = 1000
+)
+
+var (
+	errAdminDisabled = errors.New("admin API is disabled")
+	errAdminToken    = errors.New("admin token is missing or wrong")
+	errCursor        = errors.New("invalid cursor")
+	errNoUpdate      = errors.New("nothing to update")
+)
+
+// AdminLink a link as the admin API shows it, the password hash is never revealed
+type AdminLink struct {
+	// Alias the short URL without the base URL
+	Alias       string     `json:"alias"`
+	ShortURL    string     `json:"short_url"`
+	OriginalURL string     `json:"original_url"`
+	Domain      string     `json:"domain"`
+	UUID        string     `json:"uuid,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	Disabled    bool       `json:"disabled"`
+	Protected   bool       `json:"protected,omitempty"`
+	MaxClicks   int        `json:"max_clicks,omitempty"`
+	Clicks      int        `json:"clicks,omitempty"`
+	Title       string     `json:"title,omitempty"`
+	Description string     `json:"description,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	store.Redirect
+	store.Forward
+}
+
+// AdminLinksResponse a page of links, NextCursor is set if there are more
+type AdminLinksResponse struct {
+	Links      []AdminLink `json:"links"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// AdminLinkUpdate the changes of a link, fields left out stay the same
+type AdminLinkUpdate struct {
+	OriginalURL *string `json:"original_url,omitempty"`
+	Disabled    *bool   `json:"disabled,omitempty"`
+}
+
+// newAdminLink returns the link as the admin API shows it
+func newAdminLink(record store.Record, opts *config.Options) AdminLink {
+	domain := opts.DomainByNamespace(record.Domain)
+	link := AdminLink{
+		Alias:       record.ShortURL,
+		ShortURL:    domain.BaseURL + "/" + record.ShortURL,
+		OriginalURL: record.OriginalURL,
+		Domain:      domain.Host(),
+		UUID:        record.UUID,
+		Disabled:    record.Disabled,
+		Protected:   record.PasswordHash != "",
+		MaxClicks:   record.MaxClicks,
+		Clicks:      record.Clicks,
+		Title:       record.Title,
+		Description: record.Description,
+		Tags:        store.SplitTags(record.Tags),
+		Redirect:    record.Redirect,
+		Forward:     record.Forward,
+	}
+	if !record.CreatedAt.IsZero() {
+		link.CreatedAt = &record.CreatedAt
+	}
+	return link
+}
+
+// adminUserKey the context key of the name of the admin sending the request
+type adminUserKey struct{}
+
+// requireAdmin serves next only to requests with an admin token as bearer token, the name of the admin is
+// in the request context
+func requireAdmin(opts *config.Options, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if opts.AdminToken == "" {
+			problem(w, r, http.StatusForbidden, problems.CodeForbidden, errAdminDisabled.Error())
+			return
+		}
+		token, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		user, ok := opts.AdminUser(token)
+		if !bearer || !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			problem(w, r, http.StatusUnauthorized, problems.CodeUnauthorized, errAdminToken.Error())
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), adminUserKey{}, user)))
+	}
+}
+
+// adminUser returns the name of the admin sending the request
+func adminUser(r *http.Request) string {
+	user, _ := r.Context().Value(adminUserKey{}).(string)
+	return user
+}
+
+// linkStores returns the storages of the links, the one read first comes first. Changes go to all of them,
+// the in-memory store keeps a copy of the links created one by one even with a database.
+func linkStores(opts *config.Options) []store.Links {
+	memory := store.NewMemoryLinks(opts)
+	if opts.ConnectionString == "" {
+		return []store.Links{memory}
+	}
+	db := store.NewDBLinks(store.DB)
+	if opts.PrefersDB() {
+		return []store.Links{db, memory}
+	}
+	return []store.Links{memory, db}
+}
+
+// getLink reads a link like findURL, from the other storage during a migration if it was not copied yet
+func getLink(ctx context.Context, domain, shortURL string, opts *config.Options) (store.Record, bool, error) {
+	stores := linkStores(opts)
+	record, ok, err := stores[0].Get(ctx, domain, shortURL)
+	if err == nil && !ok && opts.Migrating() {
+		return stores[1].Get(ctx, domain, shortURL)
+	}
+	return record, ok, err
+}
+
+// updateLink changes the link in every storage, returning it as the storage read first has it
+func updateLink(ctx context.Context, domain, shortURL, changedBy string, update func(*store.Record), opts *config.Options) (store.Record, bool, error) {
+	var found store.Record
+	var ok bool
+	for _, links := range linkStores(opts) {
+		record, exists, err := links.Update(ctx, domain, shortURL, changedBy, update)
+		if err != nil {
+			return store.Record{}, false, err
+		}
+		if exists && !ok {
+			found, ok = record, true
+		}
+	}
+	return found, ok, nil
+}
+
+// deleteLink removes the link from every storage
+func deleteLink(ctx context.Context, domain, shortURL string, opts *config.Options) (bool, error) {
+	deleted := false
+	for _, links := range linkStores(opts) {
+		exists, err := links.Delete(ctx, domain, shortURL)
+		if err != nil {
+			return false, err
+		}
+		deleted = deleted || exists
+	}
+	return deleted, nil
+}
+
+// encodeCursor returns the opaque cursor of the page after the link
+func encodeCursor(record store.Record) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(record.Domain + "\x00" + record.ShortURL))
+}
+
+func decodeCursor(cursor string) (*store.LinkCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errCursor
+	}
+	domain, shortURL, ok := strings.Cut(string(data), "\x00")
+	if !ok {
+		return nil, errCursor
+	}
+	return &store.LinkCursor{Domain: domain, ShortURL: shortURL}, nil
+}
+
+// parseTimeParam parses an RFC 3339 time or a date, zero if empty
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// linkFilter reads the filter of a listing from the query string
+func linkFilter(r *http.Request, opts *config.Options) (store.LinkFilter, *problems.Problem) {
+	query := r.URL.Query()
+	invalid := func(name string, err error) *problems.Problem {
+		return problems.New(http.StatusBadRequest, problems.CodeInvalidParameter, name+": "+err.Error())
+	}
+	filter := store.LinkFilter{Search: query.Get("q"), Text: query.Get("search")}
+	for _, tag := range query["tag"] {
+		filter.Tags = append(filter.Tags, validator.NormalizeTag(tag))
+	}
+	var err error
+	if query.Has("domain") {
+		domain, err := creationDomain("", query.Get("domain"), opts)
+		if err != nil {
+			return filter, invalid("domain", err)
+		}
+		filter.Domain = &domain.Namespace
+	}
+	if filter.CreatedAfter, err = parseTimeParam(query.Get("created_after")); err != nil {
+		return filter, invalid("created_after", err)
+	}
+	if filter.CreatedBefore, err = parseTimeParam(query.Get("created_before")); err != nil {
+		return filter, invalid("created_before", err)
+	}
+	if filter.Limit, err = intParam(query.Get("limit"), defaultLinksPage, 1, maxLinksPage); err != nil {
+		return filter, invalid("limit", err)
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		if filter.After, err = decodeCursor(cursor); err != nil {
+			return filter, invalid("cursor", err)
+		}
+	}
+	return filter, nil
+}
+
+// ListLinks returns a page of the links matching the filter of the query string: domain, q (a substring of the
+// short or the original URL), search (words of the title or the original URL), tag (repeated for links having
+// every tag), created_after and created_before. The next page is requested with the cursor returned.
+func ListLinks(opts *config.Options) http.HandlerFunc {
+	return requireAdmin(opts, func(w http.ResponseWriter, r *http.Request) {
+		filter, p := linkFilter(r, opts)
+		if p != nil {
+			problems.Write(w, r, p)
+			return
+		}
+		// One more link tells whether there is a next page
+		limit := filter.Limit
+		filter.Limit++
+		records, err := linkStores(opts)[0].List(r.Context(), filter)
+		if err != nil {
+			storeProblem(w, r, err)
+			return
+		}
+
+		response := AdminLinksResponse{Links: make([]AdminLink, 0, min(len(records), limit))}
+		if len(records) > limit {
+			records = records[:limit]
+			response.NextCursor = encodeCursor(records[limit-1])
+		}
+		for _, record := range records {
+			response.Links = append(response.Links, newAdminLink(record, opts))
+		}
+		writeAdminJSON(w, http.StatusOK, response)
+	})
+}
+
+// adminLinkKey returns the domain namespace and the short URL of the link of the request,
+// the domain is given as a query parameter and defaults to the main one
+func adminLinkKey(w http.ResponseWriter, r *http.Request, opts *config.Options) (string, string, bool) {
+	domain, err := creationDomain("", r.URL.Query().Get("domain"), opts)
+	if err != nil {
+		problem(w, r, http.StatusBadRequest, problems.CodeInvalidParameter, "domain: "+err.Error())
+		return "", "", false
+	}
+	return domain.Namespace, mux.Vars(r)["shortURL"], true
+}
+
+// GetLink returns a link
+func GetLink(opts *config.Options) http.HandlerFunc {
+	return requireAdmin(opts, func(w http.ResponseWriter, r *http.Request) {
+		domain, shortURL, ok := adminLinkKey(w, r, opts)
+		if !ok {
+			return
+		}
+		record, ok, err := getLink(r.Context(), domain, shortURL, opts)
+		if err != nil {
+			storeProblem(w, r, err)
+			return
+		}
+		if !ok {
+			problem(w, r, http.StatusNotFound, problems.CodeNotFound, errLinkNotFound.Error())
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, newAdminLink(record, opts))
+	})
+}
+
+// UpdateLink changes the target of a link or disables and enables it
+func UpdateLink(opts *config.Options) http.HandlerFunc {
+	return requireAdmin(opts, func(w http.ResponseWriter, r *http.Request) {
+		domain, shortURL, ok := adminLinkKey(w, r, opts)
+		if !ok {
+			return
+		}
+		var request AdminLinkUpdate
+		if p := decodeJSON(w, r, &request); p != nil {
+			problems.Write(w, r, p)
+			return
+		}
+		if request.OriginalURL == nil && request.Disabled == nil {
+			problem(w, r, http.StatusBadRequest, problems.CodeInvalidBody, errNoUpdate.Error())
+			return
+		}
+		var originalURL string
+		if request.OriginalURL != nil {
+			var err error
+			if originalURL, err = validator.NormalizeURL(*request.OriginalURL, opts); err != nil {
+				problems.Write(w, r, problems.New(http.StatusBadRequest, problems.CodeInvalidRequest, "",
+					problems.FieldError{Field: "/original_url", Code: FieldInvalidURL, Detail: err.Error()}))
+				return
+			}
+			if err = checkDomain(originalURL); err != nil {
+				problems.Write(w, r, problems.New(http.StatusUnprocessableEntity, problems.CodeBlockedDomain, "",
+					problems.FieldError{Field: "/original_url", Code: FieldBlockedDomain, Detail: err.Error()}))
+				return
+			}
+		}
+
+		record, ok, err := updateLink(r.Context(), domain, shortURL, adminUser(r), func(record *store.Record) {
+			if request.OriginalURL != nil {
+				record.OriginalURL = originalURL
+			}
+			if request.Disabled != nil {
+				record.Disabled = *request.Disabled
+			}
+		}, opts)
+		if err != nil {
+			storeProblem(w, r, err)
+			return
+		}
+		if !ok {
+			problem(w, r, http.StatusNotFound, problems.CodeNotFound, errLinkNotFound.Error())
+			return
+		}
+		log.Info().Str("link", store.Key(domain, shortURL)).Str("admin", adminUser(r)).Msg("Link updated by admin")
+		writeAdminJSON(w, http.StatusOK, newAdminLink(record, opts))
+	})
+}
+
+// DeleteLink removes a link for good, its short URL can be used again
+func DeleteLink(opts *config.Options) http.HandlerFunc {
+	return requireAdmin(opts, func(w http.ResponseWriter, r *http.Request) {
+		domain, shortURL, ok := adminLinkKey(w, r, opts)
+		if !ok {
+			return
+		}
+		deleted, err := deleteLink(r.Context(), domain, shortURL, opts)
+		if err != nil {
+			storeProblem(w, r, err)
+			return
+		}
+		if !deleted {
+			problem(w, r, http.StatusNotFound, problems.CodeNotFound, errLinkNotFound.Error())
+			return
+		}
+		log.Info().Str("link", store.Key(domain, shortURL)).Str("admin", adminUser(r)).Msg("Link deleted by admin")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// writeAdminJSON writes a response of the admin API, which is never cached
+func writeAdminJSON(w http.ResponseWriter, status int, response any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Error().Err(err).Msg("Error encoding response")
+	}
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"shortener/internal/config"
+	"shortener/internal/store"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// adminRequest serves an admin API request with the token
+func adminRequest(handler http.HandlerFunc, method, target, body, shortURL string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	if shortURL != "" {
+		req = mux.SetURLVars(req, map[string]string{"shortURL": shortURL})
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAdminAuth(t *testing.T) {
+	opts := config.Options{BaseURL: "http://localhost:8080"}
+	rr := httptest.NewRecorder()
+	ListLinks(&opts).ServeHTTP(rr, httptest.NewRequest("GET", "/api/admin/links", nil))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("disabled admin API returned %v", rr.Code)
+	}
+
+	opts.AdminToken = "secret, alice:alices-secret"
+	for _, header := range []string{"", "Bearer wrong", "secret", "Bearer alice", "Bearer alice:alices-secret"} {
+		req := httptest.NewRequest("GET", "/api/admin/links", nil)
+		req.Header.Set("Authorization", header)
+		rr = httptest.NewRecorder()
+		ListLinks(&opts).ServeHTTP(rr, req)
+		if rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Authorization %q returned %v", header, rr.Code)
+		}
+	}
+	for token, want := range map[string]string{"secret": "admin", "alices-secret": "alice"} {
+		if user, ok := opts.AdminUser(token); !ok || user != want {
+			t.Errorf("AdminUser(%s) = %s, %v", token, user, ok)
+		}
+	}
+}
+
+func TestAdminListLinks(t *testing.T) {
+	store.New()
+	opts := config.Options{BaseURL: "http://localhost:8080", Domains: "http://go.example", AdminToken: "secret"}
+	created := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	for i, link := range []struct{ domain, shortURL, url string }{
+		{"", "b", "https://example.com/news"},
+		{"", "a", "https://example.com/blog"},
+		{"", "c", "https://other.example/NEWS"},
+		{"go.example", "a", "https://example.com/go"},
+	} {
+		store.Store.Save(store.Key(link.domain, link.shortURL), store.MapValues{
+			Value: link.url, UUID: "uuid", Domain: link.domain, CreatedAt: created.AddDate(0, 0, i),
+		}, &opts)
+	}
+	list := func(query string) AdminLinksResponse {
+		t.Helper()
+		rr := adminRequest(ListLinks(&opts), "GET", "/api/admin/links?"+query, "", "")
+		var response AdminLinksResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || rr.Code != http.StatusOK {
+			t.Fatalf("list %q returned %v %s", query, rr.Code, rr.Body.String())
+		}
+		return response
+	}
+	aliases := func(response AdminLinksResponse) string {
+		var links []string
+		for _, link := range response.Links {
+			links = append(links, link.Domain+"/"+link.Alias)
+		}
+		return strings.Join(links, " ")
+	}
+
+	// Pages follow each other in order of domain and short URL
+	page := list("limit=3")
+	if got := aliases(page); got != "localhost:8080/a localhost:8080/b localhost:8080/c" || page.NextCursor == "" {
+		t.Fatalf("first page = %s, cursor %q", got, page.NextCursor)
+	}
+	page = list("limit=3&cursor=" + page.NextCursor)
+	if got := aliases(page); got != "go.example/a" || page.NextCursor != "" {
+		t.Errorf("second page = %s, cursor %q", got, page.NextCursor)
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{query: "domain=go.example", want: "go.example/a"},
+		{query: "domain=localhost:8080&q=news", want: "localhost:8080/b localhost:8080/c"},
+		{query: "q=BLOG", want: "localhost:8080/a"},
+		{query: "created_after=2024-05-01&created_before=" + url.QueryEscape("2024-05-04T00:00:00Z"), want: "localhost:8080/a localhost:8080/c"},
+	}
+	for _, tt := range tests {
+		if got := aliases(list(tt.query)); got != tt.want {
+			t.Errorf("list %q = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+
+	for _, query := range []string{"domain=unknown.example", "limit=0", "cursor=%21", "created_after=yesterday"} {
+		rr := adminRequest(ListLinks(&opts), "GET", "/api/admin/links?"+query, "", "")
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("list %q returned %v", query, rr.Code)
+		}
+	}
+}
+
+func TestAdminEditLink(t *testing.T) {
+	store.New()
+	opts := config.Options{BaseURL: "http://localhost:8080", FileStore: filepath.Join(t.TempDir(), "links.json"), AdminToken: "secret"}
+	store.Store.Save("abc", store.MapValues{Value: "https://example.com/old"}, &opts)
+
+	rr := adminRequest(GetLink(&opts), "GET", "/api/admin/links/abc", "", "abc")
+	var link AdminLink
+	if err := json.Unmarshal(rr.Body.Bytes(), &link); err != nil || rr.Code != http.StatusOK || link.OriginalURL != "https://example.com/old" {
+		t.Fatalf("get returned %v %s", rr.Code, rr.Body.String())
+	}
+
+	// Invalid changes are rejected
+	for _, body := range []string{`{}`, `{"original_url": "not a url"}`, `{"disabled": "yes"}`} {
+		if rr = adminRequest(UpdateLink(&opts), "PATCH", "/api/admin/links/abc", body, "abc"); rr.Code != http.StatusBadRequest {
+			t.Errorf("update %s returned %v", body, rr.Code)
+		}
+	}
+
+	// A new target is redirected to, a disabled link is gone
+	rr = adminRequest(UpdateLink(&opts), "PATCH", "/api/admin/links/abc", `{"original_url": "https://example.com/new", "disabled": true}`, "abc")
+	if err := json.Unmarshal(rr.Body.Bytes(), &link); err != nil || rr.Code != http.StatusOK || link.OriginalURL != "https://example.com/new" || !link.Disabled {
+		t.Fatalf("update returned %v %s", rr.Code, rr.Body.String())
+	}
+	redirectTo := func() *httptest.ResponseRecorder {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/abc", nil), map[string]string{"shortURL": "abc"})
+		rr := httptest.NewRecorder()
+		RedirectToURL(&opts).ServeHTTP(rr, req)
+		return rr
+	}
+	if rr = redirectTo(); rr.Code != http.StatusGone {
+		t.Errorf("redirect of a disabled link returned %v", rr.Code)
+	}
+	adminRequest(UpdateLink(&opts), "PATCH", "/api/admin/links/abc", `{"disabled": false}`, "abc")
+	if rr = redirectTo(); rr.Code != http.StatusTemporaryRedirect || rr.Header().Get("Location") != "https://example.com/new" {
+		t.Errorf("redirect returned %v %s", rr.Code, rr.Header().Get("Location"))
+	}
+
+	// Changes are saved to the file
+	store.New()
+	if err := store.Store.LoadFromFile(opts.FileStore); err != nil {
+		t.Fatal(err)
+	}
+	if values, ok := store.Store.Find("abc"); !ok || values.Value != "https://example.com/new" {
+		t.Errorf("file has %+v", values)
+	}
+
+	if rr = adminRequest(DeleteLink(&opts), "DELETE", "/api/admin/links/abc", "", "abc"); rr.Code != http.StatusNoContent {
+		t.Errorf("delete returned %v", rr.Code)
+	}
+	for _, handler := range []http.HandlerFunc{GetLink(&opts), DeleteLink(&opts)} {
+		if rr = adminRequest(handler, "GET", "/api/admin/links/abc", "", "abc"); rr.Code != http.StatusNotFound {
+			t.Errorf("deleted link returned %v", rr.Code)
+		}
+	}
+	if rr = redirectTo(); rr.Code != http.StatusNotFound {
+		t.Errorf("redirect of a deleted link returned %v", rr.Code)
+	}
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"shortener/internal/config"
+	"shortener/internal/problems"
+	"shortener/internal/store"
+	"strconv"
+)
+
+// maxClicksHeader the header to limit clicks of a link created from a plain text body
+const maxClicksHeader = "X-Max-Clicks"
+
+var (
+	errMaxClicks = errors.New("max_clicks must not be negative")
+	errExhausted = errors.New("link has no clicks left")
+)
+
+// parseMaxClicksHeader reads the optional click limit of a link created from a plain text body
+func parseMaxClicksHeader(r *http.Request) (int, error) {
+	value := r.Header.Get(maxClicksHeader)
+	if value == "" {
+		return 0, nil
+	}
+	maxClicks, err := strconv.Atoi(value)
+	if err != nil || maxClicks < 0 {
+		return 0, errMaxClicks
+	}
+	return maxClicks, nil
+}
+
+// consumeClick counts a click of a limited link right before redirecting.
+// Writes 410 Gone and returns false if another request took the last click.
+func consumeClick(w http.ResponseWriter, r *http.Request, shortURL string, link store.MapValues, opts *config.Options) bool {
+	if link.MaxClicks == 0 {
+		return true
+	}
+
+	ctx := r.Context()
+	ok, err := consumeClickIn(ctx, opts.PrefersDB(), link.Domain, shortURL, opts)
+	if err == nil && opts.Migrating() {
+		// Keep the old storage in step, it decides if the link was not copied to the new one yet
+		okOld, errOld := consumeClickIn(ctx, !opts.PrefersDB(), link.Domain, shortURL, opts)
+		if !ok {
+			var exists bool
+			if _, exists, err = findURLIn(ctx, opts.PrefersDB(), link.Domain, shortURL); err == nil && !exists {
+				ok, err = okOld, errOld
+			}
+		}
+	}
+	if err != nil {
+		storeProblem(w, r, err)
+		return false
+	}
+	if !ok {
+		problem(w, r, http.StatusGone, problems.CodeLinkExhausted, errExhausted.Error())
+	}
+	return ok
+}
+
+// consumeClickIn counts a click in the DB or in the in-memory store
+func consumeClickIn(ctx context.Context, db bool, domain, shortURL string, opts *config.Options) (bool, error) {
+	if db {
+		return store.ConsumeClickInDB(ctx, domain, shortURL)
+	}
+	return store.Store.ConsumeClick(store.Key(domain, shortURL), opts), nil
+}
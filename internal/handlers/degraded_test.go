@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"shortener/internal/config"
+	"shortener/internal/jobs"
+	"shortener/internal/problems"
+	"shortener/internal/store"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestDegradedMode(t *testing.T) {
+	store.New()
+	db, err := sql.Open("hanging", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	oldDB, oldTimeout, oldCache, oldJournal := store.DB, store.QueryTimeout, store.Cache, store.DBJournal
+	defer func() {
+		store.DB, store.QueryTimeout, store.Cache, store.DBJournal = oldDB, oldTimeout, oldCache, oldJournal
+	}()
+	defer resetBreaker()()
+	store.DB, store.QueryTimeout = db, 20*time.Millisecond
+	store.DBBreaker = store.NewBreaker(1, time.Minute)
+	store.Cache = store.NewLinkCache(10)
+	store.DBJournal, err = store.OpenJournal(filepath.Join(t.TempDir(), "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := config.Options{BaseURL: "http://localhost:8080", ConnectionString: "hanging"}
+
+	// New links are journaled while the database does not answer
+	rr := httptest.NewRecorder()
+	ShortenURLFromJSON(&opts).ServeHTTP(rr, httptest.NewRequest("POST", "/api/shorten", strings.NewReader(`{"url": "https://example.com/degraded"}`)))
+	var response ShortenURLResponse
+	if err = json.Unmarshal(rr.Body.Bytes(), &response); err != nil || rr.Code != http.StatusCreated {
+		t.Fatalf("shorten returned %v %s", rr.Code, rr.Body.String())
+	}
+	if store.DBJournal.Pending() != 1 {
+		t.Errorf("journal has %d links, want 1", store.DBJournal.Pending())
+	}
+	if store.DBBreaker.State() != store.BreakerOpen {
+		t.Errorf("breaker is %s", store.DBBreaker.State())
+	}
+
+	// A protected link can't be created while its short URL can't be checked: the database may have
+	// a link of the same URL under the short URL derived from it, which the replay would keep
+	for _, body := range []string{`{"url": "https://example.com/in-database", "password": "secret"}`, `{"url": "https://example.com/in-database", "max_clicks": 3}`} {
+		rr = httptest.NewRecorder()
+		ShortenURLFromJSON(&opts).ServeHTTP(rr, httptest.NewRequest("POST", "/api/shorten", strings.NewReader(body)))
+		var p problems.Problem
+		if err = json.Unmarshal(rr.Body.Bytes(), &p); err != nil || rr.Code != http.StatusServiceUnavailable || p.Code != problems.CodeUnavailable || rr.Header().Get("Retry-After") == "" {
+			t.Errorf("protected shorten returned %v %s", rr.Code, rr.Body.String())
+		}
+	}
+	if store.DBJournal.Pending() != 1 {
+		t.Errorf("journal has %d links, want 1", store.DBJournal.Pending())
+	}
+
+	// and redirected from the cache
+	shortURL := response.ShortURL[strings.LastIndex(response.ShortURL, "/")+1:]
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/"+shortURL, nil), map[string]string{"shortURL": shortURL})
+	rr = httptest.NewRecorder()
+	RedirectToURL(&opts).ServeHTTP(rr, req)
+	if rr.Code != http.StatusTemporaryRedirect || rr.Header().Get("Location") != "https://example.com/degraded" {
+		t.Errorf("redirect returned %v %s", rr.Code, rr.Header().Get("Location"))
+	}
+
+	// Links missing from the cache are unavailable, without waiting for the database
+	req = mux.SetURLVars(httptest.NewRequest("GET", "/missing", nil), map[string]string{"shortURL": "missing"})
+	rr = httptest.NewRecorder()
+	start := time.Now()
+	RedirectToURL(&opts).ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" || time.Since(start) > 10*time.Millisecond {
+		t.Errorf("redirect of a missing link returned %v after %v", rr.Code, time.Since(start))
+	}
+
+	// The service stays ready, degraded
+	queue := jobs.NewQueue(jobs.NewMemoryStore(), func(context.Context, *jobs.Job, func([]json.RawMessage) error) error { return nil }, 1, 1, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err = queue.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); queue.Running() < 1 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	rr = httptest.NewRecorder()
+	Readyz(&opts, queue).ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+	var health HealthResponse
+	if err = json.Unmarshal(rr.Body.Bytes(), &health); err != nil || rr.Code != http.StatusOK || health.Status != HealthDegraded {
+		t.Fatalf("Readyz returned %v %s", rr.Code, rr.Body.String())
+	}
+	if database := health.Components["database"]; database.Status != HealthDegraded || database.Breaker != store.BreakerOpen || database.Journaled != 1 {
+		t.Errorf("database health = %+v", database)
+	}
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+	"html/template"
+	"net/http"
+	"net/url"
+	"shortener/internal/config"
+	"shortener/internal/problems"
+	"shortener/internal/store"
+	"strings"
+)
+
+// maxExpandBatch the maximum number of links in one batch expand request
+const maxExpandBatch = 1000
+
+// ExpandResponse represents a resolved short link
+type ExpandResponse struct {
+	ShortURL    string   `json:"short_url"`
+	OriginalURL string   `json:"original_url,omitempty"`
+	UUID        string   `json:"uuid,omitempty"`
+	Domain      string   `json:"domain,omitempty"`
+	QRCode      string   `json:"qr_code,omitempty"`
+	Found       bool     `json:"found"`
+	Blocked     string   `json:"blocked,omitempty"`
+	Protected   bool     `json:"protected,omitempty"`
+	Disabled    bool     `json:"disabled,omitempty"`
+	MaxClicks   int      `json:"max_clicks,omitempty"`
+	Clicks      int      `json:"clicks,omitempty"`
+	Title       string   `json:"title,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// expand resolves a short link of the domain without following it, an error means the store could not be read
+func expand(ctx context.Context, domain config.Domain, shortURL string, opts *config.Options) (ExpandResponse, error) {
+	// Accept full short links as well as bare IDs, full links may be of another domain
+	if u, err := url.Parse(shortURL); err == nil && u.Host != "" {
+		if linkDomain, ok := opts.DomainByHost(u.Host); ok {
+			domain = linkDomain
+		}
+		shortURL = strings.TrimPrefix(shortURL, domain.BaseURL+"/")
+	}
+	response := ExpandResponse{ShortURL: fmt.Sprintf("%s/%s", domain.BaseURL, shortURL)}
+
+	link, ok, err := findURL(ctx, domain.Namespace, shortURL, opts)
+	if !ok || err != nil {
+		return response, err
+	}
+	response.Found = true
+	response.UUID = link.UUID
+	response.QRCode = response.ShortURL + "/qr"
+	response.MaxClicks = link.MaxClicks
+	response.Clicks = link.Clicks
+	// The target of a disabled link is not revealed, the one of a protected link only with the password
+	if link.Disabled {
+		response.Disabled = true
+		return response, nil
+	}
+	if link.PasswordHash != "" {
+		response.Protected = true
+		return response, nil
+	}
+	response.OriginalURL = link.Value
+	response.Title, response.Description, response.Tags = link.Title, link.Description, store.SplitTags(link.Tags)
+	if u, err := url.Parse(link.Value); err == nil {
+		response.Domain = u.Hostname()
+	}
+	if err := checkDomain(link.Value); err != nil {
+		response.Blocked = err.Error()
+	}
+	return response, nil
+}
+
+// Expand returns the original URL and metadata of a short link as JSON
+func Expand(opts *config.Options) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response, err := expand(r.Context(), requestDomain(r, opts), mux.Vars(r)["shortURL"], opts)
+		if err != nil {
+			storeProblem(w, r, err)
+			return
+		}
+		if !response.Found {
+			problem(w, r, http.StatusNotFound, problems.CodeNotFound, errLinkNotFound.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(response)
+		if err != nil {
+			log.Error().Err(err).Msg("Error encoding response")
+		}
+	}
+}
+
+// BatchExpand resolves a list of short links, given as IDs or full short URLs.
+// Unknown links are reported with found set to false.
+func BatchExpand(opts *config.Options) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var shortURLs []string
+		err := json.NewDecoder(r.Body).Decode(&shortURLs)
+		if err != nil {
+			problem(w, r, http.StatusBadRequest, problems.CodeInvalidBody, jsonErrorDetail(err))
+			return
+		}
+		if len(shortURLs) > maxExpandBatch {
+			problem(w, r, http.StatusRequestEntityTooLarge, problems.CodeTooLarge, fmt.Sprintf("too many links, the maximum is %d", maxExpandBatch))
+			return
+		}
+
+		responses := make([]ExpandResponse, 0, len(shortURLs))
+		for _, shortURL := range shortURLs {
+			response, err := expand(r.Context(), requestDomain(r, opts), shortURL, opts)
+			if err != nil {
+				storeProblem(w, r, err)
+				return
+			}
+			responses = append(responses, response)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(responses)
+		if err != nil {
+			log.Error().Err(err).Msg("Error encoding response")
+		}
+	}
+}
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex, nofollow">
+<title>Link preview</title>
+</head>
+<body>
+<h1>Link preview</h1>
+{{if .Protected}}<p>The short link <code>{{.ShortURL}}</code> is password protected.</p>
+<p><a href="{{.ShortURL}}" rel="nofollow">Enter the password</a></p>
+{{else}}<p>The short link <code>{{.ShortURL}}</code> leads to:</p>
+<p><strong>{{.Domain}}</strong></p>
+<p><code>{{.OriginalURL}}</code></p>
+{{if .Blocked}}<p>This link is blocked: {{.Blocked}}</p>{{else}}<p><a href="{{.OriginalURL}}" rel="noopener noreferrer nofollow">Continue to the site</a></p>{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// Preview shows the destination of a short link as a page instead of redirecting
+func Preview(opts *config.Options) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response, err := expand(r.Context(), requestDomain(r, opts), mux.Vars(r)["shortURL"], opts)
+		if err != nil {
+			storeProblem(w, r, err)
+			return
+		}
+		if !response.Found {
+			problem(w, r, http.StatusNotFound, problems.CodeNotFound, errLinkNotFound.Error())
+			return
+		}
+		// Like a redirect, there is no target to show
+		if response.Disabled {
+			problem(w, r, http.StatusGone, problems.CodeLinkDisabled, errLinkDisabled.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+		if response.Blocked != "" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+		err = previewTemplate.Execute(w, response)
+		if err != nil {
+			log.Error().Err(err).Msg("Error rendering preview")
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"shortener/internal/config"
+	"shortener/internal/problems"
+	"shortener/internal/store"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestExpand(t *testing.T) {
+	store.New()
+	opts := config.Options{BaseURL: "http://localhost:8080"}
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for shortURL, values := range map[string]store.MapValues{
+		"open":      {Value: "https://example.com/page", UUID: "1"},
+		"disabled":  {Value: "https://example.com/disabled", Disabled: true, UUID: "2"},
+		"protected": {Value: "https://example.com/protected", PasswordHash: hash, UUID: "3"},
+		"exhausted": {Value: "https://example.com/exhausted", MaxClicks: 2, Clicks: 2, UUID: "4"},
+	} {
+		store.Store.Save(shortURL, values, &opts)
+	}
+
+	expandOne := func(shortURL string) (*httptest.ResponseRecorder, ExpandResponse) {
+		t.Helper()
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/api/expand/"+shortURL, nil), map[string]string{"shortURL": shortURL})
+		rr := httptest.NewRecorder()
+		Expand(&opts).ServeHTTP(rr, req)
+		var response ExpandResponse
+		if rr.Code == http.StatusOK {
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rr, response
+	}
+
+	tests := []struct {
+		shortURL string
+		want     ExpandResponse
+	}{
+		{shortURL: "open", want: ExpandResponse{ShortURL: "http://localhost:8080/open", OriginalURL: "https://example.com/page",
+			UUID: "1", Domain: "example.com", QRCode: "http://localhost:8080/open/qr", Found: true}},
+		// Full short links are accepted too
+		{shortURL: "http://localhost:8080/open", want: ExpandResponse{ShortURL: "http://localhost:8080/open", OriginalURL: "https://example.com/page",
+			UUID: "1", Domain: "example.com", QRCode: "http://localhost:8080/open/qr", Found: true}},
+		{shortURL: "disabled", want: ExpandResponse{ShortURL: "http://localhost:8080/disabled", UUID: "2", QRCode: "http://localhost:8080/disabled/qr",
+			Found: true, Disabled: true}},
+		{shortURL: "protected", want: ExpandResponse{ShortURL: "http://localhost:8080/protected", UUID: "3", QRCode: "http://localhost:8080/protected/qr",
+			Found: true, Protected: true}},
+		{shortURL: "exhausted", want: ExpandResponse{ShortURL: "http://localhost:8080/exhausted", OriginalURL: "https://example.com/exhausted",
+			UUID: "4", Domain: "example.com", QRCode: "http://localhost:8080/exhausted/qr", Found: true, MaxClicks: 2, Clicks: 2}},
+	}
+	for _, tt := range tests {
+		rr, got := expandOne(tt.shortURL)
+		if rr.Code != http.StatusOK || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expand %q returned %v %+v, want %+v", tt.shortURL, rr.Code, got, tt.want)
+		}
+	}
+	if rr, _ := expandOne("missing"); rr.Code != http.StatusNotFound || rr.Header().Get("Content-Type") != "application/problem+json" {
+		t.Errorf("expand missing returned %v %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+}
+
+func TestBatchExpand(t *testing.T) {
+	store.New()
+	opts := config.Options{BaseURL: "http://localhost:8080"}
+	store.Store.Save("open", store.MapValues{Value: "https://example.com/page"}, &opts)
+
+	batch := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		BatchExpand(&opts).ServeHTTP(rr, httptest.NewRequest("POST", "/api/expand", strings.NewReader(body)))
+		return rr
+	}
+
+	rr := batch(`["open", "http://localhost:8080/missing"]`)
+	var responses []ExpandResponse
+	if err := json.NewDecoder(rr.Body).Decode(&responses); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("batch expand returned %v, %v", rr.Code, err)
+	}
+	if len(responses) != 2 || !responses[0].Found || responses[0].OriginalURL != "https://example.com/page" ||
+		responses[1].Found || responses[1].ShortURL != "http://localhost:8080/missing" {
+		t.Errorf("batch expand = %+v", responses)
+	}
+
+	links := make([]string, maxExpandBatch)
+	for i := range links {
+		links[i] = "open"
+	}
+	body, _ := json.Marshal(links)
+	if rr = batch(string(body)); rr.Code != http.StatusOK {
+		t.Errorf("batch of %d links returned %v", maxExpandBatch, rr.Code)
+	}
+	body, _ = json.Marshal(append(links, "open"))
+	if rr = batch(string(body)); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("batch of %d links returned %v", maxExpandBatch+1, rr.Code)
+	}
+	if rr = batch(`{`); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid batch returned %v", rr.Code)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	store.New()
+	opts := config.Options{BaseURL: "http://localhost:8080"}
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Store.Save("open", store.MapValues{Value: "https://example.com/page?a=1&b=<2>"}, &opts)
+	store.Store.Save("protected", store.MapValues{Value: "https://example.com/protected", PasswordHash: hash}, &opts)
+	store.Store.Save("disabled", store.MapValues{Value: "https://example.com/disabled", Disabled: true}, &opts)
+
+	// The preview is served on the short link followed by a plus, next to the redirect
+	r := mux.NewRouter()
+	r.HandleFunc("/{shortURL:[^/+]+}+", Preview(&opts)).Methods("GET")
+	r.HandleFunc("/{shortURL}", RedirectToURL(&opts)).Methods("GET")
+	preview := func(target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		return rr
+	}
+
+	rr := preview("/open+")
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "text/html; charset=utf-8" || rr.Header().Get("X-Robots-Tag") != "noindex, nofollow" {
+		t.Fatalf("preview returned %v %v", rr.Code, rr.Header())
+	}
+	if body := rr.Body.String(); !strings.Contains(body, "https://example.com/page?a=1&amp;b=%3c2%3e") || !strings.Contains(body, "<strong>example.com</strong>") {
+		t.Errorf("preview body = %s", body)
+	}
+
+	rr = preview("/protected+")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "password protected") || strings.Contains(rr.Body.String(), "example.com/protected") {
+		t.Errorf("protected preview returned %v: %s", rr.Code, rr.Body)
+	}
+	rr = preview("/disabled+")
+	var p problems.Problem
+	if err = json.Unmarshal(rr.Body.Bytes(), &p); err != nil || rr.Code != http.StatusGone || p.Code != problems.CodeLinkDisabled {
+		t.Errorf("disabled preview returned %v: %s", rr.Code, rr.Body)
+	}
+	if rr = preview("/missing+"); rr.Code != http.StatusNotFound {
+		t.Errorf("missing preview returned %v", rr.Code)
+	}
+	if rr = preview("/open"); rr.Code == http.StatusOK {
+		t.Errorf("redirect returned %v", rr.Code)
+	}
+}
@@ -1,21 +1,43 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/rs/zerolog/log"
 	"io"
 	"net/http"
 	"net/url"
+	"path"
 	"shortener/internal/config"
+	"shortener/internal/domainrules"
 	"shortener/internal/generator"
+	"shortener/internal/problems"
 	"shortener/internal/store"
+	"shortener/internal/validator"
+)
+
+var (
+	errUnknownDomain    = errors.New("domain is not configured")
+	errLinkNotFound     = errors.New("short link does not exist")
+	errLinkDisabled     = errors.New("short link is disabled")
+	errStoreTimeout     = errors.New("storage did not respond in time")
+	errStoreUnavailable = errors.New("storage is unavailable")
+	errUnverified       = errors.New("short URL can't be checked while the storage is unavailable")
 )
 
 type ShortenURLRequest struct {
 	LongURL string `json:"url"`
+	store.Redirect
+	Password  string `json:"password,omitempty"`
+	MaxClicks int    `json:"max_clicks,omitempty"`
+	store.Forward
+	Domain      string   `json:"domain,omitempty"`
+	Title       string   `json:"title,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
 }
 
 type ShortenURLResponse struct {
@@ -26,48 +48,74 @@ func ShortenURL(opts *config.Options) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		dbExists := opts.ConnectionString != ""
 		// Read the long URL from the request body
-		longURL, err := io.ReadAll(r.Body)
+		rawURL, err := io.ReadAll(r.Body)
 		if err != nil {
-			http.Error(w, "Error reading request body", http.StatusBadRequest)
+			problem(w, r, http.StatusBadRequest, problems.CodeInvalidBody, "error reading request body")
 			return
 		}
 
 		// Check if the URL is valid
-		if _, err := url.ParseRequestURI(string(longURL)); err != nil {
-			http.Error(w, "Invalid URL", http.StatusBadRequest)
+		normalizedURL, err := validator.NormalizeURL(string(rawURL), opts)
+		if err != nil {
+			problem(w, r, http.StatusBadRequest, problems.CodeInvalidBody, "invalid URL: "+err.Error())
+			return
+		}
+		longURL := normalizedURL
+		if err = checkDomain(longURL); err != nil {
+			problem(w, r, http.StatusUnprocessableEntity, problems.CodeBlockedDomain, err.Error())
 			return
 		}
 
-		// Check if the URL is already in the store
-		if shortURL, ok := store.Store.ValueExistsInMap(string(longURL)); ok {
-			w.WriteHeader(http.StatusConflict)
-			_, _ = fmt.Fprintf(w, "%s/%s", opts.BaseURL, shortURL)
+		// Protect the link with a password and limit its clicks if requested
+		passwordHash, err := hashPassword(r.Header.Get(passwordHeader))
+		if err != nil {
+			problem(w, r, http.StatusBadRequest, problems.CodeInvalidParameter, passwordHeader+": "+err.Error())
 			return
 		}
+		maxClicks, err := parseMaxClicksHeader(r)
+		if err != nil {
+			problem(w, r, http.StatusBadRequest, problems.CodeInvalidParameter, maxClicksHeader+": "+err.Error())
+			return
+		}
+		domain := requestDomain(r, opts)
+		values := store.MapValues{Value: longURL, Domain: domain.Namespace, PasswordHash: passwordHash, MaxClicks: maxClicks, CreatedAt: store.Now()}
 
-		// Check if exists in DB
-		if dbExists {
-			if shortURL, exists := store.CheckIfExistsInDB(string(longURL)); exists {
+		// Check if the URL is already in the store or DB, protected and limited links are never shared
+		if values.Shareable() {
+			shortURL, ok, err := findShareable(r.Context(), domain.Namespace, longURL, opts)
+			if err != nil {
+				storeProblem(w, r, err)
+				return
+			}
+			if ok {
 				w.WriteHeader(http.StatusConflict)
-				_, _ = fmt.Fprintf(w, "%s/%s", opts.BaseURL, shortURL)
+				_, _ = fmt.Fprintf(w, "%s/%s", domain.BaseURL, shortURL)
 				return
 			}
 		}
 
-		// Generate a short URL
-		shortURL := generator.ShortURL(string(longURL), store.Store.GetStore())
-
-		// Save the URL
-		store.Store.Save(shortURL, string(longURL), "", opts)
+		// Generate a short URL that is free in every storage, links of batches may be in the database only
+		var lookupErr error
+		shortURL := generator.ShortURL(longURL, takenIn(r.Context(), domain.Namespace, nil, values.Shareable(), &lookupErr, opts))
+		if lookupErr != nil {
+			storeProblem(w, r, lookupErr)
+			return
+		}
 
-		// save to db if exists
+		// save to db if exists, first so a failure does not leave the link in memory only
 		if dbExists {
-			store.SaveToDB(shortURL, string(longURL), "")
+			if err = store.SaveToDB(r.Context(), shortURL, values); err != nil {
+				storeProblem(w, r, err)
+				return
+			}
 		}
 
+		// Save the URL
+		store.Store.Save(store.Key(domain.Namespace, shortURL), values, opts)
+
 		// Return the short URL
 		w.WriteHeader(http.StatusCreated)
-		_, _ = fmt.Fprintf(w, "%s/%s", opts.BaseURL, shortURL)
+		_, _ = fmt.Fprintf(w, "%s/%s", domain.BaseURL, shortURL)
 	}
 }
 
@@ -75,82 +123,242 @@ func RedirectToURL(opts *config.Options) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		shortURL := vars["shortURL"]
-		// Prio to DB
-		// Look up for the long URL in the DB
-		if opts.ConnectionString != "" {
-			longURL, ok := store.ReadFromDB(shortURL)
-			if !ok {
-				http.NotFound(w, r)
+		link, ok, err := findURL(r.Context(), requestDomain(r, opts).Namespace, shortURL, opts)
+		if err != nil {
+			storeProblem(w, r, err)
+			return
+		}
+		// A path after the short URL is only accepted by links forwarding it
+		if !ok || !acceptsPath(r, link, opts) {
+			problem(w, r, http.StatusNotFound, problems.CodeNotFound, errLinkNotFound.Error())
+			return
+		}
+		if link.Disabled {
+			problem(w, r, http.StatusGone, problems.CodeLinkDisabled, errLinkDisabled.Error())
+			return
+		}
+		// The rules may have changed since the link was created
+		if err := checkDomain(link.Value); err != nil {
+			problem(w, r, http.StatusForbidden, problems.CodeBlockedDomain, err.Error())
+			return
+		}
+		if link.Exhausted() {
+			problem(w, r, http.StatusGone, problems.CodeLinkExhausted, errExhausted.Error())
+			return
+		}
+		// Protected links need the password in the header, browsers get a form instead
+		if link.PasswordHash != "" {
+			password := r.Header.Get(passwordHeader)
+			if password == "" {
+				renderPasswordForm(w, r, "", http.StatusUnauthorized)
 				return
 			}
-			// Redirect to the long URL
-			http.Redirect(w, r, longURL, http.StatusTemporaryRedirect)
+			if status, err := verifyPassword(w, shortURL, link, password, opts); err != nil {
+				problem(w, r, status, passwordProblemCode(status), err.Error())
+				return
+			}
+		}
+		// Redirect to the long URL
+		if !consumeClick(w, r, shortURL, link, opts) {
 			return
 		}
+		redirect(w, r, link, opts)
+	}
+}
 
-		// Look up the long URL in in-memory store
-		if opts.ConnectionString == "" {
-			longURL, ok := store.Store.Find(shortURL)
-			if !ok {
-				http.NotFound(w, r)
-				return
+// redirect redirects to the long URL with the link redirect behavior, falling back to the service defaults
+func redirect(w http.ResponseWriter, r *http.Request, link store.MapValues, opts *config.Options) {
+	status := link.Redirect.Status
+	if status == 0 {
+		status = opts.RedirectStatus
+	}
+	if status == 0 {
+		status = http.StatusTemporaryRedirect
+	}
+	headers := map[string][2]string{
+		"Cache-Control":   {link.Redirect.CacheControl, opts.RedirectCacheControl},
+		"Referrer-Policy": {link.Redirect.ReferrerPolicy, opts.RedirectReferrerPolicy},
+		"X-Robots-Tag":    {link.Redirect.RobotsTag, opts.RedirectRobotsTag},
+	}
+	for name, values := range headers {
+		if values[0] != "" {
+			w.Header().Set(name, values[0])
+		} else if values[1] != "" {
+			w.Header().Set(name, values[1])
+		}
+	}
+	http.Redirect(w, r, forwardTarget(r, link, opts), status)
+}
+
+// acceptsPath reports whether the link is requested without a path after the short URL, or forwards the path
+func acceptsPath(r *http.Request, link store.MapValues, opts *config.Options) bool {
+	return mux.Vars(r)["rest"] == "" || link.Forward.Path || opts.ForwardPath
+}
+
+// forwardTarget builds the redirect target, forwarding the path suffix and the query string if enabled,
+// and adding the UTM parameters of the link
+func forwardTarget(r *http.Request, link store.MapValues, opts *config.Options) string {
+	rest := mux.Vars(r)["rest"]
+	forwardPath := (link.Forward.Path || opts.ForwardPath) && rest != ""
+	forwardQuery := (link.Forward.Query || opts.ForwardQuery) && r.URL.RawQuery != ""
+	utm := link.Forward.UTM.Values()
+	if !forwardPath && !forwardQuery && len(utm) == 0 {
+		return link.Value
+	}
+
+	target, err := url.Parse(link.Value)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to parse stored URL")
+		return link.Value
+	}
+	if forwardPath {
+		// The suffix is cleaned on its own, so it can't climb above the target path
+		target = target.JoinPath(path.Clean("/" + rest))
+	}
+	if forwardQuery || len(utm) > 0 {
+		query := target.Query()
+		// Parameters of the target win over the incoming ones
+		for name, values := range r.URL.Query() {
+			if forwardQuery && !query.Has(name) {
+				query[name] = values
 			}
-			// Redirect to the long URL
-			http.Redirect(w, r, longURL.Value, http.StatusTemporaryRedirect)
-			return
 		}
+		for name, value := range utm {
+			query.Set(name, value)
+		}
+		target.RawQuery = query.Encode()
+	}
+	return target.String()
+}
+
+// findURL looks up the long URL by its short URL in the domain namespace
+// During a storage migration the new storage is read first, the old one if the link was not copied yet
+func findURL(ctx context.Context, domain, shortURL string, opts *config.Options) (store.MapValues, bool, error) {
+	link, ok, err := findURLIn(ctx, opts.PrefersDB(), domain, shortURL)
+	if err == nil && !ok && opts.Migrating() {
+		return findURLIn(ctx, !opts.PrefersDB(), domain, shortURL)
+	}
+	return link, ok, err
+}
+
+// findURLIn looks up the long URL in the DB or in the in-memory store
+func findURLIn(ctx context.Context, db bool, domain, shortURL string) (store.MapValues, bool, error) {
+	if db {
+		return store.ReadFromDB(ctx, domain, shortURL)
+	}
+	link, ok := store.Store.Find(store.Key(domain, shortURL))
+	return link, ok, nil
+}
+
+// storeFailure returns the status, problem code and detail of a failed store operation:
+// 504 if the database did not answer in time, 503 otherwise
+func storeFailure(err error) (int, string, string) {
+	switch {
+	case errors.Is(err, errUnverified):
+		// Wraps the failure of the lookup, which is logged by the breaker
+		return http.StatusServiceUnavailable, problems.CodeUnavailable, errUnverified.Error()
+	case errors.Is(err, context.DeadlineExceeded):
+		log.Error().Err(err).Msg("Storage timed out")
+		return http.StatusGatewayTimeout, problems.CodeTimeout, errStoreTimeout.Error()
+	case errors.Is(err, context.Canceled):
+		// The client went away, nobody reads the response
+		log.Debug().Msg("Request canceled")
+		return http.StatusServiceUnavailable, problems.CodeUnavailable, "request was canceled"
+	case errors.Is(err, store.ErrCircuitOpen):
+		// Logged once by the breaker when it opened
+		return http.StatusServiceUnavailable, problems.CodeUnavailable, errStoreUnavailable.Error()
+	}
+	log.Error().Err(err).Msg("Storage error")
+	return http.StatusServiceUnavailable, problems.CodeUnavailable, errStoreUnavailable.Error()
+}
+
+// storeProblem writes the problem of a failed store operation
+func storeProblem(w http.ResponseWriter, r *http.Request, err error) {
+	status, code, detail := storeFailure(err)
+	// Transient errors are worth retrying soon
+	if status == http.StatusServiceUnavailable && (store.Retriable(err) || errors.Is(err, store.ErrCircuitOpen) || errors.Is(err, errUnverified)) {
+		w.Header().Set("Retry-After", "1")
+	}
+	problem(w, r, status, code, detail)
+}
+
+// requestDomain returns the domain the request was sent to, the main domain if the host is not configured
+func requestDomain(r *http.Request, opts *config.Options) config.Domain {
+	return hostDomain(r.Host, opts)
+}
+
+// hostDomain returns the domain serving the host, the main domain if the host is not configured
+func hostDomain(host string, opts *config.Options) config.Domain {
+	if domain, ok := opts.DomainByHost(host); ok {
+		return domain
+	}
+	return opts.MainDomain()
+}
+
+// creationDomain returns the domain to create a link on, the explicitly requested one or the one of the host the request was sent to
+func creationDomain(host, requested string, opts *config.Options) (config.Domain, error) {
+	if requested == "" {
+		return hostDomain(host, opts), nil
+	}
+	// Accept a base URL as well as a host
+	if u, err := url.Parse(requested); err == nil && u.Host != "" {
+		requested = u.Host
+	}
+	domain, ok := opts.DomainByHost(requested)
+	if !ok {
+		return config.Domain{}, errUnknownDomain
+	}
+	return domain, nil
+}
+
+// checkDomain checks the host of the URL against the domain allow and deny lists
+func checkDomain(longURL string) error {
+	u, err := url.Parse(longURL)
+	if err != nil {
+		return err
 	}
+	return domainrules.Rules.Check(u.Hostname())
 }
 
 func ShortenURLFromJSON(opts *config.Options) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		dbExists := opts.ConnectionString != ""
-		// Read the long URL from the request body
-		body, err := io.ReadAll(r.Body)
-		defer func(Body io.ReadCloser) {
-			err := Body.Close()
-			if err != nil {
-				log.Error().Err(err).Msg("Error closing request body")
-			}
-		}(r.Body)
-		w.Header().Set("Content-Type", "application/json")
-		if err != nil {
-			http.Error(w, "Error reading request body", http.StatusBadRequest)
-			return
-		}
 		var request ShortenURLRequest
-		err = json.Unmarshal(body, &request)
-		if err != nil {
-			http.Error(w, "Error unmarshalling request body", http.StatusBadRequest)
+		if p := decodeJSON(w, r, &request); p != nil {
+			problems.Write(w, r, p)
 			return
 		}
 
-		// Check if the URL is valid
-		if _, err := url.ParseRequestURI(request.LongURL); err != nil {
-			http.Error(w, "Invalid URL", http.StatusBadRequest)
+		// Check if the request is valid
+		record, domain, p := batchRecord(r.Host, BatchInsertRequest{
+			OriginalURL: request.LongURL,
+			Redirect:    request.Redirect,
+			Password:    request.Password,
+			MaxClicks:   request.MaxClicks,
+			Forward:     request.Forward,
+			Domain:      request.Domain,
+			Title:       request.Title,
+			Description: request.Description,
+			Tags:        request.Tags,
+		}, "", "url", "", opts)
+		if p != nil {
+			problems.Write(w, r, p)
 			return
 		}
+		values := record.Values()
+		w.Header().Set("Content-Type", "application/json")
 
-		// Check if the URL is already in the store
-		if shortURL, ok := store.Store.ValueExistsInMap(request.LongURL); ok {
-			w.WriteHeader(http.StatusConflict)
-			response := ShortenURLResponse{
-				ShortURL: fmt.Sprintf("%s/%s", opts.BaseURL, shortURL),
-			}
-			responseJSON, errMarshal := json.Marshal(response)
-			if errMarshal != nil {
-				log.Error().Err(errMarshal).Msg("Error marshalling response")
+		// Check if the URL is already in the store or DB, protected and limited links are never shared
+		if values.Shareable() {
+			shortURL, ok, err := findShareable(r.Context(), domain.Namespace, values.Value, opts)
+			if err != nil {
+				storeProblem(w, r, err)
 				return
 			}
-			_, _ = w.Write(responseJSON)
-			return
-		}
-		// Check if exists in DB
-		if dbExists {
-			if shortURL, exists := store.CheckIfExistsInDB(request.LongURL); exists {
+			if ok {
 				w.WriteHeader(http.StatusConflict)
 				response := ShortenURLResponse{
-					ShortURL: fmt.Sprintf("%s/%s", opts.BaseURL, shortURL),
+					ShortURL: fmt.Sprintf("%s/%s", domain.BaseURL, shortURL),
 				}
 				responseJSON, errMarshal := json.Marshal(response)
 				if errMarshal != nil {
@@ -162,106 +370,414 @@ func ShortenURLFromJSON(opts *config.Options) http.HandlerFunc {
 			}
 		}
 
-		// Generate a short URL
-		shortURL := generator.ShortURL(request.LongURL, store.Store.GetStore())
-
-		// Save the URL
-		store.Store.Save(shortURL, request.LongURL, "", opts)
+		// Generate a short URL that is free in every storage, links of batches may be in the database only
+		var lookupErr error
+		shortURL := generator.ShortURL(values.Value, takenIn(r.Context(), domain.Namespace, nil, values.Shareable(), &lookupErr, opts))
+		if lookupErr != nil {
+			storeProblem(w, r, lookupErr)
+			return
+		}
 
-		// DB store exists
+		// DB store exists, saved first so a failure does not leave the link in memory only
 		if dbExists {
-			store.SaveToDB(shortURL, request.LongURL, "")
+			if err := store.SaveToDB(r.Context(), shortURL, values); err != nil {
+				storeProblem(w, r, err)
+				return
+			}
 		}
 
+		// Save the URL
+		store.Store.Save(store.Key(domain.Namespace, shortURL), values, opts)
+
 		// Return the short URL
 		w.WriteHeader(http.StatusCreated)
 		response := ShortenURLResponse{
-			ShortURL: fmt.Sprintf("%s/%s", opts.BaseURL, shortURL),
+			ShortURL: fmt.Sprintf("%s/%s", domain.BaseURL, shortURL),
 		}
 		responseJSON, _ := json.Marshal(response)
 		_, _ = w.Write(responseJSON)
 	}
 }
 
-func Ping(w http.ResponseWriter, r *http.Request) {
-	if err := store.DB.Ping(); err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
-	}
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintln(w, "PONG")
-}
-
 // BatchInsertRequest represents a batch insert request
 type BatchInsertRequest struct {
 	CorrelationID string `json:"correlation_id"`
 	OriginalURL   string `json:"original_url"`
+	store.Redirect
+	Password  string `json:"password,omitempty"`
+	MaxClicks int    `json:"max_clicks,omitempty"`
+	store.Forward
+	Domain      string   `json:"domain,omitempty"`
+	Title       string   `json:"title,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
 }
 
+// Statuses of a batch item
+const (
+	BatchCreated  = "created"
+	BatchExisting = "existing"
+	BatchInvalid  = "invalid"
+)
+
+var (
+	errBatchEmpty    = errors.New("batch is empty")
+	errCorrelationID = errors.New("correlation_id is required")
+	errDuplicateID   = errors.New("correlation_id is used by another item")
+)
+
 // BatchInsertResponse represents a batch insert response
 type BatchInsertResponse struct {
-	CorrelationID string `json:"correlation_id"`
-	ShortURL      string `json:"short_url"`
+	CorrelationID string                `json:"correlation_id"`
+	ShortURL      string                `json:"short_url,omitempty"`
+	Status        string                `json:"status"`
+	Errors        []problems.FieldError `json:"errors,omitempty"`
 }
 
-// BatchInsert handles batch insert requests
-// No checks for collisions are done nor they are requested
+// BatchInsert handles batch insert requests.
+// Every item gets a result: created, existing if a shareable link to the URL exists, or invalid.
+// Responds 201 if no item is invalid, 207 if some are and 400 if all are.
+// An application/x-ndjson body is streamed, see streamBatch.
 func BatchInsert(opts *config.Options) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			problem(w, r, http.StatusMethodNotAllowed, problems.CodeMethodNotAllowed, "only POST is allowed")
+			return
+		}
+
+		// Large batches can be streamed as NDJSON instead of a JSON array
+		if isNDJSON(r) {
+			streamBatch(w, r, opts)
 			return
 		}
 
 		// Decode the JSON request body
 		var requests []BatchInsertRequest
-		err := json.NewDecoder(r.Body).Decode(&requests)
-		if err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+		if p := decodeJSON(w, r, &requests); p != nil {
+			problems.Write(w, r, p)
+			return
+		}
+		if p := checkBatch(requests, opts.MaxBatchSize); p != nil {
+			problems.Write(w, r, p)
 			return
 		}
 
 		// Convert the requests to URLRecords
-		var records []store.BatchValues
-		var responses []BatchInsertResponse
-		for _, req := range requests {
-			// Generate a UUID for each record
-			id, err := uuid.NewRandom()
+		shortener := newBatchShortener(r.Context(), r.Host, opts)
+		var records []store.Record
+		responses := make([]BatchInsertResponse, 0, len(requests))
+		invalid := 0
+		for i, req := range requests {
+			response, record, err := shortener.add(req, fmt.Sprintf("/%d", i))
 			if err != nil {
-				http.Error(w, "Failed to generate UUID", http.StatusInternalServerError)
+				storeProblem(w, r, err)
 				return
 			}
-
-			// Generate a short URL
-			shortURL := generator.ShortURLWithoutCheck(req.OriginalURL)
-
-			record := store.BatchValues{
-				UUID:        id.String(),
-				ShortURL:    shortURL,
-				OriginalURL: req.OriginalURL,
+			if record != nil {
+				records = append(records, *record)
 			}
-			records = append(records, record)
-
-			// Create a response object
-			response := BatchInsertResponse{
-				CorrelationID: req.CorrelationID,
-				ShortURL:      fmt.Sprintf("%s/%s", opts.BaseURL, shortURL),
+			if response.Status == BatchInvalid {
+				invalid++
 			}
 			responses = append(responses, response)
 		}
 
-		// Save the URLs to DB
-		store.BatchSave(records)
+		// Save the URLs
+		if err := saveBatch(r.Context(), records, opts); err != nil {
+			storeProblem(w, r, err)
+			return
+		}
+
+		status := http.StatusCreated
+		switch {
+		case invalid == len(requests):
+			status = http.StatusBadRequest
+		case invalid > 0:
+			status = http.StatusMultiStatus
+		}
 
 		// Set the response content type to JSON
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
+		w.WriteHeader(status)
 
 		// Encode the responses as JSON and write to the response writer
-		err = json.NewEncoder(w).Encode(responses)
+		err := json.NewEncoder(w).Encode(responses)
 		if err != nil {
-			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
-			return
+			log.Error().Err(err).Msg("Error encoding response")
+		}
+	}
+}
+
+// batchShortener creates the links of a batch, keeping track of the links not stored yet
+type batchShortener struct {
+	// Context of the store lookups
+	ctx context.Context
+	// Host the batch was sent to, links are created on its domain by default
+	host string
+	opts *config.Options
+	// Short URLs of the batch by store key
+	used map[string]bool
+	// Short URLs of the shareable links of the batch by domain and URL
+	shared map[string]string
+	// job the ID of the job of the batch if any. Its links get UUIDs and short URLs derived from the job
+	// and the item, so a chunk processed again after a restart finds the links it saved instead of creating new ones.
+	job string
+}
+
+func newBatchShortener(ctx context.Context, host string, opts *config.Options) *batchShortener {
+	return &batchShortener{ctx: ctx, host: host, opts: opts, used: make(map[string]bool), shared: make(map[string]string)}
+}
+
+// forget drops the short URLs of the batch once they are saved, the store lookups find them from then on
+func (b *batchShortener) forget() {
+	clear(b.used)
+	clear(b.shared)
+}
+
+// add validates an item and returns its response, and the record to save if a link is created.
+// Field errors point into the item at pointer. An error means the store could not be read.
+func (b *batchShortener) add(req BatchInsertRequest, pointer string) (BatchInsertResponse, *store.Record, error) {
+	response := BatchInsertResponse{CorrelationID: req.CorrelationID}
+	record, domain, p := batchRecord(b.host, req, pointer, "original_url", "", b.opts)
+	if p != nil {
+		response.Status = BatchInvalid
+		response.Errors = p.Errors
+		return response, nil, nil
+	}
+
+	seed := record.OriginalURL
+	shareable := record.Values().Shareable()
+	if b.job != "" {
+		record.UUID = store.NameUUID(b.job + pointer)
+		if !shareable {
+			seed += "#" + record.UUID
+		}
+	}
+
+	// Shareable links are not created twice
+	sharedKey := store.Key(domain.Namespace, record.OriginalURL)
+	if shareable {
+		shortURL, ok := b.shared[sharedKey]
+		if !ok {
+			var err error
+			shortURL, ok, err = findShareable(b.ctx, domain.Namespace, record.OriginalURL, b.opts)
+			if err != nil {
+				return response, nil, err
+			}
+		}
+		if ok {
+			saved, err := b.saved(domain.Namespace, shortURL, record.UUID)
+			if err != nil {
+				return response, nil, err
+			}
+			response.Status = BatchExisting
+			if saved {
+				response.Status = BatchCreated
+			}
+			response.ShortURL = fmt.Sprintf("%s/%s", domain.BaseURL, shortURL)
+			return response, nil, nil
+		}
+	}
+
+	// Generate a short URL, a link of the item saved by an earlier run of the job is reused
+	var err error
+	reused := false
+	taken := takenIn(b.ctx, domain.Namespace, b.used, shareable, &err, b.opts)
+	record.ShortURL = generator.ShortURL(seed, func(shortURL string) bool {
+		if b.job != "" && !shareable && err == nil {
+			reused, err = b.saved(domain.Namespace, shortURL, record.UUID)
+			if reused || err != nil {
+				return false
+			}
+		}
+		return taken(shortURL)
+	})
+	if err != nil {
+		return response, nil, err
+	}
+	if reused {
+		response.Status = BatchCreated
+		response.ShortURL = fmt.Sprintf("%s/%s", domain.BaseURL, record.ShortURL)
+		return response, nil, nil
+	}
+	b.used[record.Key()] = true
+	if shareable {
+		b.shared[sharedKey] = record.ShortURL
+	}
+	response.Status = BatchCreated
+	response.ShortURL = fmt.Sprintf("%s/%s", domain.BaseURL, record.ShortURL)
+	return response, &record, nil
+}
+
+// saved reports whether the short URL is a link of the job item of the UUID, saved by an earlier run of the job
+func (b *batchShortener) saved(domain, shortURL, uuid string) (bool, error) {
+	if b.job == "" {
+		return false, nil
+	}
+	link, ok, err := findURL(b.ctx, domain, shortURL, b.opts)
+	if store.Buffering(err) {
+		return false, nil
+	}
+	return ok && link.UUID == uuid, err
+}
+
+// checkBatch checks the batch as a whole: its size up to maxSize, unlimited if 0, and the correlation IDs
+func checkBatch(requests []BatchInsertRequest, maxSize int) *problems.Problem {
+	if len(requests) == 0 {
+		return problems.New(http.StatusBadRequest, problems.CodeInvalidBody, errBatchEmpty.Error())
+	}
+	if maxSize > 0 && len(requests) > maxSize {
+		return problems.New(http.StatusRequestEntityTooLarge, problems.CodeTooLarge, fmt.Sprintf("batch has %d items, the maximum is %d", len(requests), maxSize))
+	}
+
+	var fieldErrors []problems.FieldError
+	seen := make(map[string]bool, len(requests))
+	for i, req := range requests {
+		field := fmt.Sprintf("/%d/correlation_id", i)
+		switch {
+		case req.CorrelationID == "":
+			fieldErrors = append(fieldErrors, problems.FieldError{Field: field, Code: FieldInvalidCorrelationID, Detail: errCorrelationID.Error()})
+		case seen[req.CorrelationID]:
+			fieldErrors = append(fieldErrors, problems.FieldError{Field: field, Code: FieldDuplicateCorrelationID, Detail: errDuplicateID.Error()})
+		}
+		seen[req.CorrelationID] = true
+	}
+	if len(fieldErrors) > 0 {
+		return problems.New(http.StatusBadRequest, problems.CodeInvalidRequest, "", fieldErrors...)
+	}
+	return nil
+}
+
+// findShareable returns the short URL of an existing shareable link to the URL in the domain namespace
+func findShareable(ctx context.Context, domain, longURL string, opts *config.Options) (string, bool, error) {
+	if shortURL, ok := store.Store.ValueExistsInMap(domain, longURL); ok {
+		return shortURL, true, nil
+	}
+	if opts.ConnectionString != "" {
+		return store.CheckIfExistsInDB(ctx, domain, longURL)
+	}
+	return "", false, nil
+}
+
+// takenIn returns a function reporting whether a short URL is stored in the domain namespace
+// or used by a link not stored yet, used is keyed by store.Key.
+// A failed lookup is kept in failed and reported as free, so the generator stops; the caller has to check failed.
+// While the database is down and writes are journaled the short URL is checked against the links in memory and in the journal.
+// One found in neither is taken as free if guess is set, for shareable links: a link taken meanwhile most likely
+// has the same URL, the replay of the journal skips and logs it. Otherwise the lookup fails with errUnverified.
+func takenIn(ctx context.Context, domain string, used map[string]bool, guess bool, failed *error, opts *config.Options) func(string) bool {
+	return func(shortURL string) bool {
+		key := store.Key(domain, shortURL)
+		if used[key] {
+			return true
+		}
+		_, ok, err := findURL(ctx, domain, shortURL, opts)
+		if store.Buffering(err) {
+			if _, ok = store.Store.Find(key); ok || store.DBJournal.Has(key) {
+				return true
+			}
+			if !guess && *failed == nil {
+				*failed = fmt.Errorf("%w: %w", errUnverified, err)
+			}
+			return false
+		}
+		if err != nil && *failed == nil {
+			*failed = err
+		}
+		return ok
+	}
+}
+
+// batchRecord validates a link request and creates its record on the requested domain, or the one of the host.
+// Field errors point into the item at pointer, urlField names its URL field.
+// The short URL is left for the caller to generate if none is given, the UUID for saveBatch.
+func batchRecord(host string, req BatchInsertRequest, pointer, urlField, shortURL string, opts *config.Options) (store.Record, config.Domain, *problems.Problem) {
+	var fieldErrors []problems.FieldError
+	invalid := func(field, code string, err error) {
+		fieldErrors = append(fieldErrors, problems.FieldError{Field: pointer + "/" + field, Code: code, Detail: err.Error()})
+	}
+
+	// Check if the URL is valid
+	originalURL, err := validator.NormalizeURL(req.OriginalURL, opts)
+	if err != nil {
+		invalid(urlField, FieldInvalidURL, err)
+	}
+	var redirectErr *validator.RedirectError
+	if err = validator.Redirect(req.Redirect); errors.As(err, &redirectErr) {
+		invalid(redirectErr.Field, FieldInvalidRedirect, err)
+	}
+	passwordHash, err := hashPassword(req.Password)
+	if err != nil {
+		invalid("password", FieldInvalidPassword, err)
+	}
+	if req.MaxClicks < 0 {
+		invalid("max_clicks", FieldInvalidMaxClicks, errMaxClicks)
+	}
+	domain, err := creationDomain(host, req.Domain, opts)
+	if err != nil {
+		invalid("domain", FieldUnknownDomain, err)
+	}
+	if err = validator.Title(req.Title); err != nil {
+		invalid("title", FieldInvalidTitle, err)
+	}
+	if err = validator.Description(req.Description); err != nil {
+		invalid("description", FieldInvalidDescription, err)
+	}
+	tags, err := validator.Tags(req.Tags)
+	if err != nil {
+		invalid("tags", FieldInvalidTags, err)
+	}
+	if len(fieldErrors) > 0 {
+		return store.Record{}, domain, problems.New(http.StatusBadRequest, problems.CodeInvalidRequest, "", fieldErrors...)
+	}
+	// A valid URL may still be blocked by the domain rules
+	if err = checkDomain(originalURL); err != nil {
+		invalid(urlField, FieldBlockedDomain, err)
+		return store.Record{}, domain, problems.New(http.StatusUnprocessableEntity, problems.CodeBlockedDomain, "", fieldErrors...)
+	}
+
+	return store.Record{
+		ShortURL:     shortURL,
+		OriginalURL:  originalURL,
+		Domain:       domain.Namespace,
+		Redirect:     req.Redirect,
+		PasswordHash: passwordHash,
+		MaxClicks:    req.MaxClicks,
+		Forward:      req.Forward,
+		CreatedAt:    store.Now(),
+		Title:        req.Title,
+		Description:  req.Description,
+		Tags:         tags,
+	}, domain, nil
+}
+
+// saveBatch saves the records to the database if configured, to the in-memory and file store otherwise.
+// During a storage migration the records are saved to both. Nothing is saved if the database fails.
+func saveBatch(ctx context.Context, records []store.Record, opts *config.Options) error {
+	if len(records) == 0 {
+		return nil
+	}
+	for i := range records {
+		if records[i].UUID == "" {
+			records[i].UUID = store.GenerateUUID()
+		}
+	}
+	if opts.ConnectionString != "" {
+		if err := store.BatchSave(ctx, records); err != nil {
+			return err
+		}
+		if !opts.Migrating() {
+			return nil
+		}
+	}
+	for _, record := range records {
+		store.Store.Save(record.Key(), record.Values(), opts)
+	}
+	// The records have their UUID set, so Save does not write the file
+	if opts.FileStore != "" {
+		if err := store.Store.SaveToFile(opts.FileStore); err != nil {
+			log.Error().Err(err).Msg("Failed to save to file")
 		}
 	}
+	return nil
 }
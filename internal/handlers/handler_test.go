@@ -2,11 +2,18 @@ package handlers
 
 import (
 	"bytes"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"shortener/internal/config"
+	"shortener/internal/problems"
 	"shortener/internal/store"
+	"shortener/internal/validator"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -77,3 +84,363 @@ func TestRedirectToURL(t *testing.T) {
 		t.Errorf("handler returned unexpected redirect: got %v want %v", rr.Header().Get("Location"), expected)
 	}
 }
+
+func TestRedirectToURLWithOptions(t *testing.T) {
+	store.New()
+	opts := config.Options{RedirectStatus: http.StatusFound, RedirectReferrerPolicy: "no-referrer"}
+	store.Store.Save("seo", store.MapValues{
+		Value:    "http://example.com/seo",
+		UUID:     "1",
+		Redirect: store.Redirect{Status: http.StatusMovedPermanently, CacheControl: "max-age=3600"},
+	}, &opts)
+
+	req, err := http.NewRequest("GET", "/seo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = mux.SetURLVars(req, map[string]string{"shortURL": "seo"})
+	rr := httptest.NewRecorder()
+	RedirectToURL(&opts).ServeHTTP(rr, req)
+
+	// The link settings win over the service defaults
+	if status := rr.Code; status != http.StatusMovedPermanently {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusMovedPermanently)
+	}
+	if got := rr.Header().Get("Cache-Control"); got != "max-age=3600" {
+		t.Errorf("handler returned wrong Cache-Control: got %v want %v", got, "max-age=3600")
+	}
+	// Defaults are used for the rest
+	if got := rr.Header().Get("Referrer-Policy"); got != "no-referrer" {
+		t.Errorf("handler returned wrong Referrer-Policy: got %v want %v", got, "no-referrer")
+	}
+}
+
+func TestRedirectToURLWithPassword(t *testing.T) {
+	store.New()
+	passwordAttempts.links = make(map[string]*attempts)
+	opts := config.Options{PasswordMaxAttempts: 2, PasswordLockout: time.Minute}
+	hash, err := store.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Store.Save("locked", store.MapValues{Value: "http://example.com/internal", UUID: "1", PasswordHash: hash}, &opts)
+
+	tests := []struct {
+		name     string
+		password string
+		want     int
+	}{
+		{name: "no password", want: http.StatusUnauthorized},
+		{name: "right password", password: "secret", want: http.StatusTemporaryRedirect},
+		{name: "wrong password", password: "guess", want: http.StatusUnauthorized},
+		{name: "locked after second failure", password: "guess", want: http.StatusUnauthorized},
+		{name: "locked", password: "secret", want: http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/locked", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = mux.SetURLVars(req, map[string]string{"shortURL": "locked"})
+		if tt.password != "" {
+			req.Header.Set(passwordHeader, tt.password)
+		}
+		rr := httptest.NewRecorder()
+		RedirectToURL(&opts).ServeHTTP(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tt.name, rr.Code, tt.want)
+		}
+	}
+}
+
+func TestRedirectToURLMaxClicks(t *testing.T) {
+	store.New()
+	opts := config.Options{}
+	store.Store.Save("invite", store.MapValues{Value: "http://example.com/invite", UUID: "1", MaxClicks: 3}, &opts)
+
+	// Only three of the concurrent redirects may succeed
+	const requests = 20
+	codes := make(chan int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", "/invite", nil)
+			req = mux.SetURLVars(req, map[string]string{"shortURL": "invite"})
+			rr := httptest.NewRecorder()
+			RedirectToURL(&opts).ServeHTTP(rr, req)
+			codes <- rr.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	redirected := 0
+	for code := range codes {
+		switch code {
+		case http.StatusTemporaryRedirect:
+			redirected++
+		case http.StatusGone:
+		default:
+			t.Errorf("handler returned unexpected status code: %v", code)
+		}
+	}
+	if redirected != 3 {
+		t.Errorf("handler redirected %d times, want 3", redirected)
+	}
+}
+
+func TestRedirectToURLForwarding(t *testing.T) {
+	store.New()
+	opts := config.Options{}
+	store.Store.Save("docs", store.MapValues{
+		Value:   "http://example.com/docs/?lang=en",
+		UUID:    "1",
+		Forward: store.Forward{Query: true, Path: true, UTM: store.UTM{Source: "print"}},
+	}, &opts)
+
+	tests := []struct {
+		target string
+		rest   string
+		want   string
+	}{
+		{target: "/docs", want: "http://example.com/docs/?lang=en&utm_source=print"},
+		{target: "/docs/api/v1?page=2&lang=ru", rest: "api/v1", want: "http://example.com/docs/api/v1?lang=en&page=2&utm_source=print"},
+		{target: "/docs/../../etc", rest: "../../etc", want: "http://example.com/docs/etc?lang=en&utm_source=print"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.target, nil)
+		req = mux.SetURLVars(req, map[string]string{"shortURL": "docs", "rest": tt.rest})
+		rr := httptest.NewRecorder()
+		RedirectToURL(&opts).ServeHTTP(rr, req)
+		if got := rr.Header().Get("Location"); got != tt.want {
+			t.Errorf("%s: handler returned unexpected redirect: got %v want %v", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestShortenURLOnCustomDomains(t *testing.T) {
+	store.New()
+	opts := config.Options{BaseURL: "http://localhost:8080", Domains: "https://go.example.com, https://s.example.org"}
+
+	// The same URL gets the same short URL on every domain, each in its own namespace
+	for _, host := range []string{"go.example.com", "s.example.org"} {
+		req := httptest.NewRequest("POST", "/", bytes.NewBufferString("http://example.com/"+host))
+		req.Host = host
+		rr := httptest.NewRecorder()
+		ShortenURL(&opts).ServeHTTP(rr, req)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+		}
+		prefix := "https://" + host + "/"
+		if !strings.HasPrefix(rr.Body.String(), prefix) {
+			t.Fatalf("handler returned unexpected body: got %v want prefix %v", rr.Body.String(), prefix)
+		}
+		shortURL := strings.TrimPrefix(rr.Body.String(), prefix)
+
+		// Unknown hosts resolve in the main domain namespace where the link does not exist
+		for target, want := range map[string]string{host: "http://example.com/" + host, "localhost:8080": ""} {
+			req = httptest.NewRequest("GET", "/"+shortURL, nil)
+			req.Host = target
+			req = mux.SetURLVars(req, map[string]string{"shortURL": shortURL})
+			rr = httptest.NewRecorder()
+			RedirectToURL(&opts).ServeHTTP(rr, req)
+			if got := rr.Header().Get("Location"); got != want {
+				t.Errorf("redirect on %s returned %q, want %q", target, got, want)
+			}
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	store.New()
+	opts := config.Options{BaseURL: "http://localhost:8080"}
+	store.Store.Save("taken", store.MapValues{Value: "https://example.com/taken"}, &opts)
+
+	tests := []struct {
+		name, format, body string
+		wantStatus         int
+		wantResults        []ImportResult
+	}{
+		{
+			name:   "csv",
+			format: "csv",
+			body:   "original_url,alias\nhttps://example.com/a,promo\nhttps://example.com/taken,\n\"unterminated\nftp://example.com,\n",
+			// The unterminated quote swallows the rest of the input
+			wantStatus: http.StatusMultiStatus,
+			wantResults: []ImportResult{
+				{Line: 2, OriginalURL: "https://example.com/a", ShortURL: "http://localhost:8080/promo", Status: BatchCreated},
+				// Lines without an alias reuse the shareable link of the URL, like batch items
+				{Line: 3, OriginalURL: "https://example.com/taken", ShortURL: "http://localhost:8080/taken", Status: BatchExisting},
+				{Line: 5, Code: FieldInvalidLine, Error: "syntax error: extraneous or missing \" in quoted-field"},
+			},
+		},
+		{
+			name:   "nginx",
+			format: "nginx",
+			body:   "map $uri $target {\n  default https://example.com;\n  /sale https://example.com/sale;\n  ~^/re https://example.com;\n  /taken https://example.com/x;\n}\n",
+			wantResults: []ImportResult{
+				{Line: 3, OriginalURL: "https://example.com/sale", ShortURL: "http://localhost:8080/sale", Status: BatchCreated},
+				{Line: 4, Code: FieldInvalidLine, Error: "regular expressions are not supported"},
+				{Line: 5, OriginalURL: "https://example.com/x", Code: FieldAliasTaken, Error: "alias already exists"},
+			},
+			wantStatus: http.StatusMultiStatus,
+		},
+		{
+			name:   "apache",
+			format: "apache",
+			body:   "# moved\nRedirect 308 /docs https://example.com/docs\nRedirectPermanent /a/b https://example.com\n",
+			wantResults: []ImportResult{
+				{Line: 2, OriginalURL: "https://example.com/docs", ShortURL: "http://localhost:8080/docs", Status: BatchCreated},
+				{Line: 3, OriginalURL: "https://example.com", Code: FieldInvalidAlias, Error: validator.ErrAlias.Error()},
+			},
+			wantStatus: http.StatusMultiStatus,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/import?format="+tt.format, strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+			Import(&opts).ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			var response ImportResponse
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(response.Results, tt.wantResults) {
+				t.Errorf("got results %+v, want %+v", response.Results, tt.wantResults)
+			}
+		})
+	}
+
+	// Imported links redirect with the status of the rule
+	link, ok := store.Store.Find("docs")
+	if !ok || link.Value != "https://example.com/docs" || link.Redirect.Status != http.StatusPermanentRedirect {
+		t.Errorf("imported link = %+v, %v", link, ok)
+	}
+
+	// A URL repeated in the import is shortened once
+	req := httptest.NewRequest("POST", "/api/import?format=csv", strings.NewReader("original_url\nhttps://example.com/new\nhttps://example.com/new\n"))
+	rr := httptest.NewRecorder()
+	Import(&opts).ServeHTTP(rr, req)
+	var response ImportResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if results := response.Results; rr.Code != http.StatusCreated || len(results) != 2 || results[0].Status != BatchCreated ||
+		results[1].Status != BatchExisting || results[1].ShortURL != results[0].ShortURL || response.Imported != 2 {
+		t.Errorf("repeated URL import returned %v %+v", rr.Code, response)
+	}
+}
+
+func TestShortenURLFromJSONProblems(t *testing.T) {
+	store.New()
+	opts := config.Options{BaseURL: "http://localhost:8080"}
+
+	tests := []struct {
+		name, body string
+		wantStatus int
+		wantCode   string
+		wantDetail string
+		wantFields []problems.FieldError
+	}{
+		{name: "empty body", body: " ", wantStatus: http.StatusBadRequest, wantCode: problems.CodeInvalidBody, wantDetail: "request body is empty"},
+		{name: "unknown field", body: `{"url":"https://example.com","ttl":1}`, wantStatus: http.StatusBadRequest, wantCode: problems.CodeInvalidBody, wantDetail: `unknown field "ttl"`},
+		{name: "trailing data", body: `{"url":"https://example.com"} {}`, wantStatus: http.StatusBadRequest, wantCode: problems.CodeInvalidBody, wantDetail: "request body has data after the JSON value"},
+		{name: "wrong type", body: `{"url":1}`, wantStatus: http.StatusBadRequest, wantCode: problems.CodeInvalidBody, wantDetail: "field url must not be a number"},
+		{
+			name:       "invalid fields",
+			body:       `{"url":"ftp://example.com","redirect_status":200,"max_clicks":-1}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   problems.CodeInvalidRequest,
+			wantFields: []problems.FieldError{
+				{Field: "/url", Code: FieldInvalidURL, Detail: validator.ErrScheme.Error()},
+				{Field: "/redirect_status", Code: FieldInvalidRedirect, Detail: validator.ErrRedirectStatus.Error()},
+				{Field: "/max_clicks", Code: FieldInvalidMaxClicks, Detail: errMaxClicks.Error()},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/shorten", strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+			ShortenURLFromJSON(&opts).ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, tt.wantStatus)
+			}
+			if got := rr.Header().Get("Content-Type"); got != "application/problem+json" {
+				t.Errorf("Content-Type = %q", got)
+			}
+			var p problems.Problem
+			if err := json.NewDecoder(rr.Body).Decode(&p); err != nil {
+				t.Fatal(err)
+			}
+			if p.Code != tt.wantCode || p.Status != tt.wantStatus || p.Detail != tt.wantDetail || p.Instance != "/api/shorten" {
+				t.Errorf("got problem %+v", p)
+			}
+			if !reflect.DeepEqual(p.Errors, tt.wantFields) {
+				t.Errorf("got field errors %+v, want %+v", p.Errors, tt.wantFields)
+			}
+		})
+	}
+}
+
+func TestBatchInsert(t *testing.T) {
+	store.New()
+	opts := config.Options{BaseURL: "http://localhost:8080", MaxBatchSize: 3}
+	store.Store.Save("old", store.MapValues{Value: "https://example.com/old"}, &opts)
+
+	batch := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/shorten/batch", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		BatchInsert(&opts).ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := batch(`[
+		{"correlation_id": "1", "original_url": "https://example.com/new"},
+		{"correlation_id": "2", "original_url": "https://example.com/old"},
+		{"correlation_id": "3", "original_url": "ftp://example.com"}
+	]`)
+	if rr.Code != http.StatusMultiStatus {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusMultiStatus, rr.Body)
+	}
+	var responses []BatchInsertResponse
+	if err := json.NewDecoder(rr.Body).Decode(&responses); err != nil {
+		t.Fatal(err)
+	}
+	want := []BatchInsertResponse{
+		{CorrelationID: "1", ShortURL: responses[0].ShortURL, Status: BatchCreated},
+		{CorrelationID: "2", ShortURL: "http://localhost:8080/old", Status: BatchExisting},
+		{CorrelationID: "3", Status: BatchInvalid, Errors: []problems.FieldError{
+			{Field: "/2/original_url", Code: FieldInvalidURL, Detail: validator.ErrScheme.Error()},
+		}},
+	}
+	if !reflect.DeepEqual(responses, want) {
+		t.Errorf("got %+v, want %+v", responses, want)
+	}
+
+	// Created links are stored without a database, and the same URL is not created twice
+	shortURL := strings.TrimPrefix(responses[0].ShortURL, "http://localhost:8080/")
+	if link, ok := store.Store.Find(shortURL); !ok || link.Value != "https://example.com/new" {
+		t.Errorf("created link %q = %+v, %v", shortURL, link, ok)
+	}
+	rr = batch(`[{"correlation_id": "a", "original_url": "https://example.com/new"}]`)
+	if rr.Code != http.StatusCreated || !strings.Contains(rr.Body.String(), `"status":"existing"`) {
+		t.Errorf("repeated batch returned %v: %s", rr.Code, rr.Body)
+	}
+
+	for body, wantStatus := range map[string]int{
+		`[]`: http.StatusBadRequest,
+		`[{"correlation_id": "1", "original_url": "https://a.example"}, {"correlation_id": "1", "original_url": "https://b.example"}]`: http.StatusBadRequest,
+		`[{"correlation_id": "1"}, {"correlation_id": "2"}, {"correlation_id": "3"}, {"correlation_id": "4"}]`:                         http.StatusRequestEntityTooLarge,
+		`[{"correlation_id": "1", "original_url": ""}]`:                                                                                http.StatusBadRequest,
+	} {
+		if rr = batch(body); rr.Code != wantStatus {
+			t.Errorf("batch %s returned %v, want %v", body, rr.Code, wantStatus)
+		}
+	}
+}
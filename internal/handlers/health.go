@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"shortener/internal/config"
+	"shortener/internal/jobs"
+	"shortener/internal/problems"
+	"shortener/internal/store"
+	"time"
+)
+
+// Statuses of a readiness component
+const (
+	HealthOK       = "ok"
+	HealthFailed   = "failed"
+	HealthDisabled = "disabled"
+	// HealthDegraded the service still serves: the database is down while redirects are served from the cache
+	// and new links are journaled, or the copy of a storage migration failed
+	HealthDegraded = "degraded"
+)
+
+// ComponentHealth the state of a component the service depends on
+type ComponentHealth struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// LatencyMS how long the check took in milliseconds
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+	// Workers running and started, for background workers
+	Running int `json:"running,omitempty"`
+	Workers int `json:"workers,omitempty"`
+	// Pool statistics of the database connections
+	Pool *store.PoolStats `json:"pool,omitempty"`
+	// Breaker state of the database and links journaled while it was down
+	Breaker   string `json:"breaker,omitempty"`
+	Journaled int    `json:"journaled,omitempty"`
+	// Backfill progress of the copy of a storage migration
+	Backfill *store.BackfillStats `json:"backfill,omitempty"`
+}
+
+// HealthResponse represents a health report, failed if any component failed, degraded if the database is down
+// but the service still serves
+type HealthResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentHealth `json:"components,omitempty"`
+}
+
+// Ping checks the database connection, it answers PONG if no database is configured
+func Ping(w http.ResponseWriter, r *http.Request) {
+	if store.DB != nil {
+		if err := store.PingDB(r.Context()); err != nil {
+			log.Error().Err(err).Msg("Database ping failed")
+			problem(w, r, http.StatusInternalServerError, problems.CodeUnavailable, "database error")
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "PONG")
+}
+
+// Healthz reports the process is alive, it checks nothing else
+func Healthz(w http.ResponseWriter, _ *http.Request) {
+	writeHealth(w, HealthResponse{Status: HealthOK})
+}
+
+// Readyz reports whether the service can serve requests: the database answers, the file store is writable
+// and the job workers are running. During a storage migration the progress of the copy is reported too.
+// Responds 503 if a component failed, a database that is down while new links are journaled only degrades the service.
+func Readyz(opts *config.Options, queue *jobs.Queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		components := map[string]ComponentHealth{
+			"database":   {Status: HealthDisabled},
+			"file_store": {Status: HealthDisabled},
+			"jobs":       {Status: HealthOK, Running: queue.Running(), Workers: queue.Workers()},
+		}
+		if store.DB != nil {
+			start := time.Now()
+			database := checkHealth(store.PingDB(r.Context()), start)
+			stats := store.Stats()
+			database.Pool = &stats
+			database.Breaker = store.DBBreaker.State()
+			database.Journaled = store.DBJournal.Pending()
+			if store.DBJournal != nil && (database.Status == HealthFailed || database.Breaker != store.BreakerClosed) {
+				database.Status = HealthDegraded
+			}
+			components["database"] = database
+		}
+		if opts.FileStore != "" {
+			start := time.Now()
+			components["file_store"] = checkHealth(store.CheckFile(opts.FileStore), start)
+		}
+		if opts.Migrating() {
+			backfill := store.Backfill.Stats()
+			migration := ComponentHealth{Status: HealthOK, Backfill: &backfill}
+			if backfill.Error != "" {
+				migration.Status = HealthDegraded
+				migration.Error = backfill.Error
+			}
+			components["migration"] = migration
+		}
+		if jobsHealth := components["jobs"]; jobsHealth.Running < jobsHealth.Workers {
+			jobsHealth.Status = HealthFailed
+			jobsHealth.Error = "job workers are not running"
+			components["jobs"] = jobsHealth
+		}
+
+		response := HealthResponse{Status: HealthOK, Components: components}
+		for name, component := range components {
+			switch component.Status {
+			case HealthFailed:
+				log.Warn().Str("component", name).Msg(component.Error)
+				response.Status = HealthFailed
+			case HealthDegraded:
+				if response.Status != HealthFailed {
+					response.Status = HealthDegraded
+				}
+			}
+		}
+		writeHealth(w, response)
+	}
+}
+
+// checkHealth returns the health of a component checked since start
+func checkHealth(err error, start time.Time) ComponentHealth {
+	health := ComponentHealth{Status: HealthOK, LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		health.Status = HealthFailed
+		health.Error = err.Error()
+	}
+	return health
+}
+
+// writeHealth writes the report, 503 if it failed
+func writeHealth(w http.ResponseWriter, response HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	// Probes must see the current state
+	w.Header().Set("Cache-Control", "no-store")
+	if response.Status == HealthFailed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Error().Err(err).Msg("Error encoding response")
+	}
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"shortener/internal/config"
+	"shortener/internal/jobs"
+	"shortener/internal/store"
+	"testing"
+	"time"
+)
+
+func TestPingWithoutDatabase(t *testing.T) {
+	oldDB := store.DB
+	store.DB = nil
+	defer func() { store.DB = oldDB }()
+
+	rr := httptest.NewRecorder()
+	Ping(rr, httptest.NewRequest("GET", "/ping", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "PONG\n" {
+		t.Errorf("Ping returned %v %q", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	Healthz(rr, httptest.NewRequest("GET", "/healthz", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Healthz returned %v", rr.Code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	oldDB, oldTimeout := store.DB, store.QueryTimeout
+	defer func() { store.DB, store.QueryTimeout = oldDB, oldTimeout }()
+	defer resetBreaker()()
+	hanging, err := sql.Open("hanging", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hanging.Close()
+
+	queue := jobs.NewQueue(jobs.NewMemoryStore(), func(context.Context, *jobs.Job, func([]json.RawMessage) error) error { return nil }, 2, 1, 0)
+	stopped := jobs.NewQueue(jobs.NewMemoryStore(), func(context.Context, *jobs.Job, func([]json.RawMessage) error) error { return nil }, 1, 1, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err = queue.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); queue.Running() < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+
+	tests := []struct {
+		name   string
+		db     *sql.DB
+		file   string
+		queue  *jobs.Queue
+		status int
+		want   map[string]string
+	}{
+		{
+			name:   "memory only",
+			queue:  queue,
+			status: http.StatusOK,
+			want:   map[string]string{"database": HealthDisabled, "file_store": HealthDisabled, "jobs": HealthOK},
+		},
+		{
+			name:   "file store",
+			file:   filepath.Join(t.TempDir(), "links.json"),
+			queue:  queue,
+			status: http.StatusOK,
+			want:   map[string]string{"database": HealthDisabled, "file_store": HealthOK, "jobs": HealthOK},
+		},
+		{
+			name:   "file store in a missing directory",
+			file:   filepath.Join(t.TempDir(), "missing", "links.json"),
+			queue:  queue,
+			status: http.StatusServiceUnavailable,
+			want:   map[string]string{"database": HealthDisabled, "file_store": HealthFailed, "jobs": HealthOK},
+		},
+		{
+			name:   "database not answering",
+			db:     hanging,
+			queue:  queue,
+			status: http.StatusServiceUnavailable,
+			want:   map[string]string{"database": HealthFailed, "file_store": HealthDisabled, "jobs": HealthOK},
+		},
+		{
+			name:   "workers not started",
+			queue:  stopped,
+			status: http.StatusServiceUnavailable,
+			want:   map[string]string{"database": HealthDisabled, "file_store": HealthDisabled, "jobs": HealthFailed},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store.DB, store.QueryTimeout = tt.db, 20*time.Millisecond
+			opts := config.Options{FileStore: tt.file}
+			rr := httptest.NewRecorder()
+			Readyz(&opts, tt.queue).ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+
+			var response HealthResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || rr.Code != tt.status {
+				t.Fatalf("Readyz returned %v %s", rr.Code, rr.Body.String())
+			}
+			for name, status := range tt.want {
+				if response.Components[name].Status != status {
+					t.Errorf("component %s = %+v, want %s", name, response.Components[name], status)
+				}
+			}
+		})
+	}
+}
+
+func TestReadyzMigration(t *testing.T) {
+	store.New()
+	dir := t.TempDir()
+	opts := config.Options{Migration: config.MigrationFileToDB}
+	queue := jobs.NewQueue(jobs.NewMemoryStore(), func(context.Context, *jobs.Job, func([]json.RawMessage) error) error { return nil }, 1, 1, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := queue.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); queue.Running() < 1 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	readyz := func() (int, ComponentHealth) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		Readyz(&opts, queue).ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+		var response HealthResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return rr.Code, response.Components["migration"]
+	}
+
+	// The copy of the links reports its progress
+	source := filepath.Join(dir, "old.json")
+	store.Store.Save("a", store.MapValues{Value: "https://example.com/a"}, &config.Options{})
+	if err := store.Store.SaveToFile(source); err != nil {
+		t.Fatal(err)
+	}
+	store.New()
+	if err := store.RunBackfill(context.Background(), store.NewFileBackend(source), store.NewMemoryBackend(&config.Options{}), &store.Backfill); err != nil {
+		t.Fatal(err)
+	}
+	code, migration := readyz()
+	if want := (store.BackfillStats{Done: true, Total: 1, Read: 1, Written: 1}); code != http.StatusOK ||
+		migration.Status != HealthOK || migration.Backfill == nil || *migration.Backfill != want {
+		t.Errorf("readyz after the copy returned %v %+v", code, migration)
+	}
+
+	// A failed copy degrades the service, it still serves
+	if err := os.WriteFile(source, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RunBackfill(context.Background(), store.NewFileBackend(source), store.NewMemoryBackend(&config.Options{}), &store.Backfill); err == nil {
+		t.Fatal("RunBackfill() of an invalid file succeeded")
+	}
+	if code, migration = readyz(); code != http.StatusOK || migration.Status != HealthDegraded || migration.Error == "" {
+		t.Errorf("readyz after a failed copy returned %v %+v", code, migration)
+	}
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"shortener/internal/config"
+	"shortener/internal/problems"
+	"shortener/internal/redirectmap"
+	"shortener/internal/store"
+	"shortener/internal/validator"
+)
+
+// Maximum number of mappings of an import request
+const maxImportMappings = 10000
+
+var errAliasTaken = errors.New("alias already exists")
+
+// ImportResult the result of a line of the import
+type ImportResult struct {
+	Line        int    `json:"line"`
+	OriginalURL string `json:"original_url,omitempty"`
+	ShortURL    string `json:"short_url,omitempty"`
+	// Status BatchCreated or BatchExisting if the line was imported
+	Status string `json:"status,omitempty"`
+	Code   string `json:"code,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ImportResponse represents an import response
+type ImportResponse struct {
+	Imported int            `json:"imported"`
+	Failed   int            `json:"failed"`
+	Results  []ImportResult `json:"results"`
+}
+
+// Import handles bulk imports of CSV, nginx map and Apache Redirect rules.
+// Valid lines are saved even if others fail, every line gets a result.
+func Import(opts *config.Options) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); format == "" && mediaType == "text/csv" {
+			format = redirectmap.FormatCSV
+		}
+		next, err := redirectmap.NewReader(r.Body, format)
+		if err != nil {
+			problem(w, r, http.StatusBadRequest, problems.CodeInvalidParameter, "format must be csv, nginx or apache")
+			return
+		}
+		requestedDomain := r.URL.Query().Get("domain")
+		domain, err := creationDomain(r.Host, requestedDomain, opts)
+		if err != nil {
+			problem(w, r, http.StatusBadRequest, problems.CodeInvalidParameter, "domain: "+err.Error())
+			return
+		}
+
+		// Lines without an alias are shortened like batch items, aliases are checked against the links of the batch too
+		batch := newBatchShortener(r.Context(), r.Host, opts)
+		var lookupErr error
+		// An alias can't be guessed free, a link using it would be lost
+		taken := takenIn(r.Context(), domain.Namespace, batch.used, false, &lookupErr, opts)
+
+		var records []store.Record
+		response := ImportResponse{Results: []ImportResult{}}
+		for {
+			mapping, err := next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				problem(w, r, http.StatusBadRequest, problems.CodeInvalidBody, "error reading request body")
+				return
+			}
+			if len(response.Results) == maxImportMappings {
+				problem(w, r, http.StatusRequestEntityTooLarge, problems.CodeTooLarge, fmt.Sprintf("import is limited to %d lines", maxImportMappings))
+				return
+			}
+
+			result := ImportResult{Line: mapping.Line, OriginalURL: mapping.OriginalURL}
+			item, record, err := importRecord(r, mapping, requestedDomain, batch, taken)
+			if err == nil {
+				err = lookupErr
+			}
+			if err != nil {
+				storeProblem(w, r, err)
+				return
+			}
+			result.ShortURL = item.ShortURL
+			switch item.Status {
+			case BatchInvalid:
+				// The line has only the URL and the status, report their first error
+				result.Code = item.Errors[0].Code
+				result.Error = item.Errors[0].Detail
+				response.Failed++
+			case BatchCreated:
+				records = append(records, *record)
+				fallthrough
+			default:
+				result.Status = item.Status
+				response.Imported++
+			}
+			response.Results = append(response.Results, result)
+		}
+
+		// Save the URLs the same way as a batch
+		if err = saveBatch(r.Context(), records, opts); err != nil {
+			storeProblem(w, r, err)
+			return
+		}
+
+		status := http.StatusCreated
+		switch {
+		case response.Imported == 0:
+			status = http.StatusBadRequest
+		case response.Failed > 0:
+			status = http.StatusMultiStatus
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(response)
+	}
+}
+
+// importRecord validates a mapping like a batch item and returns its result, and the record to save if a link is created.
+// Lines without an alias reuse a shareable link of the URL. An error means the store could not be read.
+func importRecord(r *http.Request, mapping redirectmap.Mapping, domain string, batch *batchShortener, taken func(string) bool) (BatchInsertResponse, *store.Record, error) {
+	invalid := func(code string, err error) (BatchInsertResponse, *store.Record, error) {
+		return BatchInsertResponse{Status: BatchInvalid, Errors: []problems.FieldError{{Code: code, Detail: err.Error()}}}, nil, nil
+	}
+	if mapping.Err != nil {
+		return invalid(FieldInvalidLine, mapping.Err)
+	}
+	req := BatchInsertRequest{OriginalURL: mapping.OriginalURL, Redirect: store.Redirect{Status: mapping.Status}, Domain: domain}
+	shortURL := mapping.Alias
+	if shortURL == "" {
+		return batch.add(req, "")
+	}
+
+	if err := validator.Alias(shortURL); err != nil {
+		return invalid(FieldInvalidAlias, err)
+	}
+	if taken(shortURL) {
+		return invalid(FieldAliasTaken, errAliasTaken)
+	}
+	record, linkDomain, p := batchRecord(r.Host, req, "", "original_url", shortURL, batch.opts)
+	if p != nil {
+		return BatchInsertResponse{Status: BatchInvalid, Errors: p.Errors}, nil, nil
+	}
+	batch.used[record.Key()] = true
+	if record.Values().Shareable() {
+		batch.shared[store.Key(linkDomain.Namespace, record.OriginalURL)] = record.ShortURL
+	}
+	return BatchInsertResponse{Status: BatchCreated, ShortURL: fmt.Sprintf("%s/%s", linkDomain.BaseURL, record.ShortURL)}, &record, nil
+}
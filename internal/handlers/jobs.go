@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"path"
+	"shortener/internal/config"
+	"shortener/internal/jobs"
+	"shortener/internal/problems"
+	"shortener/internal/store"
+	"time"
+)
+
+var errJobNotFound = errors.New("job does not exist")
+
+// JobResponse the state of a batch job
+type JobResponse struct {
+	ID        string      `json:"id"`
+	Status    jobs.Status `json:"status"`
+	Total     int         `json:"total"`
+	Processed int         `json:"processed"`
+	Created   int         `json:"created"`
+	Existing  int         `json:"existing"`
+	Invalid   int         `json:"invalid"`
+	Error     string      `json:"error,omitempty"`
+	// Results URL of the results, set once the job is finished
+	Results   string    `json:"results,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// newJobResponse returns the state of the job, jobURL is the URL of its status
+func newJobResponse(job *jobs.Job, jobURL string) JobResponse {
+	response := JobResponse{
+		ID:        job.ID,
+		Status:    job.Status,
+		Total:     job.Total,
+		Processed: job.Processed,
+		Created:   job.Created,
+		Existing:  job.Existing,
+		Invalid:   job.Invalid,
+		Error:     job.Error,
+		CreatedAt: job.CreatedAt,
+		UpdatedAt: job.UpdatedAt,
+	}
+	if job.Finished() {
+		response.Results = jobURL + "/results"
+	}
+	return response
+}
+
+// SubmitBatchJob accepts a batch like BatchInsert and processes it in the background.
+// Responds 202 with the job, its status is polled at the Location URL.
+func SubmitBatchJob(opts *config.Options, queue *jobs.Queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var requests []BatchInsertRequest
+		if p := decodeJSON(w, r, &requests); p != nil {
+			problems.Write(w, r, p)
+			return
+		}
+		if p := checkBatch(requests, opts.MaxJobSize); p != nil {
+			problems.Write(w, r, p)
+			return
+		}
+
+		items, err := json.Marshal(requests)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to encode job items")
+			problem(w, r, http.StatusInternalServerError, problems.CodeInternal, "failed to create job")
+			return
+		}
+		job, err := queue.Submit(r.Host, items, len(requests))
+		if errors.Is(err, jobs.ErrQueueFull) {
+			w.Header().Set("Retry-After", "60")
+			problem(w, r, http.StatusServiceUnavailable, problems.CodeUnavailable, err.Error())
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to save job")
+			problem(w, r, http.StatusInternalServerError, problems.CodeInternal, "failed to create job")
+			return
+		}
+
+		// The job is a sibling of the submit route, which keeps the path prefix
+		jobURL := path.Join(path.Dir(r.URL.Path), job.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", jobURL)
+		w.WriteHeader(http.StatusAccepted)
+		if err = json.NewEncoder(w).Encode(newJobResponse(job, jobURL)); err != nil {
+			log.Error().Err(err).Msg("Error encoding response")
+		}
+	}
+}
+
+// loadJob returns the job of the request, writing a problem if it cannot be loaded
+func loadJob(w http.ResponseWriter, r *http.Request, queue *jobs.Queue) (*jobs.Job, bool) {
+	job, err := queue.Get(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, jobs.ErrNotFound) {
+		problem(w, r, http.StatusNotFound, problems.CodeNotFound, errJobNotFound.Error())
+		return nil, false
+	}
+	if store.Unavailable(err) || errors.Is(err, context.Canceled) {
+		storeProblem(w, r, err)
+		return nil, false
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load job")
+		problem(w, r, http.StatusInternalServerError, problems.CodeInternal, "failed to load job")
+		return nil, false
+	}
+	return job, true
+}
+
+// BatchJob returns the status and the progress of a batch job
+func BatchJob(queue *jobs.Queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := loadJob(w, r, queue)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		// Unfinished jobs change with every chunk
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(newJobResponse(job, r.URL.Path)); err != nil {
+			log.Error().Err(err).Msg("Error encoding response")
+		}
+	}
+}
+
+// BatchJobResults returns the results of a finished batch job as a JSON array in the order of the batch,
+// the items of BatchInsert. A failed job has the results of the items processed before it failed.
+func BatchJobResults(queue *jobs.Queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := loadJob(w, r, queue)
+		if !ok {
+			return
+		}
+		if !job.Finished() {
+			problem(w, r, http.StatusConflict, problems.CodeJobNotFinished, fmt.Sprintf("job is %s, %d of %d items are processed", job.Status, job.Processed, job.Total))
+			return
+		}
+		results, err := queue.Results(r.Context(), job.ID)
+		if store.Unavailable(err) || errors.Is(err, context.Canceled) {
+			storeProblem(w, r, err)
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to load job results")
+			problem(w, r, http.StatusInternalServerError, problems.CodeInternal, "failed to load job results")
+			return
+		}
+
+		var body bytes.Buffer
+		body.WriteByte('[')
+		for i, result := range results {
+			if i > 0 {
+				body.WriteByte(',')
+			}
+			body.Write(result)
+		}
+		body.WriteString("]\n")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="job-%s.json"`, job.ID))
+		_, _ = w.Write(body.Bytes())
+	}
+}
+
+// ProcessBatchJob returns the processor of batch jobs: the items are shortened like a streamed batch, chunk by chunk,
+// and the results of every chunk are saved with the job. A restarted job continues after the last saved chunk,
+// reusing the links of a chunk whose results were not saved.
+func ProcessBatchJob(opts *config.Options) jobs.Processor {
+	return func(ctx context.Context, job *jobs.Job, save func(results []json.RawMessage) error) error {
+		var requests []BatchInsertRequest
+		if err := json.Unmarshal(job.Items, &requests); err != nil {
+			return fmt.Errorf("invalid job items: %w", err)
+		}
+
+		chunkSize := opts.BatchChunkSize
+		if chunkSize < 1 {
+			chunkSize = 1
+		}
+		shortener := newBatchShortener(ctx, job.Host, opts)
+		shortener.job = job.ID
+		for start := job.Processed; start < len(requests); start += chunkSize {
+			end := min(start+chunkSize, len(requests))
+			results := make([]json.RawMessage, 0, end-start)
+			records := make([]store.Record, 0, end-start)
+			created, existing, invalid := 0, 0, 0
+			for i := start; i < end; i++ {
+				response, record, err := shortener.add(requests[i], fmt.Sprintf("/%d", i))
+				if err != nil {
+					_, _, detail := storeFailure(err)
+					return errors.New(detail)
+				}
+				if record != nil {
+					records = append(records, *record)
+				}
+				switch response.Status {
+				case BatchCreated:
+					created++
+				case BatchExisting:
+					existing++
+				case BatchInvalid:
+					invalid++
+				}
+				result, err := json.Marshal(response)
+				if err != nil {
+					return err
+				}
+				results = append(results, result)
+			}
+
+			// The progress only counts saved chunks
+			if err := saveBatch(ctx, records, opts); err != nil {
+				_, _, detail := storeFailure(err)
+				return errors.New(detail)
+			}
+			shortener.forget()
+			job.Created += created
+			job.Existing += existing
+			job.Invalid += invalid
+			if err := save(results); err != nil {
+				job.Created -= created
+				job.Existing -= existing
+				job.Invalid -= invalid
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"shortener/internal/config"
+	"shortener/internal/jobs"
+	"shortener/internal/problems"
+	"shortener/internal/store"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestBatchJob(t *testing.T) {
+	store.New()
+	opts := config.Options{BaseURL: "http://localhost:8080", BatchChunkSize: 2, MaxJobSize: 4}
+	queue := jobs.NewQueue(jobs.NewMemoryStore(), ProcessBatchJob(&opts), 1, 1, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := queue.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/jobs/shorten", SubmitBatchJob(&opts, queue)).Methods("POST")
+	r.HandleFunc("/api/jobs/{id}", BatchJob(queue)).Methods("GET")
+	r.HandleFunc("/api/jobs/{id}/results", BatchJobResults(queue)).Methods("GET")
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rr
+	}
+
+	if rr := serve("POST", "/api/jobs/shorten", `[{"correlation_id":"1","original_url":"https://example.com/1"},
+		{"correlation_id":"2","original_url":"https://example.com/2"},{"correlation_id":"3","original_url":"https://example.com/3"},
+		{"correlation_id":"4","original_url":"https://example.com/4"},{"correlation_id":"5","original_url":"https://example.com/5"}]`); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("too large job returned %v, want %v", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	rr := serve("POST", "/api/jobs/shorten", `[{"correlation_id":"1","original_url":"https://example.com/1"},
+		{"correlation_id":"2","original_url":"not a url"},{"correlation_id":"3","original_url":"https://example.com/1"}]`)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("submit returned %v: %s", rr.Code, rr.Body.String())
+	}
+	var submitted JobResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &submitted); err != nil {
+		t.Fatal(err)
+	}
+	location := rr.Header().Get("Location")
+	if location != "/api/jobs/"+submitted.ID || submitted.Total != 3 {
+		t.Fatalf("submit returned Location %q and %+v", location, submitted)
+	}
+
+	var status JobResponse
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		rr = serve("GET", location, "")
+		if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		if status.Status == jobs.StatusDone || time.Now().After(deadline) {
+			break
+		}
+		// Results are only available once the job is finished
+		if rr = serve("GET", location+"/results", ""); rr.Code != http.StatusConflict {
+			t.Errorf("results of an unfinished job returned %v, want %v", rr.Code, http.StatusConflict)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.Status != jobs.StatusDone || status.Processed != 3 || status.Created != 1 || status.Existing != 1 || status.Invalid != 1 {
+		t.Fatalf("job status = %+v", status)
+	}
+	if status.Results != location+"/results" {
+		t.Errorf("job results URL = %q", status.Results)
+	}
+
+	rr = serve("GET", status.Results, "")
+	var results []BatchInsertResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+		t.Fatalf("results returned %v %s: %v", rr.Code, rr.Body.String(), err)
+	}
+	if len(results) != 3 || results[0].Status != BatchCreated || results[1].Status != BatchInvalid ||
+		results[2].Status != BatchExisting || results[2].ShortURL != results[0].ShortURL {
+		t.Fatalf("job results = %+v", results)
+	}
+
+	if rr = serve("GET", "/api/jobs/unknown", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("unknown job returned %v, want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+// timeoutJobStore is a job store whose database does not answer in time
+type timeoutJobStore struct {
+	jobs.Store
+}
+
+func (timeoutJobStore) Load(context.Context, string) (*jobs.Job, error) {
+	return nil, context.DeadlineExceeded
+}
+
+func TestBatchJobTimeout(t *testing.T) {
+	queue := jobs.NewQueue(timeoutJobStore{jobs.NewMemoryStore()}, ProcessBatchJob(&config.Options{}), 1, 1, 0)
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/api/jobs/abc", nil), map[string]string{"id": "abc"})
+	rr := httptest.NewRecorder()
+	BatchJob(queue).ServeHTTP(rr, req)
+	var p problems.Problem
+	if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil || rr.Code != http.StatusGatewayTimeout || p.Code != problems.CodeTimeout {
+		t.Errorf("job returned %v %s", rr.Code, rr.Body.String())
+	}
+}
+
+// A chunk processed again after its links were saved, but not its results, reuses the links
+func TestProcessBatchJobRerun(t *testing.T) {
+	store.New()
+	opts := config.Options{BaseURL: "http://localhost:8080", BatchChunkSize: 10}
+	job := &jobs.Job{ID: "rerun", Host: "localhost:8080", Items: json.RawMessage(`[
+		{"correlation_id": "1", "original_url": "https://example.com/protected", "password": "secret"},
+		{"correlation_id": "2", "original_url": "https://example.com/limited", "max_clicks": 2},
+		{"correlation_id": "3", "original_url": "https://example.com/open"}]`), Total: 3}
+
+	var first []json.RawMessage
+	err := ProcessBatchJob(&opts)(context.Background(), job, func(results []json.RawMessage) error {
+		first = results
+		return errors.New("stopped before the results were saved")
+	})
+	if err == nil || job.Processed != 0 || job.Created != 0 {
+		t.Fatalf("first run returned %v, %d processed", err, job.Processed)
+	}
+
+	var second []json.RawMessage
+	err = ProcessBatchJob(&opts)(context.Background(), job, func(results []json.RawMessage) error {
+		second = results
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(first, second) || job.Created != 3 {
+		t.Errorf("second run returned %s, first %s, %d created", second, first, job.Created)
+	}
+	n := 0
+	store.Store.URLs.Range(func(_, _ any) bool {
+		n++
+		return true
+	})
+	if n != 3 {
+		t.Errorf("store has %d links, want 3", n)
+	}
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"shortener/internal/config"
+	"shortener/internal/problems"
+	"shortener/internal/store"
+	"shortener/internal/validator"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestLinkMetadata(t *testing.T) {
+	store.New()
+	opts := config.Options{BaseURL: "http://localhost:8080", AdminToken: "secret"}
+	store.Store.Save("plain", store.MapValues{Value: "https://example.com/guide"}, &opts)
+
+	shorten := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		ShortenURLFromJSON(&opts).ServeHTTP(rr, httptest.NewRequest("POST", "/api/shorten", strings.NewReader(body)))
+		return rr
+	}
+
+	// A described link is never shared with the plain link of the same URL
+	rr := shorten(`{"url":"https://example.com/guide","title":"Go Style Guide","description":"How we write Go","tags":["Go"," docs","go"]}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("shorten returned %v: %s", rr.Code, rr.Body)
+	}
+	var response ShortenURLResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	shortURL := strings.TrimPrefix(response.ShortURL, "http://localhost:8080/")
+	if link, ok := store.Store.Find(shortURL); !ok || link.Title != "Go Style Guide" || link.Tags != "docs,go" {
+		t.Fatalf("created link %q = %+v, %v", shortURL, link, ok)
+	}
+
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/api/expand/"+shortURL, nil), map[string]string{"shortURL": shortURL})
+	rr = httptest.NewRecorder()
+	Expand(&opts).ServeHTTP(rr, req)
+	var expanded ExpandResponse
+	if err := json.NewDecoder(rr.Body).Decode(&expanded); err != nil {
+		t.Fatal(err)
+	}
+	if expanded.Title != "Go Style Guide" || expanded.Description != "How we write Go" || !reflect.DeepEqual(expanded.Tags, []string{"docs", "go"}) {
+		t.Errorf("expand = %+v", expanded)
+	}
+
+	rr = httptest.NewRecorder()
+	BatchInsert(&opts).ServeHTTP(rr, httptest.NewRequest("POST", "/api/shorten/batch", strings.NewReader(
+		`[{"correlation_id":"1","original_url":"https://blog.example/release-notes","title":"Release notes","tags":["news"]}]`)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("batch returned %v: %s", rr.Code, rr.Body)
+	}
+
+	// list returns the titles and tags of the matching links, sorted
+	list := func(query string) string {
+		t.Helper()
+		rr := adminRequest(ListLinks(&opts), "GET", "/api/admin/links?"+query, "", "")
+		var response AdminLinksResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || rr.Code != http.StatusOK {
+			t.Fatalf("list %q returned %v %s", query, rr.Code, rr.Body.String())
+		}
+		var links []string
+		for _, link := range response.Links {
+			links = append(links, link.Title+"|"+strings.Join(link.Tags, ","))
+		}
+		sort.Strings(links)
+		return strings.Join(links, " ")
+	}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{query: "tag=Go", want: "Go Style Guide|docs,go"},
+		{query: "tag=go&tag=news", want: ""},
+		{query: "search=style+GUIDE", want: "Go Style Guide|docs,go"},
+		{query: "search=release+blog", want: "Release notes|news"},
+		{query: "search=guide", want: "Go Style Guide|docs,go |"},
+		{query: "search=guide&tag=docs", want: "Go Style Guide|docs,go"},
+		{query: "search=--", want: ""},
+	}
+	for _, tt := range tests {
+		if got := list(tt.query); got != tt.want {
+			t.Errorf("list %q = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+
+	// The index follows deleted links
+	store.Store.Delete("plain")
+	if got := list("search=guide"); got != "Go Style Guide|docs,go" {
+		t.Errorf("list after delete = %q", got)
+	}
+
+	rr = shorten(`{"url":"https://example.com","title":"a\u0000b","tags":["no spaces"]}`)
+	var p problems.Problem
+	if err := json.NewDecoder(rr.Body).Decode(&p); err != nil || rr.Code != http.StatusBadRequest {
+		t.Fatalf("invalid metadata returned %v, %v", rr.Code, err)
+	}
+	want := []problems.FieldError{
+		{Field: "/title", Code: FieldInvalidTitle, Detail: validator.ErrControlCharacter.Error()},
+		{Field: "/tags", Code: FieldInvalidTags, Detail: validator.ErrTag.Error()},
+	}
+	if !reflect.DeepEqual(p.Errors, want) {
+		t.Errorf("got field errors %+v, want %+v", p.Errors, want)
+	}
+}
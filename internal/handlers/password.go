@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+	"html/template"
+	"net/http"
+	"shortener/internal/config"
+	"shortener/internal/problems"
+	"shortener/internal/store"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// passwordHeader the header to send the link password in, on creation and on redirect
+const passwordHeader = "X-Link-Password"
+
+var (
+	errWrongPassword    = errors.New("wrong password")
+	errTooManyAttempts  = errors.New("too many failed attempts, try again later")
+	errPasswordRequired = errors.New("password required")
+)
+
+// attempts failed password attempts of a single link
+type attempts struct {
+	failures int
+	// pending attempts being verified, they count as failures until they are done
+	pending     int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// attemptLimiter throttles failed password attempts per link
+type attemptLimiter struct {
+	mu        sync.Mutex
+	links     map[string]*attempts
+	lastSweep time.Time
+}
+
+var passwordAttempts = attemptLimiter{links: make(map[string]*attempts)}
+
+// reserve starts an attempt on the link, unless it is locked or the attempts in flight could reach maxAttempts.
+// Returns how long to wait otherwise. Zero maxAttempts disables locking. Every reserved attempt must be done.
+func (l *attemptLimiter) reserve(shortURL string, maxAttempts int, lockout time.Duration) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.sweep(now, lockout)
+	a, ok := l.links[shortURL]
+	if !ok {
+		a = &attempts{}
+		l.links[shortURL] = a
+	}
+	if left := a.lockedUntil.Sub(now); left > 0 {
+		return left
+	}
+	// Failures are forgotten once they are older than the lockout window
+	if a.failures > 0 && now.Sub(a.lastFailure) >= lockout {
+		a.failures = 0
+	}
+	if maxAttempts > 0 && a.failures+a.pending >= maxAttempts {
+		// The attempts in flight are verified within a second
+		return time.Second
+	}
+	a.pending++
+	return 0
+}
+
+// done ends a reserved attempt, a failed one locks the link once there are maxAttempts failures
+func (l *attemptLimiter) done(shortURL string, ok bool, maxAttempts int, lockout time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a := l.links[shortURL]
+	a.pending--
+	if ok {
+		a.failures = 0
+		return
+	}
+	a.failures++
+	a.lastFailure = time.Now()
+	if maxAttempts > 0 && a.failures >= maxAttempts {
+		a.failures = 0
+		a.lockedUntil = a.lastFailure.Add(lockout)
+	}
+}
+
+// sweep drops the links without attempts in flight, lock or recent failure, at most once per lockout window
+func (l *attemptLimiter) sweep(now time.Time, lockout time.Duration) {
+	if now.Sub(l.lastSweep) < lockout {
+		return
+	}
+	l.lastSweep = now
+	for shortURL, a := range l.links {
+		if a.pending == 0 && !now.Before(a.lockedUntil) && now.Sub(a.lastFailure) >= lockout {
+			delete(l.links, shortURL)
+		}
+	}
+}
+
+// hashPassword hashes the optional link password, an empty password means the link is not protected
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+	return store.HashPassword(password)
+}
+
+// verifyPassword checks the password of a protected link, throttling failed attempts.
+// Returns the status code to respond with when the password is not accepted.
+func verifyPassword(w http.ResponseWriter, shortURL string, link store.MapValues, password string, opts *config.Options) (int, error) {
+	shortURL = store.Key(link.Domain, shortURL)
+	if left := passwordAttempts.reserve(shortURL, opts.PasswordMaxAttempts, opts.PasswordLockout); left > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(left.Seconds())+1))
+		return http.StatusTooManyRequests, errTooManyAttempts
+	}
+	ok := store.CheckPassword(link.PasswordHash, password)
+	passwordAttempts.done(shortURL, ok, opts.PasswordMaxAttempts, opts.PasswordLockout)
+	if !ok {
+		return http.StatusUnauthorized, errWrongPassword
+	}
+	return http.StatusOK, nil
+}
+
+var passwordTemplate = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex, nofollow">
+<title>Protected link</title>
+</head>
+<body>
+<h1>This link is password protected</h1>
+{{if .Error}}<p>{{.Error}}</p>{{end}}
+<form method="post" action="{{.Action}}">
+<input type="password" name="password" autofocus required>
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
+
+// passwordProblemCode returns the problem code of a status returned by verifyPassword
+func passwordProblemCode(status int) string {
+	if status == http.StatusTooManyRequests {
+		return problems.CodeTooManyAttempts
+	}
+	return problems.CodeWrongPassword
+}
+
+// renderPasswordForm serves the page asking for the link password.
+// The form is posted back to the same URL, so the forwarded path and query are kept.
+func renderPasswordForm(w http.ResponseWriter, r *http.Request, message string, status int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	err := passwordTemplate.Execute(w, struct{ Action, Error string }{r.URL.RequestURI(), message})
+	if err != nil {
+		log.Error().Err(err).Msg("Error rendering password form")
+	}
+}
+
+// UnlockURL handles the password form of a protected link and redirects if the password is right
+func UnlockURL(opts *config.Options) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		shortURL := mux.Vars(r)["shortURL"]
+		link, ok, err := findURL(r.Context(), requestDomain(r, opts).Namespace, shortURL, opts)
+		if err != nil {
+			storeProblem(w, r, err)
+			return
+		}
+		// A path after the short URL is only accepted by links forwarding it
+		if !ok || !acceptsPath(r, link, opts) {
+			problem(w, r, http.StatusNotFound, problems.CodeNotFound, errLinkNotFound.Error())
+			return
+		}
+		if link.Disabled {
+			problem(w, r, http.StatusGone, problems.CodeLinkDisabled, errLinkDisabled.Error())
+			return
+		}
+		if err := checkDomain(link.Value); err != nil {
+			problem(w, r, http.StatusForbidden, problems.CodeBlockedDomain, err.Error())
+			return
+		}
+		if link.Exhausted() {
+			problem(w, r, http.StatusGone, problems.CodeLinkExhausted, errExhausted.Error())
+			return
+		}
+		// The form was posted, so the browser has to follow with GET
+		if link.Redirect.Status == 0 || link.Redirect.Status == http.StatusTemporaryRedirect || link.Redirect.Status == http.StatusPermanentRedirect {
+			link.Redirect.Status = http.StatusSeeOther
+		}
+		if link.PasswordHash == "" {
+			if consumeClick(w, r, shortURL, link, opts) {
+				redirect(w, r, link, opts)
+			}
+			return
+		}
+
+		password := r.PostFormValue("password")
+		if password == "" {
+			renderPasswordForm(w, r, errPasswordRequired.Error(), http.StatusUnauthorized)
+			return
+		}
+		if status, err := verifyPassword(w, shortURL, link, password, opts); err != nil {
+			renderPasswordForm(w, r, err.Error(), status)
+			return
+		}
+		if consumeClick(w, r, shortURL, link, opts) {
+			redirect(w, r, link, opts)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAttemptLimiter(t *testing.T) {
+	l := attemptLimiter{links: make(map[string]*attempts)}
+
+	// Parallel guesses can't get more attempts than allowed before the first one is counted
+	var reserved atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if l.reserve("a", 3, time.Minute) == 0 {
+				reserved.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if reserved.Load() != 3 {
+		t.Fatalf("%d attempts reserved, want 3", reserved.Load())
+	}
+	for i := 0; i < 3; i++ {
+		l.done("a", false, 3, time.Minute)
+	}
+	if left := l.reserve("a", 3, time.Minute); left <= 59*time.Second {
+		t.Errorf("locked for %v after 3 failures", left)
+	}
+
+	// A success forgets the failures
+	l.reserve("b", 3, time.Minute)
+	l.done("b", false, 3, time.Minute)
+	l.reserve("b", 3, time.Minute)
+	l.done("b", true, 3, time.Minute)
+	if a := l.links["b"]; a.failures != 0 || a.pending != 0 {
+		t.Errorf("attempts after success = %+v", a)
+	}
+
+	// Failures expire after the lockout window, and so do the links left without any
+	l.reserve("c", 2, time.Minute)
+	l.done("c", false, 2, time.Minute)
+	l.links["c"].lastFailure = time.Now().Add(-time.Minute)
+	if left := l.reserve("c", 2, time.Minute); left != 0 {
+		t.Errorf("expired failure still counted, locked for %v", left)
+	}
+	l.done("c", false, 2, time.Minute)
+	if a := l.links["c"]; a.failures != 1 || !a.lockedUntil.IsZero() {
+		t.Errorf("attempts after an expired failure = %+v", a)
+	}
+	l.links["c"].lastFailure = time.Now().Add(-time.Minute)
+	l.links["b"].lastFailure = time.Now().Add(-time.Minute)
+	l.links["a"].lockedUntil = time.Now()
+	l.links["a"].lastFailure = time.Now().Add(-time.Minute)
+	l.lastSweep = time.Time{}
+	l.reserve("d", 2, time.Minute)
+	if _, ok := l.links["c"]; ok || len(l.links) != 1 {
+		t.Errorf("links after sweep = %v", l.links)
+	}
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"shortener/internal/problems"
+	"strings"
+)
+
+// Field error codes of an invalid-request problem
+const (
+	FieldInvalidURL       = "invalid-url"
+	FieldBlockedDomain    = "blocked-domain"
+	FieldInvalidRedirect  = "invalid-redirect"
+	FieldInvalidPassword  = "invalid-password"
+	FieldInvalidMaxClicks = "invalid-max-clicks"
+	FieldUnknownDomain    = "unknown-domain"
+	FieldInvalidLine      = "invalid-line"
+	FieldInvalidAlias     = "invalid-alias"
+	FieldAliasTaken       = "alias-taken"
+	FieldInvalidTitle     = "invalid-title"
+	FieldInvalidTags      = "invalid-tags"
+
+	FieldInvalidDescription     = "invalid-description"
+	FieldInvalidCorrelationID   = "invalid-correlation-id"
+	FieldDuplicateCorrelationID = "duplicate-correlation-id"
+	FieldTooManyLines           = "too-many-lines"
+)
+
+// problem writes a problem without field errors
+func problem(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	problems.Write(w, r, problems.New(status, code, detail))
+}
+
+// Maximum size of a JSON request body
+const maxJSONBody = 10 << 20
+
+var (
+	errEmptyBody    = errors.New("request body is empty")
+	errTrailingData = errors.New("request body has data after the JSON value")
+)
+
+// decodeJSON decodes the request body strictly: it must hold exactly one JSON value without unknown fields
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) *problems.Problem {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxJSONBody))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return problems.New(http.StatusRequestEntityTooLarge, problems.CodeTooLarge, fmt.Sprintf("request body is larger than %d bytes", tooLarge.Limit))
+	}
+	if err != nil {
+		return problems.New(http.StatusBadRequest, problems.CodeInvalidBody, "error reading request body")
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return problems.New(http.StatusBadRequest, problems.CodeInvalidBody, errEmptyBody.Error())
+	}
+
+	if err = decodeStrict(body, v); err != nil {
+		return problems.New(http.StatusBadRequest, problems.CodeInvalidBody, jsonErrorDetail(err))
+	}
+	return nil
+}
+
+// decodeStrict decodes exactly one JSON value without unknown fields
+func decodeStrict(data []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return errTrailingData
+	}
+	return nil
+}
+
+// jsonErrorDetail describes a decoding error without the Go types
+func jsonErrorDetail(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("invalid JSON at offset %d", syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return fmt.Sprintf("expected a different JSON value than %s", typeErr.Value)
+		}
+		return fmt.Sprintf("field %s must not be a %s", typeErr.Field, typeErr.Value)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "request body ends in the middle of the JSON value"
+	case errors.Is(err, errTrailingData):
+		return err.Error()
+	}
+	// Unknown fields are reported as: json: unknown field "name"
+	return strings.TrimPrefix(err.Error(), "json: ")
+}
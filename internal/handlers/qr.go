@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+	"github.com/skip2/go-qrcode"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"shortener/internal/config"
+	"shortener/internal/problems"
+	"strconv"
+	"strings"
+)
+
+const (
+	qrDefaultSize   = 256
+	qrMinSize       = 64
+	qrMaxSize       = 2048
+	qrDefaultMargin = 4
+	qrMaxMargin     = 16
+)
+
+// qrLevels error correction levels by their query names
+var qrLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// QRCode returns a QR code of the short link as PNG or SVG.
+// Query parameters: format (png, svg), size in pixels, margin in modules, level (L, M, Q, H).
+// Without format the Accept header decides, PNG being the default.
+func QRCode(opts *config.Options) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		shortURL := mux.Vars(r)["shortURL"]
+		domain := requestDomain(r, opts)
+		_, ok, err := findURL(r.Context(), domain.Namespace, shortURL, opts)
+		if err != nil {
+			storeProblem(w, r, err)
+			return
+		}
+		if !ok {
+			problem(w, r, http.StatusNotFound, problems.CodeNotFound, errLinkNotFound.Error())
+			return
+		}
+
+		query := r.URL.Query()
+		format := strings.ToLower(query.Get("format"))
+		if format == "" {
+			format = "png"
+			if strings.Contains(r.Header.Get("Accept"), "image/svg+xml") {
+				format = "svg"
+			}
+		}
+		if format != "png" && format != "svg" {
+			problem(w, r, http.StatusBadRequest, problems.CodeInvalidParameter, "format must be png or svg")
+			return
+		}
+		size, err := intParam(query.Get("size"), qrDefaultSize, qrMinSize, qrMaxSize)
+		if err != nil {
+			problem(w, r, http.StatusBadRequest, problems.CodeInvalidParameter, "size: "+err.Error())
+			return
+		}
+		margin, err := intParam(query.Get("margin"), qrDefaultMargin, 0, qrMaxMargin)
+		if err != nil {
+			problem(w, r, http.StatusBadRequest, problems.CodeInvalidParameter, "margin: "+err.Error())
+			return
+		}
+		levelName := strings.ToUpper(query.Get("level"))
+		if levelName == "" {
+			levelName = "M"
+		}
+		level, ok := qrLevels[levelName]
+		if !ok {
+			problem(w, r, http.StatusBadRequest, problems.CodeInvalidParameter, "level must be L, M, Q or H")
+			return
+		}
+
+		// The image only depends on the link and the parameters
+		link := fmt.Sprintf("%s/%s", domain.BaseURL, shortURL)
+		etagHash := sha1.Sum([]byte(fmt.Sprintf("%s|%s|%d|%d|%s", link, format, size, margin, levelName)))
+		etag := `"` + hex.EncodeToString(etagHash[:]) + `"`
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Vary", "Accept")
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		code, err := qrcode.New(link, level)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to encode QR code")
+			problem(w, r, http.StatusInternalServerError, problems.CodeInternal, "failed to encode QR code")
+			return
+		}
+		code.DisableBorder = true
+		bitmap := code.Bitmap()
+
+		var body bytes.Buffer
+		if format == "svg" {
+			w.Header().Set("Content-Type", "image/svg+xml")
+			writeQRSVG(&body, bitmap, size, margin)
+		} else {
+			w.Header().Set("Content-Type", "image/png")
+			err = png.Encode(&body, qrImage(bitmap, size, margin))
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to encode PNG")
+				problem(w, r, http.StatusInternalServerError, problems.CodeInternal, "failed to encode PNG")
+				return
+			}
+		}
+		_, _ = w.Write(body.Bytes())
+	}
+}
+
+// intParam parses an optional integer query parameter within bounds
+func intParam(value string, def, minValue, maxValue int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if n < minValue || n > maxValue {
+		return 0, fmt.Errorf("must be between %d and %d", minValue, maxValue)
+	}
+	return n, nil
+}
+
+// qrImage draws the bitmap scaled to fit into size pixels, centered, with margin modules around it
+func qrImage(bitmap [][]bool, size, margin int) image.Image {
+	modules := len(bitmap) + 2*margin
+	scale := size / modules
+	if scale < 1 {
+		scale = 1
+		size = modules
+	}
+	offset := (size-scale*modules)/2 + margin*scale
+
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{color.White, color.Black})
+	for y, row := range bitmap {
+		for x, set := range row {
+			if !set {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex(offset+x*scale+dx, offset+y*scale+dy, 1)
+				}
+			}
+		}
+	}
+	return img
+}
+
+// writeQRSVG writes the bitmap as an SVG image, one path of unit squares in module coordinates
+func writeQRSVG(buf *bytes.Buffer, bitmap [][]bool, size, margin int) {
+	modules := len(bitmap) + 2*margin
+	fmt.Fprintf(buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size, size, modules, modules)
+	fmt.Fprintf(buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, modules, modules)
+	for y, row := range bitmap {
+		for x, set := range row {
+			if set {
+				fmt.Fprintf(buf, "M%d %dh1v1h-1z", x+margin, y+margin)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"shortener/internal/config"
+	"shortener/internal/problems"
+	"shortener/internal/store"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestQRCode(t *testing.T) {
+	store.New()
+	opts := config.Options{BaseURL: "http://localhost:8080"}
+	store.Store.Save("abc", store.MapValues{Value: "https://example.com"}, &opts)
+
+	qr := func(shortURL, query string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/"+shortURL+"/qr?"+query, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rr := httptest.NewRecorder()
+		QRCode(&opts).ServeHTTP(rr, mux.SetURLVars(req, map[string]string{"shortURL": shortURL}))
+		return rr
+	}
+
+	t.Run("png", func(t *testing.T) {
+		rr := qr("abc", "size=100&margin=0", nil)
+		if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "image/png" {
+			t.Fatalf("qr returned %v %s", rr.Code, rr.Header().Get("Content-Type"))
+		}
+		img, err := png.Decode(bytes.NewReader(rr.Body.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bounds := img.Bounds(); bounds.Dx() != 100 || bounds.Dy() != 100 {
+			t.Errorf("image is %v, want 100x100", bounds)
+		}
+	})
+
+	t.Run("svg", func(t *testing.T) {
+		for _, tt := range []struct {
+			query  string
+			accept string
+		}{
+			{query: "format=SVG"},
+			{accept: "image/svg+xml,image/*"},
+		} {
+			rr := qr("abc", tt.query, http.Header{"Accept": {tt.accept}})
+			if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "image/svg+xml" ||
+				!strings.HasPrefix(rr.Body.String(), "<svg ") || rr.Header().Get("Vary") != "Accept" {
+				t.Errorf("qr %q, Accept %q returned %v %s", tt.query, tt.accept, rr.Code, rr.Header().Get("Content-Type"))
+			}
+		}
+	})
+
+	t.Run("invalid parameters", func(t *testing.T) {
+		for _, query := range []string{"format=gif", "size=63", "size=2049", "size=big", "margin=-1", "margin=17", "level=X"} {
+			rr := qr("abc", query, nil)
+			var p problems.Problem
+			if err := json.NewDecoder(rr.Body).Decode(&p); err != nil || rr.Code != http.StatusBadRequest || p.Code != problems.CodeInvalidParameter {
+				t.Errorf("qr %q returned %v %+v", query, rr.Code, p)
+			}
+		}
+		for _, query := range []string{"size=64&margin=0&level=l", "size=2048&margin=16&level=H"} {
+			if rr := qr("abc", query, nil); rr.Code != http.StatusOK {
+				t.Errorf("qr %q returned %v", query, rr.Code)
+			}
+		}
+	})
+
+	t.Run("unknown link", func(t *testing.T) {
+		rr := qr("missing", "", nil)
+		if rr.Code != http.StatusNotFound || rr.Header().Get("Content-Type") != "application/problem+json" {
+			t.Errorf("qr returned %v %s", rr.Code, rr.Header().Get("Content-Type"))
+		}
+	})
+
+	t.Run("etag", func(t *testing.T) {
+		etag := qr("abc", "", nil).Header().Get("ETag")
+		if etag == "" {
+			t.Fatal("no ETag")
+		}
+		rr := qr("abc", "", http.Header{"If-None-Match": {etag}})
+		if rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+			t.Errorf("qr with If-None-Match returned %v, %d bytes", rr.Code, rr.Body.Len())
+		}
+		// Other parameters make another image
+		if other := qr("abc", "format=svg", nil).Header().Get("ETag"); other == etag {
+			t.Errorf("svg has the ETag of the png")
+		}
+		if rr = qr("abc", "format=svg", http.Header{"If-None-Match": {etag}}); rr.Code != http.StatusOK {
+			t.Errorf("svg with the png ETag returned %v", rr.Code)
+		}
+	})
+}
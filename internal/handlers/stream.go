@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"mime"
+	"net/http"
+	"shortener/internal/config"
+	"shortener/internal/problems"
+	"shortener/internal/store"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+// Maximum size of a line of a streamed batch
+const maxStreamLine = 64 << 10
+
+// BatchFailed status of the created links of a chunk that could not be saved
+const BatchFailed = "failed"
+
+// BatchStreamResult the result of a line of a streamed batch
+type BatchStreamResult struct {
+	Line int `json:"line"`
+	BatchInsertResponse
+}
+
+// isNDJSON reports whether the request body is newline delimited JSON
+func isNDJSON(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == ndjsonContentType
+}
+
+// streamBatch shortens a batch of NDJSON lines chunk by chunk: a chunk is saved in one transaction
+// and its results are sent before the next one is read, so a client not reading the results stops the reading.
+// Memory holds one chunk and the correlation IDs seen so far, the number of lines is limited by MaxStreamLines.
+func streamBatch(w http.ResponseWriter, r *http.Request, opts *config.Options) {
+	rc := http.NewResponseController(w)
+	// HTTP/1 servers close the request body on the first write otherwise
+	_ = rc.EnableFullDuplex()
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 4096), maxStreamLine)
+
+	w.Header().Set("Content-Type", ndjsonContentType)
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+
+	chunkSize := opts.BatchChunkSize
+	if chunkSize < 1 {
+		chunkSize = 1
+	}
+	shortener := newBatchShortener(r.Context(), r.Host, opts)
+	seen := make(map[string]bool)
+	results := make([]BatchStreamResult, 0, chunkSize)
+	records := make([]store.Record, 0, chunkSize)
+
+	// flush saves the chunk and sends its results, false means the batch has to stop
+	flush := func() bool {
+		saved := true
+		if err := saveBatch(r.Context(), records, opts); err != nil {
+			saved = false
+			_, code, detail := storeFailure(err)
+			for i := range results {
+				if results[i].Status == BatchCreated {
+					results[i].Status = BatchFailed
+					results[i].ShortURL = ""
+					results[i].Errors = []problems.FieldError{{Code: code, Detail: detail}}
+				}
+			}
+		}
+		for _, result := range results {
+			if err := encoder.Encode(result); err != nil {
+				return false
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			log.Error().Err(err).Msg("Failed to flush batch results")
+		}
+		if saved {
+			shortener.forget()
+		}
+		results, records = results[:0], records[:0]
+		return saved
+	}
+
+	line, items := 0, 0
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		if items++; opts.MaxStreamLines > 0 && items > opts.MaxStreamLines {
+			// The lines before are saved and the rest is not read
+			if len(results) > 0 && !flush() {
+				return
+			}
+			_ = encoder.Encode(BatchStreamResult{Line: line, BatchInsertResponse: BatchInsertResponse{
+				Status: BatchInvalid,
+				Errors: []problems.FieldError{{Code: FieldTooManyLines, Detail: fmt.Sprintf("batch has more than %d lines", opts.MaxStreamLines)}},
+			}})
+			return
+		}
+
+		result := BatchStreamResult{Line: line}
+		var req BatchInsertRequest
+		if err := decodeStrict(text, &req); err != nil {
+			result.Status = BatchInvalid
+			result.Errors = []problems.FieldError{{Code: FieldInvalidLine, Detail: jsonErrorDetail(err)}}
+		} else if fieldErr, ok := checkStreamCorrelationID(req.CorrelationID, seen); !ok {
+			result.CorrelationID = req.CorrelationID
+			result.Status = BatchInvalid
+			result.Errors = []problems.FieldError{fieldErr}
+		} else {
+			var record *store.Record
+			var err error
+			result.BatchInsertResponse, record, err = shortener.add(req, "")
+			if err != nil {
+				// The store can't be read, the items before are saved and the rest is not read
+				_, code, detail := storeFailure(err)
+				result.Status = BatchFailed
+				result.Errors = []problems.FieldError{{Code: code, Detail: detail}}
+				results = append(results, result)
+				flush()
+				return
+			}
+			if record != nil {
+				records = append(records, *record)
+			}
+		}
+		results = append(results, result)
+
+		if len(results) == chunkSize && !flush() {
+			return
+		}
+	}
+	if len(results) > 0 && !flush() {
+		return
+	}
+
+	// The input could not be read to the end, report it as the next line
+	if err := scanner.Err(); err != nil {
+		detail := "error reading request body"
+		if errors.Is(err, bufio.ErrTooLong) {
+			detail = fmt.Sprintf("line is longer than %d bytes", maxStreamLine)
+		}
+		_ = encoder.Encode(BatchStreamResult{Line: line + 1, BatchInsertResponse: BatchInsertResponse{
+			Status: BatchInvalid,
+			Errors: []problems.FieldError{{Code: FieldInvalidLine, Detail: detail}},
+		}})
+	}
+}
+
+// checkStreamCorrelationID checks the correlation ID is set and unique in the stream
+func checkStreamCorrelationID(id string, seen map[string]bool) (problems.FieldError, bool) {
+	switch {
+	case id == "":
+		return problems.FieldError{Field: "/correlation_id", Code: FieldInvalidCorrelationID, Detail: errCorrelationID.Error()}, false
+	case seen[id]:
+		return problems.FieldError{Field: "/correlation_id", Code: FieldDuplicateCorrelationID, Detail: errDuplicateID.Error()}, false
+	}
+	seen[id] = true
+	return problems.FieldError{}, true
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"shortener/internal/config"
+	"shortener/internal/store"
+	"strings"
+	"testing"
+)
+
+func TestBatchInsertStream(t *testing.T) {
+	store.New()
+	opts := config.Options{BaseURL: "http://localhost:8080", BatchChunkSize: 2}
+
+	body := strings.Join([]string{
+		`{"correlation_id": "1", "original_url": "https://example.com/1"}`,
+		`{"correlation_id": "2", "original_url": `,
+		``,
+		`{"correlation_id": "1", "original_url": "https://example.com/dup"}`,
+		`{"correlation_id": "3", "original_url": "https://example.com/1"}`,
+		`{"correlation_id": "4", "original_url": "https://example.com/4", "ttl": 1}`,
+	}, "\n")
+	req := httptest.NewRequest("POST", "/api/shorten/batch", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	rr := httptest.NewRecorder()
+	BatchInsert(&opts).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != ndjsonContentType {
+		t.Fatalf("handler returned %v %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	var results []BatchStreamResult
+	decoder := json.NewDecoder(rr.Body)
+	for decoder.More() {
+		var result BatchStreamResult
+		if err := decoder.Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, result)
+	}
+
+	want := []struct {
+		line   int
+		status string
+		code   string
+	}{
+		{1, BatchCreated, ""},
+		{2, BatchInvalid, FieldInvalidLine},
+		{4, BatchInvalid, FieldDuplicateCorrelationID},
+		{5, BatchExisting, ""},
+		{6, BatchInvalid, FieldInvalidLine},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d: %+v", len(results), len(want), results)
+	}
+	for i, w := range want {
+		got := results[i]
+		code := ""
+		if len(got.Errors) > 0 {
+			code = got.Errors[0].Code
+		}
+		if got.Line != w.line || got.Status != w.status || code != w.code {
+			t.Errorf("result %d = %+v, want line %d %s %s", i, got, w.line, w.status, w.code)
+		}
+	}
+	if results[3].ShortURL != results[0].ShortURL {
+		t.Errorf("the same URL got %s and %s", results[0].ShortURL, results[3].ShortURL)
+	}
+}
+
+// The results of a chunk arrive before the rest of the batch is sent
+func TestBatchInsertStreamIsIncremental(t *testing.T) {
+	store.New()
+	opts := config.Options{BaseURL: "http://localhost:8080", BatchChunkSize: 1}
+	server := httptest.NewServer(BatchInsert(&opts))
+	defer server.Close()
+
+	bodyReader, bodyWriter := io.Pipe()
+	req, err := http.NewRequest("POST", server.URL, bodyReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	responses := make(chan *http.Response)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			close(responses)
+			return
+		}
+		responses <- resp
+	}()
+
+	_, _ = fmt.Fprintln(bodyWriter, `{"correlation_id": "1", "original_url": "https://example.com/1"}`)
+	resp, ok := <-responses
+	if !ok {
+		return
+	}
+	defer resp.Body.Close()
+	results := bufio.NewScanner(resp.Body)
+	if !results.Scan() || !strings.Contains(results.Text(), `"correlation_id":"1"`) {
+		t.Fatalf("first result = %q, %v", results.Text(), results.Err())
+	}
+
+	_, _ = fmt.Fprintln(bodyWriter, `{"correlation_id": "2", "original_url": "https://example.com/2"}`)
+	_ = bodyWriter.Close()
+	if !results.Scan() || !strings.Contains(results.Text(), `"correlation_id":"2"`) {
+		t.Fatalf("second result = %q, %v", results.Text(), results.Err())
+	}
+}
+
+func TestBatchInsertStreamLineLimit(t *testing.T) {
+	store.New()
+	opts := config.Options{BaseURL: "http://localhost:8080", BatchChunkSize: 2, MaxStreamLines: 3}
+
+	var lines []string
+	for i := 1; i <= 5; i++ {
+		lines = append(lines, fmt.Sprintf(`{"correlation_id": "%d", "original_url": "https://example.com/%d"}`, i, i))
+	}
+	req := httptest.NewRequest("POST", "/api/shorten/batch", strings.NewReader(strings.Join(lines, "\n")))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	rr := httptest.NewRecorder()
+	BatchInsert(&opts).ServeHTTP(rr, req)
+
+	var results []BatchStreamResult
+	decoder := json.NewDecoder(rr.Body)
+	for decoder.More() {
+		var result BatchStreamResult
+		if err := decoder.Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, result)
+	}
+	// The lines up to the limit are saved, the one after it is reported and the rest is not read
+	if len(results) != 4 {
+		t.Fatalf("got %d results: %+v", len(results), results)
+	}
+	for _, result := range results[:3] {
+		if result.Status != BatchCreated {
+			t.Errorf("result = %+v", result)
+		}
+	}
+	if last := results[3]; last.Line != 4 || last.Status != BatchInvalid || len(last.Errors) != 1 || last.Errors[0].Code != FieldTooManyLines {
+		t.Errorf("last result = %+v", last)
+	}
+	n := 0
+	store.Store.URLs.Range(func(_, _ any) bool {
+		n++
+		return true
+	})
+	if n != 3 {
+		t.Errorf("store has %d links, want 3", n)
+	}
+}
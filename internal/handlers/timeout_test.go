@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"shortener/internal/config"
+	"shortener/internal/problems"
+	"shortener/internal/store"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// hangingDriver is a database that never answers, queries only return when their context is done
+type hangingDriver struct{}
+
+func (hangingDriver) Open(string) (driver.Conn, error) { return hangingConn{}, nil }
+
+type hangingConn struct{}
+
+func (hangingConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (hangingConn) Close() error                        { return nil }
+func (hangingConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (hangingConn) QueryContext(ctx context.Context, _ string, _ []driver.NamedValue) (driver.Rows, error) {
+	<-ctx.Done()
+	return nil, errors.New("canceling statement")
+}
+
+func (hangingConn) Ping(ctx context.Context) error {
+	<-ctx.Done()
+	return errors.New("canceling statement")
+}
+
+func (hangingConn) ExecContext(ctx context.Context, _ string, _ []driver.NamedValue) (driver.Result, error) {
+	<-ctx.Done()
+	return nil, errors.New("canceling statement")
+}
+
+func init() {
+	sql.Register("hanging", hangingDriver{})
+}
+
+func TestStoreTimeout(t *testing.T) {
+	store.New()
+	db, err := sql.Open("hanging", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	oldDB, oldTimeout := store.DB, store.QueryTimeout
+	store.DB, store.QueryTimeout = db, 20*time.Millisecond
+	defer func() { store.DB, store.QueryTimeout = oldDB, oldTimeout }()
+	defer resetBreaker()()
+	opts := config.Options{BaseURL: "http://localhost:8080", ConnectionString: "hanging"}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		body    string
+	}{
+		{name: "redirect", handler: RedirectToURL(&opts), method: "GET"},
+		{name: "shorten", handler: ShortenURL(&opts), method: "POST", body: "https://example.com/timeout"},
+		{name: "shorten JSON", handler: ShortenURLFromJSON(&opts), method: "POST", body: `{"url": "https://example.com/timeout"}`},
+		{name: "batch", handler: BatchInsert(&opts), method: "POST", body: `[{"correlation_id": "1", "original_url": "https://example.com/timeout"}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store.DBBreaker = store.NewBreaker(5, time.Minute)
+			req := httptest.NewRequest(tt.method, "/abc", strings.NewReader(tt.body))
+			req = mux.SetURLVars(req, map[string]string{"shortURL": "abc"})
+			rr := httptest.NewRecorder()
+			start := time.Now()
+			tt.handler.ServeHTTP(rr, req)
+
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("handler took %v", elapsed)
+			}
+			var p problems.Problem
+			if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil || rr.Code != http.StatusGatewayTimeout || p.Code != problems.CodeTimeout {
+				t.Errorf("handler returned %v %s", rr.Code, rr.Body.String())
+			}
+		})
+	}
+
+	// A client going away cancels the query without waiting for the timeout
+	store.DBBreaker = store.NewBreaker(5, time.Minute)
+	store.QueryTimeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/abc", nil).WithContext(ctx)
+	req = mux.SetURLVars(req, map[string]string{"shortURL": "abc"})
+	time.AfterFunc(20*time.Millisecond, cancel)
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	RedirectToURL(&opts).ServeHTTP(rr, req)
+	if elapsed := time.Since(start); elapsed > time.Second || rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("canceled request returned %v after %v", rr.Code, elapsed)
+	}
+}
+
+// resetBreaker gives the test a closed database breaker, the returned function restores the old one
+func resetBreaker() func() {
+	old := store.DBBreaker
+	store.DBBreaker = store.NewBreaker(5, time.Minute)
+	return func() { store.DBBreaker = old }
+}
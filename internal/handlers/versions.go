@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"shortener/internal/config"
+	"shortener/internal/problems"
+	"shortener/internal/store"
+	"time"
+)
+
+var errVersionNotFound = errors.New("version does not exist")
+
+// LinkVersion a target of a link, versions are numbered from 1
+type LinkVersion struct {
+	Version     int    `json:"version"`
+	OriginalURL string `json:"original_url"`
+	Current     bool   `json:"current,omitempty"`
+	// CreatedBy and CreatedAt who made it the target and when, nobody for the first version
+	CreatedBy string     `json:"created_by,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+// LinkHistoryResponse the targets of a link, newest first
+type LinkHistoryResponse struct {
+	CurrentVersion int           `json:"current_version"`
+	Versions       []LinkVersion `json:"versions"`
+}
+
+// RollbackRequest the version of the target to restore
+type RollbackRequest struct {
+	Version int `json:"version"`
+}
+
+// linkHistory reads a link and its previous targets from the storage read first,
+// from the other one during a migration if the link was not copied yet
+func linkHistory(ctx context.Context, domain, shortURL string, opts *config.Options) (store.Record, []store.Version, bool, error) {
+	stores := linkStores(opts)
+	if !opts.Migrating() {
+		stores = stores[:1]
+	}
+	for _, links := range stores {
+		record, ok, err := links.Get(ctx, domain, shortURL)
+		if err != nil {
+			return store.Record{}, nil, false, err
+		}
+		if ok {
+			versions, err := links.History(ctx, domain, shortURL)
+			return record, versions, err == nil, err
+		}
+	}
+	return store.Record{}, nil, false, nil
+}
+
+// newLinkHistory returns the targets of the link newest first, its current target is the version after the previous ones
+func newLinkHistory(record store.Record, versions []store.Version) LinkHistoryResponse {
+	current := len(versions) + 1
+	response := LinkHistoryResponse{CurrentVersion: current, Versions: make([]LinkVersion, 0, current)}
+	for n := current; n >= 1; n-- {
+		version := LinkVersion{Version: n, OriginalURL: record.OriginalURL, Current: n == current}
+		if n < current {
+			version.OriginalURL = versions[n-1].OriginalURL
+		}
+		// A version was created when the one before was replaced, the first one with the link
+		if n > 1 {
+			version.CreatedBy = versions[n-2].ChangedBy
+			version.CreatedAt = &versions[n-2].ChangedAt
+		} else if !record.CreatedAt.IsZero() {
+			version.CreatedAt = &record.CreatedAt
+		}
+		response.Versions = append(response.Versions, version)
+	}
+	return response
+}
+
+// LinkHistory returns the current and the previous targets of a link
+func LinkHistory(opts *config.Options) http.HandlerFunc {
+	return requireAdmin(opts, func(w http.ResponseWriter, r *http.Request) {
+		domain, shortURL, ok := adminLinkKey(w, r, opts)
+		if !ok {
+			return
+		}
+		record, versions, ok, err := linkHistory(r.Context(), domain, shortURL, opts)
+		if err != nil {
+			storeProblem(w, r, err)
+			return
+		}
+		if !ok {
+			problem(w, r, http.StatusNotFound, problems.CodeNotFound, errLinkNotFound.Error())
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, newLinkHistory(record, versions))
+	})
+}
+
+// RollbackLink makes a previous target of a link the current one again, as a new version
+func RollbackLink(opts *config.Options) http.HandlerFunc {
+	return requireAdmin(opts, func(w http.ResponseWriter, r *http.Request) {
+		domain, shortURL, ok := adminLinkKey(w, r, opts)
+		if !ok {
+			return
+		}
+		var request RollbackRequest
+		if p := decodeJSON(w, r, &request); p != nil {
+			problems.Write(w, r, p)
+			return
+		}
+		record, versions, ok, err := linkHistory(r.Context(), domain, shortURL, opts)
+		if err != nil {
+			storeProblem(w, r, err)
+			return
+		}
+		if !ok {
+			problem(w, r, http.StatusNotFound, problems.CodeNotFound, errLinkNotFound.Error())
+			return
+		}
+		if request.Version < 1 || request.Version > len(versions)+1 {
+			problem(w, r, http.StatusNotFound, problems.CodeNotFound, fmt.Sprintf("%s: %d", errVersionNotFound, request.Version))
+			return
+		}
+		// The current version stays as it is
+		if request.Version == len(versions)+1 {
+			writeAdminJSON(w, http.StatusOK, newAdminLink(record, opts))
+			return
+		}
+		// The rules may have changed since the version was the target
+		originalURL := versions[request.Version-1].OriginalURL
+		if err = checkDomain(originalURL); err != nil {
+			problem(w, r, http.StatusUnprocessableEntity, problems.CodeBlockedDomain, err.Error())
+			return
+		}
+
+		record, ok, err = updateLink(r.Context(), domain, shortURL, adminUser(r), func(record *store.Record) {
+			record.OriginalURL = originalURL
+		}, opts)
+		if err != nil {
+			storeProblem(w, r, err)
+			return
+		}
+		if !ok {
+			problem(w, r, http.StatusNotFound, problems.CodeNotFound, errLinkNotFound.Error())
+			return
+		}
+		log.Info().Str("link", store.Key(domain, shortURL)).Str("admin", adminUser(r)).Msgf("Link rolled back to version %d", request.Version)
+		writeAdminJSON(w, http.StatusOK, newAdminLink(record, opts))
+	})
+}
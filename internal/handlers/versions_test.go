@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"shortener/internal/config"
+	"shortener/internal/store"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestLinkVersions(t *testing.T) {
+	store.New()
+	opts := config.Options{BaseURL: "http://localhost:8080", FileStore: filepath.Join(t.TempDir(), "links.json"), AdminToken: "alice:a,bob:b,secret"}
+	store.Store.Save("abc", store.MapValues{Value: "https://example.com/v1", CreatedAt: store.Now()}, &opts)
+
+	edit := func(token, handler, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		h := UpdateLink(&opts)
+		if handler == "rollback" {
+			h = RollbackLink(&opts)
+		}
+		req := mux.SetURLVars(httptest.NewRequest("POST", "/api/admin/links/abc/"+handler, strings.NewReader(body)), map[string]string{"shortURL": "abc"})
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	history := func() LinkHistoryResponse {
+		t.Helper()
+		rr := adminRequest(LinkHistory(&opts), "GET", "/api/admin/links/abc/history", "", "abc")
+		var response LinkHistoryResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || rr.Code != http.StatusOK {
+			t.Fatalf("history returned %v %s", rr.Code, rr.Body.String())
+		}
+		return response
+	}
+	redirectTarget := func() string {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/abc", nil), map[string]string{"shortURL": "abc"})
+		rr := httptest.NewRecorder()
+		RedirectToURL(&opts).ServeHTTP(rr, req)
+		return rr.Header().Get("Location")
+	}
+
+	if rr := edit("a", "", `{"original_url": "https://example.com/v2"}`); rr.Code != http.StatusOK {
+		t.Fatalf("update returned %v %s", rr.Code, rr.Body.String())
+	}
+	// Disabling does not change the target, so it is no version
+	edit("b", "", `{"disabled": false}`)
+	edit("b", "", `{"original_url": "https://example.com/v3"}`)
+	if target := redirectTarget(); target != "https://example.com/v3" {
+		t.Errorf("redirect to %s", target)
+	}
+
+	response := history()
+	if response.CurrentVersion != 3 || len(response.Versions) != 3 {
+		t.Fatalf("history = %+v", response)
+	}
+	for i, want := range []struct{ url, by string }{{"https://example.com/v3", "bob"}, {"https://example.com/v2", "alice"}, {"https://example.com/v1", ""}} {
+		if v := response.Versions[i]; v.OriginalURL != want.url || v.CreatedBy != want.by || v.CreatedAt == nil || v.Current != (i == 0) {
+			t.Errorf("version %d = %+v", v.Version, v)
+		}
+	}
+
+	// A rollback is a new version with the old target
+	for _, version := range []string{`{"version": 0}`, `{"version": 4}`} {
+		if rr := edit("a", "rollback", version); rr.Code != http.StatusNotFound {
+			t.Errorf("rollback to %s returned %v", version, rr.Code)
+		}
+	}
+	if rr := edit("a", "rollback", `{"version": 1}`); rr.Code != http.StatusOK {
+		t.Fatalf("rollback returned %v %s", rr.Code, rr.Body.String())
+	}
+	if target := redirectTarget(); target != "https://example.com/v1" {
+		t.Errorf("redirect after rollback to %s", target)
+	}
+	if response = history(); response.CurrentVersion != 4 || response.Versions[0].CreatedBy != "alice" || response.Versions[1].OriginalURL != "https://example.com/v3" {
+		t.Errorf("history after rollback = %+v", response)
+	}
+
+	// The history is saved next to the file and goes with the link
+	store.New()
+	if err := store.Store.LoadHistory(store.HistoryPath(opts.FileStore)); err != nil {
+		t.Fatal(err)
+	}
+	if versions := store.Store.Versions("abc"); len(versions) != 3 || versions[2].ChangedBy != "alice" {
+		t.Errorf("loaded history = %+v", versions)
+	}
+	if err := store.Store.LoadFromFile(opts.FileStore); err != nil {
+		t.Fatal(err)
+	}
+	if rr := adminRequest(DeleteLink(&opts), "DELETE", "/api/admin/links/abc", "", "abc"); rr.Code != http.StatusNoContent {
+		t.Fatalf("delete returned %v", rr.Code)
+	}
+	if versions := store.Store.Versions("abc"); versions != nil {
+		t.Errorf("history of a deleted link = %+v", versions)
+	}
+}
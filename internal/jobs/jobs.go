@@ -0,0 +1,268 @@
+// Package jobs runs long batches in the background and keeps their progress and results
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Status of a job
+type Status string
+
+const (
+	StatusQueued  Status = "queued"
+	StatusRunning Status = "running"
+	StatusDone    Status = "done"
+	StatusFailed  Status = "failed"
+)
+
+var (
+	ErrNotFound  = errors.New("job does not exist")
+	ErrQueueFull = errors.New("too many jobs are queued")
+)
+
+// Job a batch processed in the background
+type Job struct {
+	ID     string `json:"id"`
+	Status Status `json:"status"`
+	// Host the batch was sent to
+	Host string `json:"host"`
+	// Items the batch, kept until the job is finished
+	Items json.RawMessage `json:"items,omitempty"`
+	// Processed number of items whose results are saved, a restarted job continues after them
+	Processed int       `json:"processed"`
+	Total     int       `json:"total"`
+	Created   int       `json:"created"`
+	Existing  int       `json:"existing"`
+	Invalid   int       `json:"invalid"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Finished reports whether the job is done or failed
+func (j *Job) Finished() bool {
+	return j.Status == StatusDone || j.Status == StatusFailed
+}
+
+// Processor processes a job from job.Processed on, calling save with the results of every step to persist the progress.
+// The context is done when the queue stops.
+type Processor func(ctx context.Context, job *Job, save func(results []json.RawMessage) error) error
+
+// Store persists jobs and their results, Load and Pending return copies the caller may change
+type Store interface {
+	Save(job *Job) error
+	// SaveResults saves the results of the items from start on, replacing any saved before, and the job counting them
+	SaveResults(job *Job, start int, results []json.RawMessage) error
+	Load(ctx context.Context, id string) (*Job, error)
+	// Results returns the results of the processed items in their order
+	Results(ctx context.Context, id string) ([]json.RawMessage, error)
+	// Pending returns the jobs that are not finished, oldest first
+	Pending() ([]*Job, error)
+	// Sweep deletes the jobs finished before the time with their results, returning how many
+	Sweep(before time.Time) (int, error)
+}
+
+// Maximum interval of the sweeps of finished jobs
+const sweepInterval = time.Hour
+
+// Queue runs jobs in a bounded pool of workers
+type Queue struct {
+	store   Store
+	process Processor
+	workers int
+	// retention how long finished jobs are kept, forever if 0
+	retention time.Duration
+	ids       chan string
+	running   atomic.Int32
+	wg        sync.WaitGroup
+}
+
+// NewQueue creates a queue of size jobs processed by the workers, finished jobs are deleted after retention
+func NewQueue(store Store, process Processor, workers, size int, retention time.Duration) *Queue {
+	if workers < 1 {
+		workers = 1
+	}
+	if size < 1 {
+		size = 1
+	}
+	return &Queue{store: store, process: process, workers: workers, retention: retention, ids: make(chan string, size)}
+}
+
+// Start starts the workers and requeues the jobs left unfinished by a previous run, until ctx is done
+func (q *Queue) Start(ctx context.Context) error {
+	pending, err := q.store.Pending()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.work(ctx)
+	}
+	if q.retention > 0 {
+		go q.sweep(ctx)
+	}
+	if len(pending) > 0 {
+		log.Info().Msgf("Resuming %d jobs", len(pending))
+		// The queue may be smaller than the jobs left
+		go func() {
+			for _, job := range pending {
+				select {
+				case q.ids <- job.ID:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// Wait waits for the workers to stop after the context of Start is done
+func (q *Queue) Wait() {
+	q.wg.Wait()
+}
+
+// Workers returns the number of workers started by Start
+func (q *Queue) Workers() int {
+	return q.workers
+}
+
+// Running returns the number of running workers
+func (q *Queue) Running() int {
+	return int(q.running.Load())
+}
+
+// Submit saves a new job for the items and queues it
+func (q *Queue) Submit(host string, items json.RawMessage, total int) (*Job, error) {
+	now := time.Now().UTC()
+	job := &Job{
+		ID:        uuid.NewString(),
+		Status:    StatusQueued,
+		Host:      host,
+		Items:     items,
+		Total:     total,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	// Check for room first, so a full queue does not leave a job nobody runs until a restart
+	if len(q.ids) == cap(q.ids) {
+		return nil, ErrQueueFull
+	}
+	if err := q.store.Save(job); err != nil {
+		return nil, err
+	}
+	select {
+	case q.ids <- job.ID:
+	default:
+		// Filled up meanwhile, the client is told to retry so the job must not run on the next start
+		job.Status = StatusFailed
+		job.Error = ErrQueueFull.Error()
+		job.Items = nil
+		if err := q.store.Save(job); err != nil {
+			log.Error().Err(err).Msgf("Failed to save job %s", job.ID)
+		}
+		return nil, ErrQueueFull
+	}
+	return job, nil
+}
+
+// Get returns the job
+func (q *Queue) Get(ctx context.Context, id string) (*Job, error) {
+	return q.store.Load(ctx, id)
+}
+
+// Results returns the results of the processed items of the job
+func (q *Queue) Results(ctx context.Context, id string) ([]json.RawMessage, error) {
+	return q.store.Results(ctx, id)
+}
+
+// sweep deletes the jobs finished longer than the retention ago, until ctx is done
+func (q *Queue) sweep(ctx context.Context) {
+	ticker := time.NewTicker(min(q.retention, sweepInterval))
+	defer ticker.Stop()
+	for {
+		n, err := q.store.Sweep(time.Now().Add(-q.retention))
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to delete finished jobs")
+		} else if n > 0 {
+			log.Info().Msgf("Deleted %d finished jobs", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *Queue) work(ctx context.Context) {
+	defer q.wg.Done()
+	q.running.Add(1)
+	defer q.running.Add(-1)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-q.ids:
+			q.run(ctx, id)
+		}
+	}
+}
+
+// run processes a job and saves its final state
+func (q *Queue) run(ctx context.Context, id string) {
+	job, err := q.store.Load(ctx, id)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to load job %s", id)
+		return
+	}
+	if job.Finished() {
+		return
+	}
+	job.Status = StatusRunning
+	save := func() error {
+		job.UpdatedAt = time.Now().UTC()
+		return q.store.Save(job)
+	}
+	if err = save(); err != nil {
+		log.Error().Err(err).Msgf("Failed to save job %s", id)
+		return
+	}
+
+	// Only the results of the step are written, with the job counting them
+	saveResults := func(results []json.RawMessage) error {
+		start := job.Processed
+		job.Processed += len(results)
+		job.UpdatedAt = time.Now().UTC()
+		if err := q.store.SaveResults(job, start, results); err != nil {
+			job.Processed = start
+			return err
+		}
+		return nil
+	}
+	err = q.process(ctx, job, saveResults)
+	if err != nil && ctx.Err() != nil {
+		// Stopped, not failed: the job stays pending and continues on the next start
+		log.Info().Msgf("Job %s interrupted after %d items", id, job.Processed)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Job %s failed", id)
+		job.Status = StatusFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = StatusDone
+	}
+	// The items are not needed anymore
+	job.Items = nil
+	if err = save(); err != nil {
+		log.Error().Err(err).Msgf("Failed to save job %s", id)
+	}
+}
@@ -0,0 +1,154 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestQueueResumesPendingJobs(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A job interrupted after its first item
+	interrupted := &Job{
+		ID:        "interrupted",
+		Status:    StatusRunning,
+		Items:     json.RawMessage(`["a","b","c"]`),
+		Processed: 1,
+		Total:     3,
+		CreatedAt: time.Now(),
+	}
+	if err = store.SaveResults(interrupted, 0, []json.RawMessage{json.RawMessage(`"A"`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Uppercases the items not processed yet
+	process := func(_ context.Context, job *Job, save func([]json.RawMessage) error) error {
+		var items []string
+		if err := json.Unmarshal(job.Items, &items); err != nil {
+			return err
+		}
+		for _, item := range items[job.Processed:] {
+			result, _ := json.Marshal(string(item[0] - 'a' + 'A'))
+			if err := save([]json.RawMessage{result}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	queue := NewQueue(store, process, 2, 1, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err = queue.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	submitted, err := queue.Submit("localhost", json.RawMessage(`["x"]`), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wait := func(id string) *Job {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			job, err := queue.Get(context.Background(), id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if job.Finished() {
+				return job
+			}
+		}
+		t.Fatalf("job %s did not finish", id)
+		return nil
+	}
+	job := wait("interrupted")
+	results, err := queue.Results(context.Background(), job.ID)
+	if job.Status != StatusDone || job.Processed != 3 || job.Items != nil || err != nil || len(results) != 3 || string(results[2]) != `"C"` {
+		t.Errorf("resumed job = %+v, results %s, %v", job, results, err)
+	}
+	job = wait(submitted.ID)
+	results, err = queue.Results(context.Background(), job.ID)
+	if job.Status != StatusDone || job.Processed != 1 || err != nil || len(results) != 1 || string(results[0]) != `"X"` {
+		t.Errorf("submitted job = %+v, results %s, %v", job, results, err)
+	}
+
+	pending, err := store.Pending()
+	if err != nil || len(pending) != 0 {
+		t.Errorf("Pending() = %v, %v", pending, err)
+	}
+	if _, err = queue.Get(context.Background(), "../interrupted"); err != ErrNotFound {
+		t.Errorf("Get() of a path = %v, want %v", err, ErrNotFound)
+	}
+
+	cancel()
+	queue.Wait()
+	if queue.Running() != 0 {
+		t.Errorf("Running() = %d after stop", queue.Running())
+	}
+}
+
+func TestStores(t *testing.T) {
+	fileStore, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]Store{"memory": NewMemoryStore(), "file": fileStore}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now().UTC()
+			job := &Job{ID: "job", Status: StatusRunning, Total: 4, CreatedAt: now, UpdatedAt: now}
+			save := func(start int, results ...string) {
+				t.Helper()
+				raw := make([]json.RawMessage, 0, len(results))
+				for _, result := range results {
+					raw = append(raw, json.RawMessage(result))
+				}
+				job.Processed = start + len(raw)
+				if err := store.SaveResults(job, start, raw); err != nil {
+					t.Fatal(err)
+				}
+			}
+			save(0, `"a"`, `"b"`)
+			save(2, `"c"`)
+			// A step written again after a restart replaces the one before
+			save(2, `"C"`, `"D"`)
+			results, err := store.Results(context.Background(), "job")
+			if err != nil || len(results) != 4 || string(results[0]) != `"a"` || string(results[3]) != `"D"` {
+				t.Fatalf("Results() = %s, %v", results, err)
+			}
+
+			// Finished jobs are deleted with their results once the retention is over
+			job.Status = StatusDone
+			if err = store.Save(job); err != nil {
+				t.Fatal(err)
+			}
+			running := &Job{ID: "running", Status: StatusRunning, CreatedAt: now, UpdatedAt: now}
+			if err = store.Save(running); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := store.Sweep(now); n != 0 || err != nil {
+				t.Errorf("Sweep() before the retention = %d, %v", n, err)
+			}
+			if n, err := store.Sweep(now.Add(time.Second)); n != 1 || err != nil {
+				t.Errorf("Sweep() = %d, %v", n, err)
+			}
+			if _, err = store.Load(context.Background(), "job"); err != ErrNotFound {
+				t.Errorf("Load() of a swept job = %v", err)
+			}
+			if _, err = store.Load(context.Background(), "running"); err != nil {
+				t.Errorf("Load() of a running job = %v", err)
+			}
+		})
+	}
+}
+
+func TestInsertResultsSQL(t *testing.T) {
+	if query := insertResultsSQL(2); query != `INSERT INTO job_results (job_id, position, data) VALUES ($1, $2, $3), ($4, $5, $6);` {
+		t.Errorf("insertResultsSQL(2) = %s", query)
+	}
+	if maxResultRows*3 > 65535 {
+		t.Errorf("%d results have more parameters than Postgres allows", maxResultRows)
+	}
+}
@@ -0,0 +1,496 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"shortener/internal/store"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clone copies a job through JSON, so stored jobs are not shared with workers
+func clone(job *Job) (*Job, error) {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+	var copied Job
+	err = json.Unmarshal(data, &copied)
+	return &copied, err
+}
+
+// sortPending keeps the unfinished jobs, oldest first
+func sortPending(all []*Job) []*Job {
+	pending := make([]*Job, 0, len(all))
+	for _, job := range all {
+		if !job.Finished() {
+			pending = append(pending, job)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].CreatedAt.Before(pending[j].CreatedAt) })
+	return pending
+}
+
+// expired reports whether the job finished before the time
+func expired(job *Job, before time.Time) bool {
+	return job.Finished() && job.UpdatedAt.Before(before)
+}
+
+// memoryStore keeps jobs until the server stops
+type memoryStore struct {
+	jobs sync.Map
+
+	mu      sync.Mutex
+	results map[string][]json.RawMessage
+}
+
+// NewMemoryStore creates a store losing the jobs on restart
+func NewMemoryStore() Store {
+	return &memoryStore{results: make(map[string][]json.RawMessage)}
+}
+
+func (s *memoryStore) Save(job *Job) error {
+	copied, err := clone(job)
+	if err != nil {
+		return err
+	}
+	s.jobs.Store(job.ID, copied)
+	return nil
+}
+
+func (s *memoryStore) SaveResults(job *Job, start int, results []json.RawMessage) error {
+	s.mu.Lock()
+	saved := s.results[job.ID]
+	s.results[job.ID] = append(saved[:min(start, len(saved))], results...)
+	s.mu.Unlock()
+	return s.Save(job)
+}
+
+func (s *memoryStore) Load(_ context.Context, id string) (*Job, error) {
+	job, ok := s.jobs.Load(id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return clone(job.(*Job))
+}
+
+func (s *memoryStore) Pending() ([]*Job, error) {
+	var all []*Job
+	var err error
+	s.jobs.Range(func(_, value any) bool {
+		var job *Job
+		job, err = clone(value.(*Job))
+		all = append(all, job)
+		return err == nil
+	})
+	return sortPending(all), err
+}
+
+func (s *memoryStore) Results(_ context.Context, id string) ([]json.RawMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]json.RawMessage(nil), s.results[id]...), nil
+}
+
+func (s *memoryStore) Sweep(before time.Time) (int, error) {
+	n := 0
+	s.jobs.Range(func(id, value any) bool {
+		if expired(value.(*Job), before) {
+			s.jobs.Delete(id)
+			s.mu.Lock()
+			delete(s.results, id.(string))
+			s.mu.Unlock()
+			n++
+		}
+		return true
+	})
+	return n, nil
+}
+
+// fileStore keeps every job in a JSON file of a directory,
+// the results of its steps in the files of a directory next to it named by the index of their first item
+type fileStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewFileStore creates a store of the jobs in dir, which is created if missing
+func NewFileStore(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+// path of the job file, IDs are checked as they come from requests
+func (s *fileStore) path(id string) (string, bool) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return "", false
+	}
+	return filepath.Join(s.dir, id+".json"), true
+}
+
+// resultsDir the directory of the results of the job file
+func resultsDir(path string) string {
+	return strings.TrimSuffix(path, ".json") + ".results"
+}
+
+func (s *fileStore) Save(job *Job) error {
+	path, ok := s.path(job.ID)
+	if !ok {
+		return ErrNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeJSON(path, job)
+}
+
+func (s *fileStore) SaveResults(job *Job, start int, results []json.RawMessage) error {
+	path, ok := s.path(job.ID)
+	if !ok {
+		return ErrNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dir := resultsDir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	// Results written before a crash are replaced, the job only counts them once it is saved
+	if err := writeJSON(filepath.Join(dir, strconv.Itoa(start)+".json"), results); err != nil {
+		return err
+	}
+	return writeJSON(path, job)
+}
+
+// writeJSON replaces the file at once, so a crash does not leave half of it
+func writeJSON(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *fileStore) Load(_ context.Context, id string) (*Job, error) {
+	path, ok := s.path(id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	s.mu.Lock()
+	data, err := os.ReadFile(path)
+	s.mu.Unlock()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	err = json.Unmarshal(data, &job)
+	return &job, err
+}
+
+func (s *fileStore) Results(ctx context.Context, id string) ([]json.RawMessage, error) {
+	job, err := s.Load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	path, _ := s.path(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := os.ReadDir(resultsDir(path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	starts := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		if start, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), ".json")); err == nil {
+			starts = append(starts, start)
+		}
+	}
+	sort.Ints(starts)
+
+	// Steps left by a run interrupted before the job was saved are skipped, they don't follow the counted ones
+	results := make([]json.RawMessage, 0, job.Processed)
+	for _, start := range starts {
+		if start != len(results) || len(results) >= job.Processed {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(resultsDir(path), strconv.Itoa(start)+".json"))
+		if err != nil {
+			return nil, err
+		}
+		var step []json.RawMessage
+		if err = json.Unmarshal(data, &step); err != nil {
+			return nil, fmt.Errorf("results of job %s: %w", id, err)
+		}
+		results = append(results, step...)
+	}
+	return results[:min(len(results), job.Processed)], nil
+}
+
+func (s *fileStore) Pending() ([]*Job, error) {
+	all, err := s.all()
+	return sortPending(all), err
+}
+
+func (s *fileStore) Sweep(before time.Time) (int, error) {
+	all, err := s.all()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, job := range all {
+		if !expired(job, before) {
+			continue
+		}
+		path, _ := s.path(job.ID)
+		s.mu.Lock()
+		err = os.RemoveAll(resultsDir(path))
+		if err == nil {
+			err = os.Remove(path)
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// all loads the jobs of the directory
+func (s *fileStore) all() ([]*Job, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var all []*Job
+	for _, path := range paths {
+		job, err := s.Load(context.Background(), strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			// One broken file should not keep the other jobs from running
+			log.Error().Err(err).Msgf("Failed to load job file %s", path)
+			continue
+		}
+		all = append(all, job)
+	}
+	return all, nil
+}
+
+// SQL statements to create the jobs table, the job is kept as JSON, and the table of their results
+var createJobsTablesSQL = []string{`
+		CREATE TABLE IF NOT EXISTS jobs (
+			id TEXT PRIMARY KEY,
+			status TEXT NOT NULL,
+			data TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL
+		);`, `
+		CREATE TABLE IF NOT EXISTS job_results (
+			job_id TEXT NOT NULL REFERENCES jobs (id) ON DELETE CASCADE,
+			position INTEGER NOT NULL,
+			data TEXT NOT NULL,
+			PRIMARY KEY (job_id, position)
+		);`,
+}
+
+// SQL statement to insert or replace a job
+const saveJobSQL = `
+		INSERT INTO jobs (id, status, data, created_at, updated_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (id) DO UPDATE SET status = EXCLUDED.status, data = EXCLUDED.data, updated_at = EXCLUDED.updated_at;`
+
+// SQL statement to select a job
+const selectJobSQL = `SELECT data FROM jobs WHERE id = $1;`
+
+// SQL statement to delete the results of a job from a position on
+const deleteJobResultsSQL = `DELETE FROM job_results WHERE job_id = $1 AND position >= $2;`
+
+// SQL statement to select the results of a job in their order
+const selectJobResultsSQL = `SELECT data FROM job_results WHERE job_id = $1 ORDER BY position;`
+
+// SQL statement to delete the jobs finished before a time, their results are deleted with them
+const sweepJobsSQL = `DELETE FROM jobs WHERE status IN ('done', 'failed') AND updated_at < $1;`
+
+// SQL statement to select the unfinished jobs
+const selectPendingJobsSQL = `SELECT data FROM jobs WHERE status IN ('queued', 'running') ORDER BY created_at;`
+
+// dbStore keeps jobs in the jobs table. Queries run through the breaker of the store within its query timeout,
+// the ones of the workers without a request context: a stopping worker still saves its job.
+type dbStore struct {
+	db *sql.DB
+}
+
+// NewDBStore creates a store of the jobs in the database, creating the tables if missing
+func NewDBStore(db *sql.DB) (Store, error) {
+	for _, query := range createJobsTablesSQL {
+		err := store.RunQuery(context.Background(), func(ctx context.Context) error {
+			_, err := db.ExecContext(ctx, query)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &dbStore{db: db}, nil
+}
+
+func (s *dbStore) Save(job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return store.RunQuery(context.Background(), func(ctx context.Context) error {
+		_, err := s.db.ExecContext(ctx, saveJobSQL, job.ID, job.Status, string(data), job.CreatedAt, job.UpdatedAt)
+		return err
+	})
+}
+
+func (s *dbStore) SaveResults(job *Job, start int, results []json.RawMessage) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	// The results from start on are replaced, so a repeated transaction writes the same
+	return store.RunQuery(context.Background(), func(ctx context.Context) error {
+		return s.saveResults(ctx, job, string(data), start, results)
+	})
+}
+
+// saveResults runs one attempt of SaveResults in a transaction
+func (s *dbStore) saveResults(ctx context.Context, job *Job, data string, start int, results []json.RawMessage) (err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	if _, err = tx.ExecContext(ctx, deleteJobResultsSQL, job.ID, start); err != nil {
+		return err
+	}
+	for first := 0; first < len(results); first += maxResultRows {
+		step := results[first:min(first+maxResultRows, len(results))]
+		args := make([]any, 0, len(step)*3)
+		for i, result := range step {
+			args = append(args, job.ID, start+first+i, string(result))
+		}
+		if _, err = tx.ExecContext(ctx, insertResultsSQL(len(step)), args...); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, saveJobSQL, job.ID, job.Status, data, job.CreatedAt, job.UpdatedAt)
+	return err
+}
+
+// Maximum number of results inserted by one statement, Postgres takes up to 65535 parameters
+const maxResultRows = 1000
+
+// insertResultsSQL returns the statement to insert n results of a job
+func insertResultsSQL(n int) string {
+	var b strings.Builder
+	b.WriteString(`INSERT INTO job_results (job_id, position, data) VALUES `)
+	for row := 0; row < n; row++ {
+		if row > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "($%d, $%d, $%d)", row*3+1, row*3+2, row*3+3)
+	}
+	b.WriteByte(';')
+	return b.String()
+}
+
+func (s *dbStore) Load(ctx context.Context, id string) (*Job, error) {
+	var data string
+	err := store.RunQuery(ctx, func(ctx context.Context) error {
+		return s.db.QueryRowContext(ctx, selectJobSQL, id).Scan(&data)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	err = json.Unmarshal([]byte(data), &job)
+	return &job, err
+}
+
+func (s *dbStore) Pending() ([]*Job, error) {
+	var pending []*Job
+	err := store.RunQuery(context.Background(), func(ctx context.Context) error {
+		pending = nil
+		return s.queryData(ctx, selectPendingJobsSQL, nil, func(data string) error {
+			var job Job
+			if err := json.Unmarshal([]byte(data), &job); err != nil {
+				return err
+			}
+			pending = append(pending, &job)
+			return nil
+		})
+	})
+	return pending, err
+}
+
+func (s *dbStore) Results(ctx context.Context, id string) ([]json.RawMessage, error) {
+	var results []json.RawMessage
+	err := store.RunQuery(ctx, func(ctx context.Context) error {
+		results = nil
+		return s.queryData(ctx, selectJobResultsSQL, []any{id}, func(data string) error {
+			results = append(results, json.RawMessage(data))
+			return nil
+		})
+	})
+	return results, err
+}
+
+// queryData calls fn with the data column of every row of the query
+func (s *dbStore) queryData(ctx context.Context, query string, args []any, fn func(data string) error) error {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data string
+		if err = rows.Scan(&data); err != nil {
+			return err
+		}
+		if err = fn(data); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *dbStore) Sweep(before time.Time) (int, error) {
+	var n int64
+	err := store.RunQuery(context.Background(), func(ctx context.Context) error {
+		result, err := s.db.ExecContext(ctx, sweepJobsSQL, before)
+		if err != nil {
+			return err
+		}
+		n, err = result.RowsAffected()
+		return err
+	})
+	return int(n), err
+}
@@ -3,20 +3,21 @@ package logger
 import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"os"
+	"io"
 )
 
-func SetupLog(debug bool) {
+// SetupLog настраивает логгер, out - куда писать логи
+func SetupLog(debug bool, out io.Writer) {
 	if debug {
 		// В дебаге выводим плоские строки
-		cw := zerolog.ConsoleWriter{Out: os.Stdout}
+		cw := zerolog.ConsoleWriter{Out: out}
 		log.Logger = zerolog.New(cw).With().Timestamp().Logger()
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 		return
 	}
 
-	// Иначе логируем в stdout в json'е
-	log.Logger = zerolog.New(os.Stdout).With().Logger()
+	// Иначе логируем в out в json'е
+	log.Logger = zerolog.New(out).With().Logger()
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 
 	zerolog.MessageFieldName = "m"
@@ -5,6 +5,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"io"
 	"net/http"
+	"shortener/internal/problems"
 	"strings"
 	"time"
 )
@@ -27,6 +28,11 @@ func (rw *responseWriter) Write(data []byte) (int, error) {
 	return size, err
 }
 
+// Unwrap lets http.ResponseController reach the flusher of the wrapped writer
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 // LoggingMiddleware is a middleware function that logs request details along with response status code, response size, and time taken.
 //
 // It takes a http.Handler as a parameter and returns a http.Handler.
@@ -54,7 +60,8 @@ func GzipAcceptMiddleware(next http.Handler) http.Handler {
 		if r.Header.Get("Content-Encoding") == "gzip" {
 			gzipReader, err := gzip.NewReader(r.Body)
 			if err != nil {
-				http.Error(w, "Error creating gzip reader", http.StatusInternalServerError)
+				// The client sent a body that is not gzip
+				problems.Write(w, r, problems.New(http.StatusBadRequest, problems.CodeInvalidBody, "request body is not valid gzip"))
 				return
 			}
 			defer gzipReader.Close()
@@ -77,6 +84,19 @@ func (w gzipResponseWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
+// Flush sends the data compressed so far, for streamed responses
+func (w gzipResponseWriter) Flush() {
+	if gz, ok := w.Writer.(*gzip.Writer); ok {
+		_ = gz.Flush()
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the wrapped writer
+func (w gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 // GzipMiddleware is a middleware that compresses the response if the client supports gzip encoding
 func GzipSendMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,42 @@
+package middlewares
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"shortener/internal/problems"
+	"strings"
+	"testing"
+)
+
+func TestGzipAcceptMiddleware(t *testing.T) {
+	echo := GzipAcceptMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, r.Body)
+	}))
+
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	_, _ = gz.Write([]byte("https://example.com"))
+	_ = gz.Close()
+	req := httptest.NewRequest("POST", "/", &body)
+	req.Header.Set("Content-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	echo.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "https://example.com" {
+		t.Errorf("gzip body returned %v %q", rr.Code, rr.Body.String())
+	}
+
+	// A body that is not gzip is the client's fault
+	req = httptest.NewRequest("POST", "/api/shorten", strings.NewReader("plain text"))
+	req.Header.Set("Content-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	echo.ServeHTTP(rr, req)
+	var p problems.Problem
+	if err := json.NewDecoder(rr.Body).Decode(&p); err != nil || rr.Code != http.StatusBadRequest ||
+		rr.Header().Get("Content-Type") != "application/problem+json" || p.Code != problems.CodeInvalidBody || p.Instance != "/api/shorten" {
+		t.Errorf("invalid gzip body returned %v %s %+v", rr.Code, rr.Header().Get("Content-Type"), p)
+	}
+}
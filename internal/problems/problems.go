@@ -0,0 +1,87 @@
+// Package problems writes RFC 7807 problem details, the error responses of the handlers and the middlewares
+package problems
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strings"
+)
+
+// Problem codes, clients can rely on them staying the same
+const (
+	CodeInvalidBody      = "invalid-body"
+	CodeInvalidRequest   = "invalid-request"
+	CodeInvalidParameter = "invalid-parameter"
+	CodeBlockedDomain    = "blocked-domain"
+	CodeNotFound         = "not-found"
+	CodeLinkExhausted    = "link-exhausted"
+	CodeLinkDisabled     = "link-disabled"
+	CodeWrongPassword    = "wrong-password"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeTooManyAttempts  = "too-many-attempts"
+	CodeTooLarge         = "too-large"
+	CodeMethodNotAllowed = "method-not-allowed"
+	CodeInternal         = "internal-error"
+	CodeUnavailable      = "unavailable"
+	CodeTimeout          = "timeout"
+	CodeJobNotFinished   = "job-not-finished"
+)
+
+// typePrefix the type URI of a problem is the prefix followed by its code
+const typePrefix = "urn:shortener:problem:"
+
+// Problem an RFC 7807 problem details response
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Code     string       `json:"code"`
+	Errors   []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError a problem with a field of the request body, the field is a JSON pointer
+type FieldError struct {
+	Field  string `json:"field"`
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+}
+
+// New creates a problem with the title of the status
+func New(status int, code, detail string, fieldErrors ...FieldError) *Problem {
+	return &Problem{
+		Type:   typePrefix + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+		Errors: fieldErrors,
+	}
+}
+
+// Error returns the detail and the field errors, so a problem can be returned as an error
+func (p *Problem) Error() string {
+	messages := make([]string, 0, len(p.Errors)+1)
+	if p.Detail != "" {
+		messages = append(messages, p.Detail)
+	}
+	for _, e := range p.Errors {
+		messages = append(messages, fmt.Sprintf("%s: %s", e.Field, e.Detail))
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Write writes the problem of the request as application/problem+json
+func Write(w http.ResponseWriter, r *http.Request, p *Problem) {
+	p.Instance = r.URL.RequestURI()
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		log.Error().Err(err).Msg("Error encoding problem")
+	}
+}
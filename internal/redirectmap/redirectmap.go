@@ -0,0 +1,192 @@
+// Package redirectmap parses redirect rules of other tools into mappings to shorten
+package redirectmap
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Input formats
+const (
+	FormatCSV    = "csv"    // original_url[,alias] rows, with an optional header
+	FormatNginx  = "nginx"  // Entries of an nginx map block: /alias https://target;
+	FormatApache = "apache" // Apache Redirect, RedirectPermanent and RedirectTemp directives
+)
+
+var (
+	ErrFormat  = errors.New("unknown format")
+	ErrSyntax  = errors.New("syntax error")
+	ErrPattern = errors.New("regular expressions are not supported")
+)
+
+// Mapping a redirect read from the input
+type Mapping struct {
+	Line        int
+	OriginalURL string
+	Alias       string // Empty to generate a short URL
+	Status      int    // Redirect status if the rule has one, 0 otherwise
+	Err         error  // Set if the line could not be parsed, the other lines are still read
+}
+
+// NewReader returns a function reading the next mapping, io.EOF when there are no more.
+// Other errors are returned only when the input can't be read any further.
+func NewReader(r io.Reader, format string) (func() (Mapping, error), error) {
+	switch format {
+	case FormatCSV:
+		return csvReader(r), nil
+	case FormatNginx:
+		return lineReader(r, parseNginx), nil
+	case FormatApache:
+		return lineReader(r, parseApache), nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrFormat, format)
+}
+
+func csvReader(r io.Reader) func() (Mapping, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	first := true
+	return func() (Mapping, error) {
+		for {
+			row, err := reader.Read()
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				return Mapping{Line: parseErr.Line, Err: fmt.Errorf("%w: %s", ErrSyntax, parseErr.Err)}, nil
+			}
+			if err != nil {
+				return Mapping{}, err
+			}
+			line, _ := reader.FieldPos(0)
+			// Skip the header
+			if first {
+				first = false
+				if strings.EqualFold(strings.TrimSpace(row[0]), "original_url") {
+					continue
+				}
+			}
+			m := Mapping{Line: line, OriginalURL: strings.TrimSpace(row[0])}
+			switch {
+			case len(row) > 2:
+				m.Err = fmt.Errorf("%w: expected original_url and an optional alias", ErrSyntax)
+			case len(row) == 2:
+				m.Alias = strings.TrimSpace(row[1])
+			}
+			return m, nil
+		}
+	}
+}
+
+// lineReader reads the input line by line, parse reports false for lines without a mapping
+func lineReader(r io.Reader, parse func(fields []string) (Mapping, bool)) func() (Mapping, error) {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	return func() (Mapping, error) {
+		for scanner.Scan() {
+			line++
+			text := scanner.Text()
+			if i := strings.IndexByte(text, '#'); i >= 0 {
+				text = text[:i]
+			}
+			fields := strings.Fields(text)
+			if len(fields) == 0 {
+				continue
+			}
+			m, ok := parse(fields)
+			if !ok {
+				continue
+			}
+			m.Line = line
+			return m, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return Mapping{}, err
+		}
+		return Mapping{}, io.EOF
+	}
+}
+
+// parseNginx parses a map entry, the map block itself and its parameters are skipped
+func parseNginx(fields []string) (Mapping, bool) {
+	last := fields[len(fields)-1]
+	switch {
+	case fields[0] == "map" || fields[0] == "}" || last == "{":
+		return Mapping{}, false
+	case fields[0] == "default" || fields[0] == "hostnames;" || fields[0] == "volatile;" || fields[0] == "include":
+		return Mapping{}, false
+	}
+
+	if !strings.HasSuffix(last, ";") {
+		return Mapping{Err: fmt.Errorf("%w: missing ;", ErrSyntax)}, true
+	}
+	fields[len(fields)-1] = strings.TrimSuffix(last, ";")
+	if fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
+	if len(fields) != 2 {
+		return Mapping{Err: fmt.Errorf("%w: expected a source and a target", ErrSyntax)}, true
+	}
+	if strings.HasPrefix(fields[0], "~") {
+		return Mapping{Err: ErrPattern}, true
+	}
+	return Mapping{Alias: pathAlias(unquote(fields[0])), OriginalURL: unquote(fields[1])}, true
+}
+
+// Redirect statuses of the Apache status keywords
+var apacheStatuses = map[string]int{
+	"permanent": http.StatusMovedPermanently,
+	"temp":      http.StatusFound,
+	"seeother":  http.StatusSeeOther,
+}
+
+// parseApache parses Redirect directives, other directives are skipped
+func parseApache(fields []string) (Mapping, bool) {
+	status := 0
+	switch strings.ToLower(fields[0]) {
+	case "redirect":
+		if len(fields) > 1 && strings.EqualFold(fields[1], "gone") {
+			return Mapping{Err: fmt.Errorf("%w: unsupported status gone", ErrSyntax)}, true
+		}
+		if len(fields) == 4 {
+			var ok bool
+			if status, ok = apacheStatuses[strings.ToLower(fields[1])]; !ok {
+				n, err := strconv.Atoi(fields[1])
+				if err != nil || n < 300 || n > 399 {
+					return Mapping{Err: fmt.Errorf("%w: unsupported status %s", ErrSyntax, fields[1])}, true
+				}
+				status = n
+			}
+			fields = append(fields[:1], fields[2:]...)
+		}
+	case "redirectpermanent":
+		status = http.StatusMovedPermanently
+	case "redirecttemp":
+		status = http.StatusFound
+	case "redirectmatch":
+		return Mapping{Err: ErrPattern}, true
+	default:
+		return Mapping{}, false
+	}
+	if len(fields) != 3 {
+		return Mapping{Err: fmt.Errorf("%w: expected a source path and a target URL", ErrSyntax)}, true
+	}
+	return Mapping{Alias: pathAlias(unquote(fields[1])), OriginalURL: unquote(fields[2]), Status: status}, true
+}
+
+// pathAlias returns the alias of a source path, keeping anything else for the validation to reject
+func pathAlias(source string) string {
+	return strings.TrimPrefix(source, "/")
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
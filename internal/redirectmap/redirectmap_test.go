@@ -0,0 +1,150 @@
+package redirectmap
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// mapping the expected fields of a Mapping, the error is compared with errors.Is
+type mapping struct {
+	line        int
+	originalURL string
+	alias       string
+	status      int
+	err         error
+}
+
+func readAll(t *testing.T, input, format string) []mapping {
+	t.Helper()
+	next, err := NewReader(strings.NewReader(input), format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mappings []mapping
+	for {
+		m, err := next()
+		if errors.Is(err, io.EOF) {
+			return mappings
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		mappings = append(mappings, mapping{m.Line, m.OriginalURL, m.Alias, m.Status, m.Err})
+	}
+}
+
+func checkMappings(t *testing.T, got, want []mapping) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d mappings %+v, want %d", len(got), got, len(want))
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.line != w.line || g.originalURL != w.originalURL || g.alias != w.alias || g.status != w.status || !errors.Is(g.err, w.err) {
+			t.Errorf("mapping %d = %+v, want %+v", i, g, w)
+		}
+	}
+}
+
+func TestCSV(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []mapping
+	}{
+		{
+			name:  "header and aliases",
+			input: "Original_URL, alias\nhttps://example.com/a, promo\nhttps://example.com/b\n",
+			want: []mapping{
+				{line: 2, originalURL: "https://example.com/a", alias: "promo"},
+				{line: 3, originalURL: "https://example.com/b"},
+			},
+		},
+		{
+			name:  "without header",
+			input: "https://example.com/a,a\n",
+			want:  []mapping{{line: 1, originalURL: "https://example.com/a", alias: "a"}},
+		},
+		{
+			name:  "quoted",
+			input: "\"https://example.com/?a=1,b=2\",\"x\"\"y\"\n",
+			want:  []mapping{{line: 1, originalURL: "https://example.com/?a=1,b=2", alias: `x"y`}},
+		},
+		{
+			name:  "too many fields",
+			input: "https://example.com,a,b\nhttps://example.com/c\n",
+			want: []mapping{
+				{line: 1, originalURL: "https://example.com", err: ErrSyntax},
+				{line: 2, originalURL: "https://example.com/c"},
+			},
+		},
+		{
+			name:  "bare quote",
+			input: "https://exa\"mple.com\n",
+			want:  []mapping{{line: 1, err: ErrSyntax}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkMappings(t, readAll(t, tt.input, FormatCSV), tt.want)
+		})
+	}
+}
+
+func TestNginx(t *testing.T) {
+	input := `# redirects
+map $uri $target {
+    default https://example.com;
+    hostnames;
+    include more.map;
+
+    /sale    https://example.com/sale;  # comment
+    "/quoted" 'https://example.com/q' ;
+    ~^/re    https://example.com/re;
+    /missing https://example.com/missing
+    /three   https://a.example https://b.example;
+}
+`
+	checkMappings(t, readAll(t, input, FormatNginx), []mapping{
+		{line: 7, originalURL: "https://example.com/sale", alias: "sale"},
+		{line: 8, originalURL: "https://example.com/q", alias: "quoted"},
+		{line: 9, err: ErrPattern},
+		{line: 10, err: ErrSyntax},
+		{line: 11, err: ErrSyntax},
+	})
+}
+
+func TestApache(t *testing.T) {
+	input := `RewriteEngine on
+Redirect /plain https://example.com/plain
+Redirect 308 /docs https://example.com/docs
+redirect permanent /old "https://example.com/new"
+Redirect seeother /form https://example.com/thanks
+RedirectPermanent /p https://example.com/p
+RedirectTemp /t https://example.com/t
+Redirect 200 /ok https://example.com
+Redirect gone /gone
+RedirectMatch ^/re https://example.com
+Redirect /short
+`
+	checkMappings(t, readAll(t, input, FormatApache), []mapping{
+		{line: 2, originalURL: "https://example.com/plain", alias: "plain"},
+		{line: 3, originalURL: "https://example.com/docs", alias: "docs", status: 308},
+		{line: 4, originalURL: "https://example.com/new", alias: "old", status: 301},
+		{line: 5, originalURL: "https://example.com/thanks", alias: "form", status: 303},
+		{line: 6, originalURL: "https://example.com/p", alias: "p", status: 301},
+		{line: 7, originalURL: "https://example.com/t", alias: "t", status: 302},
+		{line: 8, err: ErrSyntax},
+		{line: 9, err: ErrSyntax},
+		{line: 10, err: ErrPattern},
+		{line: 11, err: ErrSyntax},
+	})
+}
+
+func TestUnknownFormat(t *testing.T) {
+	if _, err := NewReader(strings.NewReader(""), "json"); !errors.Is(err, ErrFormat) {
+		t.Errorf("NewReader(json) error = %v", err)
+	}
+}
@@ -0,0 +1,410 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"shortener/internal/config"
+)
+
+// ConflictPolicy what to do when an imported link already exists
+type ConflictPolicy string
+
+const (
+	ConflictSkip      ConflictPolicy = "skip"
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	ConflictFail      ConflictPolicy = "fail"
+)
+
+var (
+	ErrNoBackend = errors.New("neither database nor file storage is configured")
+	ErrConflict  = errors.New("link already exists")
+)
+
+// ImportStats counters of an import
+type ImportStats struct {
+	Read        int `json:"read"`
+	Written     int `json:"written"`
+	Skipped     int `json:"skipped"`
+	Overwritten int `json:"overwritten"`
+	// Histories the links that got the previous targets imported with them
+	Histories int `json:"histories"`
+}
+
+// Backend a persistent storage of links
+type Backend interface {
+	// Each calls fn for every stored link, stopping at the first error
+	Each(ctx context.Context, fn func(Record) error) error
+	// Import stores the records returned by next until it returns io.EOF.
+	// The file and database backends store nothing if an error is returned, except for the database skipping
+	// conflicts: it commits in chunks, so an import of a running server's links can be resumed by running it again.
+	Import(ctx context.Context, next func() (Record, error), policy ConflictPolicy) (ImportStats, error)
+	// EachHistory calls fn for the previous targets of every link that has any, stopping at the first error
+	EachHistory(ctx context.Context, fn func(LinkHistory) error) error
+	// ImportHistory stores the histories returned by next until it returns io.EOF, skipping the links that
+	// already have one. Returns the number of links that got a history.
+	ImportHistory(ctx context.Context, next func() (LinkHistory, error)) (int, error)
+}
+
+// OpenBackend returns the backend selected by the options, the database taking priority over the file.
+// The database connection has to be opened in DB before.
+func OpenBackend(opts *config.Options) (Backend, error) {
+	if opts.ConnectionString != "" {
+		return NewDBBackend(DB), nil
+	}
+	if opts.FileStore != "" {
+		return NewFileBackend(opts.FileStore), nil
+	}
+	return nil, ErrNoBackend
+}
+
+// NewFileBackend returns the backend of a storage file, it must not be written by a running server
+func NewFileBackend(path string) Backend {
+	return &fileBackend{path: path}
+}
+
+// NewDBBackend returns the backend of the urls table
+func NewDBBackend(db *sql.DB) Backend {
+	return &dbBackend{db: db}
+}
+
+// NewMemoryBackend returns the backend of the in-memory store, imports are saved to the file if set
+func NewMemoryBackend(opts *config.Options) Backend {
+	return &memoryBackend{opts: opts}
+}
+
+// checkRecord checks the imported record has what is needed to store it
+func checkRecord(r *Record, n int) error {
+	if r.ShortURL == "" || r.OriginalURL == "" {
+		return fmt.Errorf("record %d: short_url and original_url are required", n)
+	}
+	if r.UUID == "" {
+		r.UUID = GenerateUUID()
+	}
+	return nil
+}
+
+// resolveConflict applies the policy to an imported record that already exists, reports whether to write it
+func resolveConflict(r Record, n int, policy ConflictPolicy, stats *ImportStats) (bool, error) {
+	switch policy {
+	case ConflictSkip:
+		stats.Skipped++
+		return false, nil
+	case ConflictOverwrite:
+		stats.Overwritten++
+		return true, nil
+	default:
+		return false, fmt.Errorf("record %d: %w: %s", n, ErrConflict, r.Key())
+	}
+}
+
+// fileBackend the JSON file of FILE_STORAGE_PATH
+type fileBackend struct {
+	path string
+}
+
+// Each streams the records of the file, a missing file has none
+func (b *fileBackend) Each(_ context.Context, fn func(Record) error) error {
+	file, err := os.Open(b.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	// The file may hold null if it was saved without links
+	token, err := decoder.Token()
+	if errors.Is(err, io.EOF) || token == nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("%s: expected a JSON array", b.path)
+	}
+	for decoder.More() {
+		var record Record
+		if err = decoder.Decode(&record); err != nil {
+			return err
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import merges the records into the file, which is replaced at once when all of them are read
+func (b *fileBackend) Import(ctx context.Context, next func() (Record, error), policy ConflictPolicy) (ImportStats, error) {
+	var stats ImportStats
+	var records []Record
+	index := make(map[string]int)
+	err := b.Each(ctx, func(r Record) error {
+		index[r.Key()] = len(records)
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	for {
+		record, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+		stats.Read++
+		if err = checkRecord(&record, stats.Read); err != nil {
+			return stats, err
+		}
+		i, exists := index[record.Key()]
+		if !exists {
+			index[record.Key()] = len(records)
+			records = append(records, record)
+			stats.Written++
+			continue
+		}
+		write, err := resolveConflict(record, stats.Read, policy, &stats)
+		if err != nil {
+			return stats, err
+		}
+		if write {
+			records[i] = record
+			stats.Written++
+		}
+	}
+
+	// Write a temporary file and rename it, so a failure leaves the old file intact
+	fileMu.Lock()
+	defer fileMu.Unlock()
+	tmp := filepath.Join(filepath.Dir(b.path), "."+filepath.Base(b.path)+".import")
+	if err = writeRecords(tmp, records); err != nil {
+		return stats, err
+	}
+	return stats, os.Rename(tmp, b.path)
+}
+
+// memoryBackend the in-memory store of a running server and its file
+type memoryBackend struct {
+	opts *config.Options
+}
+
+// Each calls fn for the links in no particular order
+func (b *memoryBackend) Each(_ context.Context, fn func(Record) error) error {
+	var err error
+	Store.URLs.Range(func(key, value interface{}) bool {
+		err = fn(NewRecord(key.(string), value.(MapValues)))
+		return err == nil
+	})
+	return err
+}
+
+// Import stores the records, the file is saved once at the end.
+// Records stored before an error are kept in memory.
+func (b *memoryBackend) Import(_ context.Context, next func() (Record, error), policy ConflictPolicy) (ImportStats, error) {
+	var stats ImportStats
+	for {
+		record, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+		stats.Read++
+		if err = checkRecord(&record, stats.Read); err != nil {
+			return stats, err
+		}
+		if _, loaded := Store.URLs.LoadOrStore(record.Key(), record.Values()); loaded {
+			write, err := resolveConflict(record, stats.Read, policy, &stats)
+			if err != nil {
+				return stats, err
+			}
+			if !write {
+				continue
+			}
+			Store.URLs.Store(record.Key(), record.Values())
+		}
+		Store.Index.Add(record.Key(), record.Values())
+		stats.Written++
+	}
+	if b.opts.FileStore == "" || stats.Written == 0 {
+		return stats, nil
+	}
+	return stats, Store.SaveToFile(b.opts.FileStore)
+}
+
+// SQL statements of the links of an export or import
+const (
+	existsSQL     = `SELECT EXISTS (SELECT 1 FROM urls WHERE domain = $1 AND short_url = $2);`
+	selectPageSQL = `
+		SELECT ` + recordColumns + ` FROM urls WHERE (domain, short_url) > ($1, $2)
+		ORDER BY domain, short_url LIMIT $3;`
+)
+
+// eachPageRows the number of rows read by a query of Each and EachHistory
+const eachPageRows = 1000
+
+// dbBackend the urls table of DATABASE_DSN
+type dbBackend struct {
+	db *sql.DB
+}
+
+// Each streams the rows of the table a page at a time, every page read with retries within the query timeout
+func (b *dbBackend) Each(ctx context.Context, fn func(Record) error) error {
+	var last Record
+	for {
+		var page []Record
+		err := dbCall(func() error {
+			return retryQuery(ctx, func(ctx context.Context) error {
+				page = page[:0]
+				rows, err := b.db.QueryContext(ctx, selectPageSQL, last.Domain, last.ShortURL, eachPageRows)
+				if err != nil {
+					return err
+				}
+				defer rows.Close()
+				for rows.Next() {
+					record, err := scanRecord(rows)
+					if err != nil {
+						return err
+					}
+					page = append(page, record)
+				}
+				return rows.Err()
+			})
+		})
+		if err != nil {
+			return err
+		}
+		for _, record := range page {
+			if err = fn(record); err != nil {
+				return err
+			}
+		}
+		if len(page) < eachPageRows {
+			return nil
+		}
+		last = page[len(page)-1]
+	}
+}
+
+// Import inserts the records in a single transaction, or in chunks when conflicts are skipped.
+// Every statement of the transaction runs within the query timeout.
+func (b *dbBackend) Import(ctx context.Context, next func() (Record, error), policy ConflictPolicy) (stats ImportStats, err error) {
+	if policy == ConflictSkip {
+		return b.importChunks(ctx, next)
+	}
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return stats, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	for {
+		var record Record
+		record, err = next()
+		if errors.Is(err, io.EOF) {
+			err = nil
+			return stats, nil
+		}
+		if err != nil {
+			return stats, err
+		}
+		stats.Read++
+		if err = checkRecord(&record, stats.Read); err != nil {
+			return stats, err
+		}
+		if err = importRecord(ctx, tx, record, policy, &stats); err != nil {
+			return stats, err
+		}
+	}
+}
+
+// importRecord inserts a record in the transaction of an import, resolving a conflict by the policy
+func importRecord(ctx context.Context, tx *sql.Tx, record Record, policy ConflictPolicy, stats *ImportStats) (err error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	defer func() { err = queryError(ctx, err) }()
+
+	var exists bool
+	if err = tx.QueryRowContext(ctx, existsSQL, record.Domain, record.ShortURL).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		var write bool
+		if write, err = resolveConflict(record, stats.Read, policy, stats); err != nil || !write {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, deleteSQL, record.Domain, record.ShortURL); err != nil {
+			return err
+		}
+	}
+	if _, err = tx.ExecContext(ctx, insertSQL, recordArgs(record)...); err != nil {
+		return err
+	}
+	stats.Written++
+	return nil
+}
+
+// importChunks inserts the records in transactions of maxInsertRows, skipping the links that exist.
+// A running server may save links meanwhile, they are skipped as well. Chunks are retried, importing again resumes.
+func (b *dbBackend) importChunks(ctx context.Context, next func() (Record, error)) (stats ImportStats, err error) {
+	chunk := make([]Record, 0, maxInsertRows)
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		var skipped []Record
+		err := dbCall(func() error {
+			return retryQuery(ctx, func(ctx context.Context) (err error) {
+				skipped, err = insertMissing(ctx, b.db, chunk)
+				return err
+			})
+		})
+		if err != nil {
+			return err
+		}
+		stats.Written += len(chunk) - len(skipped)
+		stats.Skipped += len(skipped)
+		chunk = chunk[:0]
+		return nil
+	}
+
+	for {
+		var record Record
+		record, err = next()
+		if errors.Is(err, io.EOF) {
+			return stats, flush()
+		}
+		if err != nil {
+			return stats, err
+		}
+		stats.Read++
+		if err = checkRecord(&record, stats.Read); err != nil {
+			return stats, err
+		}
+		if chunk = append(chunk, record); len(chunk) == maxInsertRows {
+			if err = flush(); err != nil {
+				return stats, err
+			}
+		}
+	}
+}
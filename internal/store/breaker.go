@@ -0,0 +1,120 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen the database is not called while it is considered down
+var ErrCircuitOpen = errors.New("database is unavailable")
+
+// States of a circuit breaker
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// Breaker a circuit breaker: it opens after threshold consecutive failures, and after the cooldown
+// lets a single call through to find out whether the database is back
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// DBBreaker guards the calls of the database
+var DBBreaker = NewBreaker(5, 10*time.Second)
+
+// NewBreaker creates a closed breaker
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &Breaker{threshold: threshold, cooldown: cooldown, state: BreakerClosed}
+}
+
+// Allow reports whether a call may go through, a half-open breaker allows one call at a time
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// Record counts the result of an allowed call. Only unavailability counts as a failure,
+// a call canceled by its client says nothing about the database.
+func (b *Breaker) Record(err error) {
+	if errors.Is(err, context.Canceled) {
+		b.mu.Lock()
+		b.probing = false
+		b.mu.Unlock()
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !Unavailable(err) {
+		if b.state != BreakerClosed {
+			log.Info().Msg("Database is available again")
+		}
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		if b.state == BreakerClosed {
+			log.Warn().Err(err).Msgf("Database failed %d times, degrading", b.failures)
+		}
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// State returns the state of the breaker
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// Unavailable reports whether the error means the database can't be used right now
+func Unavailable(err error) bool {
+	return errors.Is(err, ErrCircuitOpen) || errors.Is(err, context.DeadlineExceeded) || Retriable(err)
+}
+
+// dbCall runs a database call through the breaker
+func dbCall(call func() error) error {
+	if !DBBreaker.Allow() {
+		return ErrCircuitOpen
+	}
+	err := call()
+	DBBreaker.Record(err)
+	return err
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	down := syscall.ECONNREFUSED
+	b := NewBreaker(2, 20*time.Millisecond)
+
+	// Only consecutive unavailability opens the breaker
+	b.Record(down)
+	b.Record(errors.New("syntax error"))
+	b.Record(down)
+	b.Record(context.Canceled)
+	if b.State() != BreakerClosed || !b.Allow() {
+		t.Fatalf("breaker is %s after one failure", b.State())
+	}
+	b.Record(context.DeadlineExceeded)
+	if b.State() != BreakerOpen || b.Allow() {
+		t.Fatalf("breaker is %s after two failures", b.State())
+	}
+
+	// After the cooldown a single probe goes through, a failed one opens the breaker again
+	time.Sleep(30 * time.Millisecond)
+	if b.State() != BreakerHalfOpen || !b.Allow() || b.Allow() {
+		t.Fatalf("breaker is %s after the cooldown", b.State())
+	}
+	b.Record(down)
+	if b.State() != BreakerOpen {
+		t.Fatalf("breaker is %s after a failed probe", b.State())
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("breaker did not allow a probe")
+	}
+	b.Record(nil)
+	if b.State() != BreakerClosed || !b.Allow() || !b.Allow() {
+		t.Fatalf("breaker is %s after a successful probe", b.State())
+	}
+}
+
+func TestLinkCache(t *testing.T) {
+	c := NewLinkCache(2)
+	c.Put("a", MapValues{Value: "https://a.example"})
+	c.Put("b", MapValues{Value: "https://b.example"})
+	c.Get("a")
+	c.Put("c", MapValues{Value: "https://c.example"})
+	if _, ok := c.Get("b"); ok || c.Len() != 2 {
+		t.Errorf("least recently used link was kept, %d links", c.Len())
+	}
+	if values, ok := c.Get("a"); !ok || values.Value != "https://a.example" {
+		t.Errorf("Get(a) = %+v, %v", values, ok)
+	}
+
+	var disabled *LinkCache
+	disabled.Put("a", MapValues{})
+	if _, ok := disabled.Get("a"); ok {
+		t.Error("disabled cache returned a link")
+	}
+}
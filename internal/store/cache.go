@@ -0,0 +1,86 @@
+package store
+
+import (
+	"container/list"
+	"sync"
+)
+
+// LinkCache keeps the links last read from or written to the database, to serve redirects while it is down
+type LinkCache struct {
+	size int
+
+	mu    sync.Mutex
+	order *list.List
+	links map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key    string
+	values MapValues
+}
+
+// Cache the links of the database, disabled if nil
+var Cache *LinkCache
+
+// NewLinkCache creates a cache of the size links used last
+func NewLinkCache(size int) *LinkCache {
+	return &LinkCache{size: size, order: list.New(), links: make(map[string]*list.Element)}
+}
+
+// Get returns the cached link of the store key
+func (c *LinkCache) Get(key string) (MapValues, bool) {
+	if c == nil {
+		return MapValues{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.links[key]
+	if !ok {
+		return MapValues{}, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*cacheEntry).values, true
+}
+
+// Put caches the link of the store key, dropping the one used least recently if the cache is full
+func (c *LinkCache) Put(key string, values MapValues) {
+	if c == nil || c.size < 1 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.links[key]; ok {
+		element.Value.(*cacheEntry).values = values
+		c.order.MoveToFront(element)
+		return
+	}
+	c.links[key] = c.order.PushFront(&cacheEntry{key: key, values: values})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.links, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Delete drops the link of the store key
+func (c *LinkCache) Delete(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.links[key]; ok {
+		c.order.Remove(element)
+		delete(c.links, key)
+	}
+}
+
+// Len returns the number of cached links
+func (c *LinkCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
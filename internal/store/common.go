@@ -3,7 +3,9 @@ package store
 import (
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
+	"strings"
 	"sync"
+	"time"
 )
 
 var Store URLStore
@@ -11,12 +13,145 @@ var Store URLStore
 // URLStore a map to store the URLs
 type URLStore struct {
 	URLs *sync.Map
+	// History the previous targets of the links whose target was changed, []Version by URLs key
+	History *sync.Map
+	// Index the words of the titles and the URLs of the links
+	Index *SearchIndex
 }
 
 // MapValues a struct to represent values in ORLStore.URLs sync Map
 type MapValues struct {
 	Value string
 	UUID  string
+	// Domain the namespace of the link, empty for the main base URL
+	Domain   string
+	Redirect Redirect
+	// PasswordHash salted hash of the link password, empty if the link is not protected
+	PasswordHash string
+	// MaxClicks how many times the link can be followed, 0 means unlimited
+	MaxClicks int
+	// Clicks how many times the link was followed, only counted for limited links
+	Clicks  int
+	Forward Forward
+	// CreatedAt when the link was created, zero for links created before it was recorded
+	CreatedAt time.Time
+	// Disabled links are kept but not redirected
+	Disabled bool
+	// Title, Description and Tags describe the link, tags are joined with JoinTags so the values stay comparable
+	Title       string
+	Description string
+	Tags        string
+}
+
+// Forward per link forwarding of the incoming request to the target
+type Forward struct {
+	// Query merges the incoming query string into the target query
+	Query bool `json:"forward_query,omitempty"`
+	// Path appends the path after the short URL to the target path
+	Path bool `json:"forward_path,omitempty"`
+	UTM
+}
+
+// UTM parameters added to the target on every redirect
+type UTM struct {
+	Source   string `json:"utm_source,omitempty"`
+	Medium   string `json:"utm_medium,omitempty"`
+	Campaign string `json:"utm_campaign,omitempty"`
+	Term     string `json:"utm_term,omitempty"`
+	Content  string `json:"utm_content,omitempty"`
+}
+
+// Values returns the UTM parameters that are set by their query names
+func (u UTM) Values() map[string]string {
+	values := make(map[string]string)
+	for name, value := range map[string]string{
+		"utm_source":   u.Source,
+		"utm_medium":   u.Medium,
+		"utm_campaign": u.Campaign,
+		"utm_term":     u.Term,
+		"utm_content":  u.Content,
+	} {
+		if value != "" {
+			values[name] = value
+		}
+	}
+	return values
+}
+
+// Shareable reports whether the link can be returned to anyone shortening the same URL.
+// Protected, limited, forwarding and described links always belong to the one who created them, disabled links to nobody.
+func (v MapValues) Shareable() bool {
+	return v.PasswordHash == "" && v.MaxClicks == 0 && v.Forward == Forward{} && !v.Disabled &&
+		v.Title == "" && v.Description == "" && v.Tags == ""
+}
+
+// tagSeparator separates the tags of a link, tags can't contain it
+const tagSeparator = ","
+
+// JoinTags returns the tags as they are stored
+func JoinTags(tags []string) string {
+	return strings.Join(tags, tagSeparator)
+}
+
+// SplitTags returns the stored tags as a list
+func SplitTags(tags string) []string {
+	if tags == "" {
+		return nil
+	}
+	return strings.Split(tags, tagSeparator)
+}
+
+// HasTags reports whether the stored tags include every one of tags
+func HasTags(stored string, tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range SplitTags(stored) {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Exhausted reports whether a limited link has no clicks left
+func (v MapValues) Exhausted() bool {
+	return v.MaxClicks > 0 && v.Clicks >= v.MaxClicks
+}
+
+// Redirect per link redirect behavior, zero values mean the service defaults
+type Redirect struct {
+	Status         int    `json:"redirect_status,omitempty"`
+	CacheControl   string `json:"cache_control,omitempty"`
+	ReferrerPolicy string `json:"referrer_policy,omitempty"`
+	RobotsTag      string `json:"robots_tag,omitempty"`
+}
+
+// Key returns the URLStore.URLs key of a short URL in the domain namespace
+func Key(domain, shortURL string) string {
+	if domain == "" {
+		return shortURL
+	}
+	return domain + "/" + shortURL
+}
+
+// SplitKey returns the short URL of a URLStore.URLs key
+func SplitKey(key string) string {
+	return key[strings.LastIndex(key, "/")+1:]
+}
+
+// Now returns the creation time of a new link, in UTC and to the second so it compares equal after a round trip through any store
+func Now() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+// NameUUID returns the UUID derived from the name, the same for the same name
+func NameUUID(name string) string {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(name)).String()
 }
 
 func GenerateUUID() string {
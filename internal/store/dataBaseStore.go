@@ -1,20 +1,16 @@
 package store
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"github.com/rs/zerolog/log"
+	"time"
 )
 
 // DB a global variable to hold the database connection
 var DB *sql.DB
 
-// BatchValues a struct to hold the values for batch insert
-type BatchValues struct {
-	OriginalURL string `json:"original_url"`
-	ShortURL    string `json:"short_url"`
-	UUID        string `json:"uuid"`
-}
-
 // SQL statement to create the table
 const createTableSQL = `
 		CREATE TABLE IF NOT EXISTS urls (
@@ -23,14 +19,69 @@ const createTableSQL = `
 			original_url TEXT NOT NULL
 		);`
 
+// SQL statements to bring a table created by an older version up to date
+var migrateTableSQL = []string{
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS redirect_status INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS cache_control TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS referrer_policy TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS robots_tag TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS password_hash TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS max_clicks INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS clicks INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS forward_query BOOLEAN NOT NULL DEFAULT FALSE;`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS forward_path BOOLEAN NOT NULL DEFAULT FALSE;`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS utm_source TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS utm_medium TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS utm_campaign TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS utm_term TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS utm_content TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS domain TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ;`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT FALSE;`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS title TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS tags TEXT NOT NULL DEFAULT '';`,
+	// The words of the title and the URL, split like Words splits them for the in-memory index
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS search TSVECTOR GENERATED ALWAYS AS
+		(to_tsvector('simple'::regconfig, regexp_replace(lower(title || ' ' || original_url), '[^[:alnum:]]+', ' ', 'g'))) STORED;`,
+	`CREATE INDEX IF NOT EXISTS urls_search_idx ON urls USING GIN (search);`,
+	`CREATE INDEX IF NOT EXISTS urls_tags_idx ON urls USING GIN (string_to_array(tags, ','));`,
+	// A short URL is a single link of its domain, this also indexes the lookups of redirects.
+	// Fails on a table that already has duplicates, they have to be resolved by hand.
+	`CREATE UNIQUE INDEX IF NOT EXISTS urls_domain_short_url_idx ON urls (domain, short_url);`,
+}
+
+// Number of columns of a link
+const recordFields = 23
+
+// Columns of a link in the order of scanRecord and recordArgs
+const recordColumns = `uuid, short_url, original_url, domain, redirect_status, cache_control, referrer_policy, robots_tag,
+			password_hash, max_clicks, clicks, forward_query, forward_path, utm_source, utm_medium, utm_campaign, utm_term, utm_content,
+			created_at, disabled, title, description, tags`
+
 // SQL statement to insert into the table
-const insertSQL = `INSERT INTO urls (uuid, short_url, original_url) VALUES ($1, $2, $3);`
+const insertSQL = `
+		INSERT INTO urls (` + recordColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23);`
 
 // SQL statement to delete from the table
-const deleteSQL = `DELETE FROM urls WHERE short_url = $1;`
+const deleteSQL = `DELETE FROM urls WHERE domain = $1 AND short_url = $2;`
 
 // SQL statement to select from the table
-const selectSQL = `SELECT original_url FROM urls WHERE short_url = $1;`
+const selectSQL = `SELECT ` + recordColumns + ` FROM urls WHERE domain = $1 AND short_url = $2;`
+
+// SQL statement to find a link that can be shared by its original URL
+const selectShareableSQL = `
+		SELECT short_url FROM urls
+		WHERE domain = $1 AND original_url = $2 AND password_hash = '' AND max_clicks = 0 AND NOT forward_query AND NOT forward_path AND NOT disabled
+			AND title = '' AND description = '' AND tags = ''
+			AND utm_source || utm_medium || utm_campaign || utm_term || utm_content = '';`
+
+// SQL statement to count a click of a limited link, no rows means the link has no clicks left
+const consumeClickSQL = `
+		UPDATE urls SET clicks = clicks + 1
+		WHERE domain = $1 AND short_url = $2 AND (max_clicks = 0 OR clicks < max_clicks)
+		RETURNING clicks;`
 
 // NewDBStore creates a new store
 func InitDB(db *sql.DB) error {
@@ -38,73 +89,272 @@ func InitDB(db *sql.DB) error {
 	if err != nil {
 		return err
 	}
+	for _, migration := range migrateTableSQL {
+		_, err = db.Exec(migration)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err = db.Exec(createVersionsTableSQL); err != nil {
+		return err
+	}
 
 	log.Info().Msg("Table 'urls' created successfully")
-	return nil
+	return prepareStatements(db)
 }
 
-// SaveToDB saves a URL to the database
-func SaveToDB(shortURL, originalURL, uuid string) {
-	if uuid == "" {
-		uuid = GenerateUUID()
+// rowScanner is implemented by sql.Row and sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanRecord reads a link selected with recordColumns
+func scanRecord(row rowScanner) (Record, error) {
+	var r Record
+	var uuid sql.NullString
+	var createdAt sql.NullTime
+	err := row.Scan(&uuid, &r.ShortURL, &r.OriginalURL, &r.Domain, &r.Redirect.Status, &r.Redirect.CacheControl,
+		&r.Redirect.ReferrerPolicy, &r.Redirect.RobotsTag, &r.PasswordHash, &r.MaxClicks, &r.Clicks, &r.Forward.Query,
+		&r.Forward.Path, &r.Forward.Source, &r.Forward.Medium, &r.Forward.Campaign, &r.Forward.Term, &r.Forward.Content,
+		&createdAt, &r.Disabled, &r.Title, &r.Description, &r.Tags)
+	r.UUID = uuid.String
+	if createdAt.Valid {
+		r.CreatedAt = createdAt.Time.UTC()
 	}
-	_, err := DB.Exec(insertSQL, uuid, shortURL, originalURL)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to save URL")
+	return r, err
+}
+
+// recordArgs returns the arguments to insert a link with recordColumns
+func recordArgs(r Record) []any {
+	return []any{r.UUID, r.ShortURL, r.OriginalURL, r.Domain, r.Redirect.Status, r.Redirect.CacheControl,
+		r.Redirect.ReferrerPolicy, r.Redirect.RobotsTag, r.PasswordHash, r.MaxClicks, r.Clicks, r.Forward.Query,
+		r.Forward.Path, r.Forward.Source, r.Forward.Medium, r.Forward.Campaign, r.Forward.Term, r.Forward.Content,
+		sql.NullTime{Time: r.CreatedAt, Valid: !r.CreatedAt.IsZero()}, r.Disabled,
+		r.Title, r.Description, r.Tags}
+}
+
+// QueryTimeout limits every query of a request, no limit if 0
+var QueryTimeout time.Duration
+
+// queryContext derives the context of a query from the one of the request
+func queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if QueryTimeout > 0 {
+		return context.WithTimeout(ctx, QueryTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// queryError returns the context error if the query was canceled or timed out, the driver reports those its own way
+func queryError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
 	}
+	return err
+}
+
+// PingDB checks the database connection within the query timeout
+func PingDB(ctx context.Context) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	return queryError(ctx, DB.PingContext(ctx))
+}
+
+// SaveToDB saves a URL to the database, it is not retried as the insert may have been applied.
+// While the database is down the URL is saved to the journal if there is one, unless the insert timed out.
+func SaveToDB(ctx context.Context, shortURL string, values MapValues) error {
+	if values.UUID == "" {
+		values.UUID = GenerateUUID()
+	}
+	record := NewRecord(Key(values.Domain, shortURL), values)
+	err := dbCall(func() error {
+		ctx, cancel := queryContext(ctx)
+		defer cancel()
+		_, err := DB.ExecContext(ctx, insertSQL, recordArgs(record)...)
+		return queryError(ctx, err)
+	})
+	if journaling(err) {
+		err = DBJournal.Append(record)
+	}
+	if err == nil {
+		Cache.Put(record.Key(), values)
+	}
+	return err
+}
+
+// Buffering reports whether the database failed and writes go to the journal instead
+func Buffering(err error) bool {
+	return DBJournal != nil && Unavailable(err)
+}
+
+// journaling reports whether a failed write goes to the journal. A write that hit the deadline may have been applied,
+// it fails instead of being journaled.
+func journaling(err error) bool {
+	return Buffering(err) && !errors.Is(err, context.DeadlineExceeded)
 }
 
 // CheckIfExistsInDB проверяет наличие записи в базе данных по shortURL
 // true - если есть, false - если нет
-func CheckIfExistsInDB(longURL string) (string, bool) {
+// Учитываются только ссылки, которые можно отдать другим пользователям (см. MapValues.Shareable)
+func CheckIfExistsInDB(ctx context.Context, domain, longURL string) (string, bool, error) {
 	var existingURL string
-	err := DB.QueryRow("SELECT short_url FROM urls WHERE original_url = $1", longURL).Scan(&existingURL)
+	err := dbCall(func() error {
+		return retryQuery(ctx, func(ctx context.Context) error {
+			return queryRow(ctx, selectShareableStmt, selectShareableSQL, domain, longURL).Scan(&existingURL)
+		})
+	})
+	// While the database is down a new link is created, sharing can't be checked
+	if errors.Is(err, sql.ErrNoRows) || Buffering(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return existingURL, true, nil
+}
+
+// ReadFromDB reads a URL of the domain from the database, or from the cache while the database is down
+func ReadFromDB(ctx context.Context, domain, shortURL string) (values MapValues, ok bool, err error) {
+	var record Record
+	err = dbCall(func() error {
+		return retryQuery(ctx, func(ctx context.Context) (err error) {
+			record, err = scanRecord(queryRow(ctx, selectStmt, selectSQL, domain, shortURL))
+			return err
+		})
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return MapValues{}, false, nil
+	}
+	if Unavailable(err) {
+		if values, ok = Cache.Get(Key(domain, shortURL)); ok {
+			return values, true, nil
+		}
+	}
 	if err != nil {
-		return "", false
+		return MapValues{}, false, err
 	}
-	return existingURL, true
+	values = record.Values()
+	Cache.Put(Key(domain, shortURL), values)
+	return values, true, nil
 }
 
-// ReadFromDB reads a URL from the database
-func ReadFromDB(shortURL string) (originalURL string, ok bool) {
-	err := DB.QueryRow(selectSQL, shortURL).Scan(&originalURL)
+// ConsumeClickInDB counts a click of a limited link in a single statement, so concurrent redirects can't overspend it
+// Returns false if the link does not exist or has no clicks left. It is not retried, a click must not count twice.
+func ConsumeClickInDB(ctx context.Context, domain, shortURL string) (bool, error) {
+	var clicks int
+	err := dbCall(func() error {
+		ctx, cancel := queryContext(ctx)
+		defer cancel()
+		return queryError(ctx, DB.QueryRowContext(ctx, consumeClickSQL, domain, shortURL).Scan(&clicks))
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to read URL")
-		return "", false
+		return false, err
 	}
-	return originalURL, true
+	return true, nil
 }
 
-// BatchSave saves a batch of URLs to the database
-func BatchSave(BatchURLs []BatchValues) {
-	tx, err := DB.Begin()
+// BatchSave saves a batch of URLs to the database in a single transaction with multi-row inserts,
+// the timeout applies to every attempt of the whole batch. A transaction failing before the commit is retried.
+// While the database is down the URLs are saved to the journal if there is one, unless the batch timed out.
+func BatchSave(ctx context.Context, BatchURLs []Record) error {
+	err := dbCall(func() error {
+		return retryQuery(ctx, func(ctx context.Context) error {
+			return batchSave(ctx, BatchURLs)
+		})
+	})
+	if journaling(err) {
+		err = DBJournal.Append(BatchURLs...)
+	}
+	if err == nil {
+		for _, record := range BatchURLs {
+			Cache.Put(record.Key(), record.Values())
+		}
+	}
+	return err
+}
+
+// batchSave runs one attempt of BatchSave
+func batchSave(ctx context.Context, BatchURLs []Record) (err error) {
+	tx, err := DB.BeginTx(ctx, nil)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to begin transaction")
-		return
+		return err
 	}
 	defer func() {
 		if err != nil {
-			tx.Rollback()
+			_ = tx.Rollback()
 			return
 		}
-		err = tx.Commit()
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to commit transaction")
+		if err = tx.Commit(); err != nil {
+			// The commit may have been applied, retrying could save the links twice
+			err = finalError{err}
 		}
 	}()
 
-	stmt, err := tx.Prepare(insertSQL)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to prepare statement")
-		return
+	for start := 0; start < len(BatchURLs); start += maxInsertRows {
+		rows := BatchURLs[start:min(start+maxInsertRows, len(BatchURLs))]
+		args := make([]any, 0, len(rows)*recordFields)
+		for _, v := range rows {
+			args = append(args, recordArgs(v)...)
+		}
+		_, err = tx.ExecContext(ctx, insertRowsSQL(len(rows)), args...)
+		if err != nil {
+			return err
+		}
 	}
-	defer stmt.Close()
+	return nil
+}
 
-	for _, v := range BatchURLs {
-		_, err = stmt.Exec(v.UUID, v.ShortURL, v.OriginalURL)
+// insertMissing saves links in a single transaction, links whose short URL is taken are skipped.
+// Saving the same links again does nothing, so it is safe to retry. Returns the skipped links.
+func insertMissing(ctx context.Context, db *sql.DB, records []Record) (skipped []Record, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to insert batch values")
+			_ = tx.Rollback()
 			return
 		}
+		err = tx.Commit()
+	}()
+
+	inserted := make(map[string]bool, len(records))
+	for start := 0; start < len(records); start += maxInsertRows {
+		rows := records[start:min(start+maxInsertRows, len(records))]
+		args := make([]any, 0, len(rows)*recordFields)
+		for _, v := range rows {
+			args = append(args, recordArgs(v)...)
+		}
+		if err = scanKeys(ctx, tx, insertMissingRowsSQL(len(rows)), args, inserted); err != nil {
+			return nil, err
+		}
+	}
+	for _, record := range records {
+		if !inserted[record.Key()] {
+			skipped = append(skipped, record)
+		}
+		// A link journaled twice is inserted once
+		delete(inserted, record.Key())
+	}
+	return skipped, nil
+}
+
+// scanKeys runs a statement returning the domain and short URL of rows, their keys are added to keys
+func scanKeys(ctx context.Context, tx *sql.Tx, query string, args []any, keys map[string]bool) error {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var domain, shortURL string
+		if err = rows.Scan(&domain, &shortURL); err != nil {
+			return err
+		}
+		keys[Key(domain, shortURL)] = true
 	}
+	return rows.Err()
 }
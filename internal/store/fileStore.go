@@ -2,38 +2,100 @@ package store
 
 import (
 	"encoding/json"
+	"errors"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
-type fileStore struct {
+// fileMu serializes writes of the storage file, so concurrent saves don't interleave
+var fileMu sync.Mutex
+
+// Record a link as it is saved to the file, exported and imported
+type Record struct {
 	UUID        string `json:"uuid"`
 	ShortURL    string `json:"short_url"`
 	OriginalURL string `json:"original_url"`
+	Domain      string `json:"domain,omitempty"`
+	Redirect
+	PasswordHash string `json:"password_hash,omitempty"`
+	MaxClicks    int    `json:"max_clicks,omitempty"`
+	Clicks       int    `json:"clicks,omitempty"`
+	Forward
+	CreatedAt   time.Time `json:"created_at"`
+	Disabled    bool      `json:"disabled,omitempty"`
+	Title       string    `json:"title,omitempty"`
+	Description string    `json:"description,omitempty"`
+	// Tags joined with JoinTags
+	Tags string `json:"tags,omitempty"`
+}
+
+// NewRecord creates a record of the link stored under the URLStore.URLs key
+func NewRecord(key string, mapValues MapValues) Record {
+	return Record{
+		UUID:         mapValues.UUID,
+		ShortURL:     SplitKey(key),
+		OriginalURL:  mapValues.Value,
+		Domain:       mapValues.Domain,
+		Redirect:     mapValues.Redirect,
+		PasswordHash: mapValues.PasswordHash,
+		MaxClicks:    mapValues.MaxClicks,
+		Clicks:       mapValues.Clicks,
+		Forward:      mapValues.Forward,
+		CreatedAt:    mapValues.CreatedAt,
+		Disabled:     mapValues.Disabled,
+		Title:        mapValues.Title,
+		Description:  mapValues.Description,
+		Tags:         mapValues.Tags,
+	}
+}
+
+// Key returns the URLStore.URLs key of the record
+func (r Record) Key() string {
+	return Key(r.Domain, r.ShortURL)
+}
+
+// Values returns the record as it is kept in URLStore.URLs
+func (r Record) Values() MapValues {
+	return MapValues{
+		Value:        r.OriginalURL,
+		UUID:         r.UUID,
+		Domain:       r.Domain,
+		Redirect:     r.Redirect,
+		PasswordHash: r.PasswordHash,
+		MaxClicks:    r.MaxClicks,
+		Clicks:       r.Clicks,
+		Forward:      r.Forward,
+		CreatedAt:    r.CreatedAt,
+		Disabled:     r.Disabled,
+		Title:        r.Title,
+		Description:  r.Description,
+		Tags:         r.Tags,
+	}
 }
 
 // SaveToFile saves the short URL to a file
 func (s *URLStore) SaveToFile(filePath string) error {
-	// Create a slice of fileStore structs to store the URLs
-	var fileStores []fileStore
+	// Create a slice of records to store the URLs
+	var records []Record
+
+	// Take the snapshot under the lock, so the last write has the latest state
+	fileMu.Lock()
+	defer fileMu.Unlock()
 
 	// Iterate over the URLs in the URLStore
 	s.URLs.Range(func(key, value interface{}) bool {
-		// Convert the value to MapValues
-		mapValues := value.(MapValues)
-
-		// Create a fileStore struct with the necessary information
-		fileStore := fileStore{
-			UUID:        mapValues.UUID,
-			ShortURL:    key.(string),
-			OriginalURL: mapValues.Value,
-		}
-
-		// Append the fileStore struct to the slice
-		fileStores = append(fileStores, fileStore)
-
+		// Append the record to the slice
+		records = append(records, NewRecord(key.(string), value.(MapValues)))
 		return true
 	})
 
+	return writeRecords(filePath, records)
+}
+
+// writeRecords writes the records to the file as a JSON array
+func writeRecords(filePath string, records []Record) error {
 	// Create a file
 	file, err := os.Create(filePath)
 	if err != nil {
@@ -41,10 +103,10 @@ func (s *URLStore) SaveToFile(filePath string) error {
 	}
 	defer file.Close()
 
-	// Encode the fileStores slice as JSON and write it to the file
+	// Encode the records slice as JSON and write it to the file
 	encoder := json.NewEncoder(file)
 	encoder.SetIndent("", "  ")
-	err = encoder.Encode(fileStores)
+	err = encoder.Encode(records)
 	if err != nil {
 		return err
 	}
@@ -52,6 +114,23 @@ func (s *URLStore) SaveToFile(filePath string) error {
 	return nil
 }
 
+// CheckFile checks the file can be written without changing it, or created if it does not exist yet
+func CheckFile(filePath string) error {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND, 0)
+	if err == nil {
+		return file.Close()
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	file, err = os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".check")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
 // LoadFromFile loads the short URLs from a file
 func (s *URLStore) LoadFromFile(filePath string) error {
 	// Open the file
@@ -61,20 +140,17 @@ func (s *URLStore) LoadFromFile(filePath string) error {
 	}
 	defer file.Close()
 
-	// Decode the file contents as JSON into a slice of fileStore structs
-	var fileStores []fileStore
-	err = json.NewDecoder(file).Decode(&fileStores)
+	// Decode the file contents as JSON into a slice of records
+	var records []Record
+	err = json.NewDecoder(file).Decode(&records)
 	if err != nil {
 		return err
 	}
 
-	// Iterate over the fileStores slice and add the URLs to the URLStore
-	for _, fileStore := range fileStores {
-		mapValues := MapValues{
-			Value: fileStore.OriginalURL,
-			UUID:  fileStore.UUID,
-		}
-		s.URLs.Store(fileStore.ShortURL, mapValues)
+	// Iterate over the records slice and add the URLs to the URLStore
+	for _, record := range records {
+		s.URLs.Store(record.Key(), record.Values())
+		s.Index.Add(record.Key(), record.Values())
 	}
 
 	return nil
@@ -7,17 +7,20 @@ import (
 )
 
 // ValueExistsInMap Function to check if a value exists in a sync.Map
-func (s *URLStore) ValueExistsInMap(searchValue string) (string, bool) {
+// Only links of the domain are searched, and links that are not shareable are skipped
+// Returns the short URL without the domain
+func (s *URLStore) ValueExistsInMap(domain, searchValue string) (string, bool) {
 	var key string
 	var ok bool
 	found := false
 
 	s.URLs.Range(func(k, value interface{}) bool {
-		if value == searchValue {
+		if values := value.(MapValues); values.Value == searchValue && values.Domain == domain && values.Shareable() {
 			key, ok = k.(string)
 			if !ok {
 				log.Error().Msg("Failed to convert key to string")
 			}
+			key = SplitKey(key)
 			found = true
 			return false // Stop iterating
 		}
@@ -28,27 +31,19 @@ func (s *URLStore) ValueExistsInMap(searchValue string) (string, bool) {
 }
 
 func New() {
-	Store = URLStore{URLs: &sync.Map{}}
+	Store = URLStore{URLs: &sync.Map{}, History: &sync.Map{}, Index: NewSearchIndex()}
 }
 
 // Time savers
 
 // Save Function to store the URL
-func (s *URLStore) Save(key, value, uuid string, options *config.Options) {
-	var values MapValues
-	if uuid != "" {
-		values = MapValues{
-			Value: value,
-			UUID:  uuid,
-		}
-	}
+func (s *URLStore) Save(key string, values MapValues, options *config.Options) {
+	uuid := values.UUID
 	if uuid == "" { // Generate uuid if uuid is not set
-		values = MapValues{
-			Value: value,
-			UUID:  GenerateUUID(),
-		}
+		values.UUID = GenerateUUID()
 	}
 	s.URLs.Store(key, values)
+	s.Index.Add(key, values)
 	// Save to file if FileStore is set, and if UUID is not set (uuid set means it was already saved to file)
 	if options.FileStore != "" && uuid == "" {
 		err := s.SaveToFile(options.FileStore)
@@ -65,12 +60,43 @@ func (s *URLStore) Save(key, value, uuid string, options *config.Options) {
 // Find Function to find the URL
 func (s *URLStore) Find(key string) (MapValues, bool) {
 	value, ok := s.URLs.Load(key)
-	return value.(MapValues), ok
+	if !ok {
+		return MapValues{}, false
+	}
+	return value.(MapValues), true
+}
+
+// ConsumeClick Function to count a click of a limited link
+// Returns false if the link does not exist or has no clicks left
+func (s *URLStore) ConsumeClick(key string, options *config.Options) bool {
+	for {
+		value, ok := s.URLs.Load(key)
+		if !ok {
+			return false
+		}
+		values := value.(MapValues)
+		if values.Exhausted() {
+			return false
+		}
+		updated := values
+		updated.Clicks++
+		// Retry if another request has counted a click in the meantime
+		if !s.URLs.CompareAndSwap(key, values, updated) {
+			continue
+		}
+		if options.FileStore != "" {
+			if err := s.SaveToFile(options.FileStore); err != nil {
+				log.Error().Err(err).Msg("Failed to save to file")
+			}
+		}
+		return true
+	}
 }
 
 // Delete Function to delete the URL
 func (s *URLStore) Delete(key string) {
 	s.URLs.Delete(key)
+	s.Index.Remove(key)
 }
 
 func (s *URLStore) GetStore() *sync.Map {
@@ -0,0 +1,183 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Journal a local file of the links saved while the database was down, one JSON record per line.
+// Every append is synced, so the links survive a crash until they are replayed.
+type Journal struct {
+	path string
+
+	mu      sync.Mutex
+	pending int
+	// keys of the journaled links
+	keys map[string]bool
+}
+
+// DBJournal buffers the writes while the database is down, writes fail then if nil
+var DBJournal *Journal
+
+// OpenJournal opens the journal file, counting the links left by the last run
+func OpenJournal(path string) (*Journal, error) {
+	j := &Journal{path: path, keys: make(map[string]bool)}
+	records, err := j.read()
+	if err != nil {
+		return nil, err
+	}
+	j.pending = len(records)
+	for _, record := range records {
+		j.keys[record.Key()] = true
+	}
+	return j, nil
+}
+
+// Append writes the records to the journal
+func (j *Journal) Append(records ...Record) error {
+	if j == nil {
+		return ErrCircuitOpen
+	}
+	var data []byte
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = file.Write(data); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	j.pending += len(records)
+	for _, record := range records {
+		j.keys[record.Key()] = true
+	}
+	return nil
+}
+
+// Has reports whether a link of the key is waiting to be replayed
+func (j *Journal) Has(key string) bool {
+	if j == nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.keys[key]
+}
+
+// Pending returns the number of links waiting to be replayed
+func (j *Journal) Pending() int {
+	if j == nil {
+		return 0
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.pending
+}
+
+// Replay saves the journaled links with save and empties the journal if they were saved.
+// Appends wait until the replay is done.
+func (j *Journal) Replay(ctx context.Context, save func(ctx context.Context, records []Record) error) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	records, err := j.read()
+	if err != nil || len(records) == 0 {
+		return 0, err
+	}
+	if err = save(ctx, records); err != nil {
+		return 0, err
+	}
+	if err = os.Remove(j.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return len(records), err
+	}
+	j.pending = 0
+	clear(j.keys)
+	return len(records), nil
+}
+
+// read returns the records of the journal, a line cut off by a crash is dropped
+func (j *Journal) read() ([]Record, error) {
+	file, err := os.Open(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 4096), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var record Record
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Error().Err(err).Msgf("Skipping line %d of the journal %s", line, j.path)
+			continue
+		}
+		records = append(records, record)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading journal: %w", err)
+	}
+	return records, nil
+}
+
+// ReplayJournal replays the journal into the database every interval until ctx is done
+func ReplayJournal(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if DBJournal.Pending() == 0 {
+			continue
+		}
+		var skipped []Record
+		n, err := DBJournal.Replay(ctx, func(ctx context.Context, records []Record) error {
+			return dbCall(func() error {
+				return retryQuery(ctx, func(ctx context.Context) (err error) {
+					skipped, err = insertMissing(ctx, DB, records)
+					return err
+				})
+			})
+		})
+		if err != nil {
+			if !errors.Is(err, ErrCircuitOpen) {
+				log.Error().Err(err).Msg("Failed to replay the journal")
+			}
+			continue
+		}
+		// The short URL of a link journaled while the database was down may have been taken by then, or the link saved before
+		for _, record := range skipped {
+			log.Warn().Str("uuid", record.UUID).Str("original_url", record.OriginalURL).
+				Msgf("Skipped journaled link %s, the short URL is already stored", record.Key())
+		}
+		log.Info().Msgf("Replayed %d links saved while the database was down, %d skipped", n-len(skipped), len(skipped))
+	}
+}
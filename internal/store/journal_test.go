@@ -0,0 +1,91 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = j.Append(Record{ShortURL: "a", OriginalURL: "https://a.example"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = j.Append(Record{ShortURL: "b", OriginalURL: "https://b.example", Domain: "go.example"}); err != nil {
+		t.Fatal(err)
+	}
+	// A line cut off by a crash is skipped
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"short_url": "c"`)
+	file.Close()
+
+	// The links survive a restart
+	j, err = OpenJournal(path)
+	if err != nil || j.Pending() != 2 {
+		t.Fatalf("reopened journal has %d links, %v", j.Pending(), err)
+	}
+
+	if !j.Has("go.example/b") || j.Has("b") {
+		t.Errorf("Has() does not match the journaled keys")
+	}
+
+	// A failed replay keeps the links
+	down := errors.New("database is down")
+	if _, err = j.Replay(context.Background(), func(context.Context, []Record) error { return down }); !errors.Is(err, down) || j.Pending() != 2 {
+		t.Fatalf("failed replay returned %v, %d links pending", err, j.Pending())
+	}
+
+	var saved []Record
+	n, err := j.Replay(context.Background(), func(_ context.Context, records []Record) error {
+		saved = records
+		return nil
+	})
+	if err != nil || n != 2 || j.Pending() != 0 {
+		t.Fatalf("replay returned %d, %v, %d links pending", n, err, j.Pending())
+	}
+	if saved[0].Key() != "a" || saved[1].Key() != "go.example/b" {
+		t.Errorf("replayed %+v", saved)
+	}
+	if j.Has("a") {
+		t.Error("Has() of a replayed link")
+	}
+	if _, err = os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("journal was not removed: %v", err)
+	}
+}
+
+func TestJournaling(t *testing.T) {
+	old := DBJournal
+	defer func() { DBJournal = old }()
+	DBJournal = &Journal{path: filepath.Join(t.TempDir(), "journal")}
+
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: ErrCircuitOpen, want: true},
+		{err: syscall.ECONNREFUSED, want: true},
+		// The insert may have been applied when the deadline hit
+		{err: context.DeadlineExceeded, want: false},
+		{err: errors.New("duplicate key value"), want: false},
+	}
+	for _, tt := range tests {
+		if got := journaling(tt.err); got != tt.want {
+			t.Errorf("journaling(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+	DBJournal = nil
+	if journaling(ErrCircuitOpen) {
+		t.Error("journaling without a journal")
+	}
+}
@@ -0,0 +1,358 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"shortener/internal/config"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LinkCursor the position of a link in a listing, links are ordered by domain and short URL
+type LinkCursor struct {
+	Domain   string
+	ShortURL string
+}
+
+// LinkFilter selects the links of a listing
+type LinkFilter struct {
+	// Domain limits the listing to a namespace if set
+	Domain *string
+	// Search a case-insensitive substring of the short or the original URL
+	Search string
+	// CreatedAfter and CreatedBefore bound the creation time if set, links without one are left out then
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// Tags the link must all have
+	Tags []string
+	// Text words that must all be in the title or the original URL
+	Text string
+	// After the cursor of the last link of the previous page
+	After *LinkCursor
+	Limit int
+}
+
+// Links manages the stored links one by one
+type Links interface {
+	// List returns up to filter.Limit links matching the filter, ordered by domain and short URL
+	List(ctx context.Context, filter LinkFilter) ([]Record, error)
+	// Get returns a link, ok is false if it does not exist
+	Get(ctx context.Context, domain, shortURL string) (Record, bool, error)
+	// Update changes a link with update, which may be called more than once. The domain and short URL stay the same.
+	// A replaced target is kept as a version changed by changedBy.
+	Update(ctx context.Context, domain, shortURL, changedBy string, update func(*Record)) (Record, bool, error)
+	// Delete removes a link and its history for good, ok is false if it does not exist
+	Delete(ctx context.Context, domain, shortURL string) (bool, error)
+	// History returns the previous targets of a link, oldest first
+	History(ctx context.Context, domain, shortURL string) ([]Version, error)
+}
+
+// NewMemoryLinks returns the links of the in-memory store, changes are saved to the file if set
+func NewMemoryLinks(opts *config.Options) Links {
+	return &memoryBackend{opts: opts}
+}
+
+// NewDBLinks returns the links of the urls table
+func NewDBLinks(db *sql.DB) Links {
+	return &dbBackend{db: db}
+}
+
+// Matches reports whether the link is selected by the filter, the cursor and limit aside
+func (f LinkFilter) Matches(r Record) bool {
+	if f.Domain != nil && r.Domain != *f.Domain {
+		return false
+	}
+	if f.Search != "" {
+		search := strings.ToLower(f.Search)
+		if !strings.Contains(strings.ToLower(r.ShortURL), search) && !strings.Contains(strings.ToLower(r.OriginalURL), search) {
+			return false
+		}
+	}
+	if !HasTags(r.Tags, f.Tags) {
+		return false
+	}
+	if f.Text != "" && !hasWords(r.Title+" "+r.OriginalURL, f.Text) {
+		return false
+	}
+	if (!f.CreatedAfter.IsZero() || !f.CreatedBefore.IsZero()) && r.CreatedAt.IsZero() {
+		return false
+	}
+	if !f.CreatedAfter.IsZero() && !r.CreatedAt.After(f.CreatedAfter) {
+		return false
+	}
+	return f.CreatedBefore.IsZero() || r.CreatedAt.Before(f.CreatedBefore)
+}
+
+// List sorts the matching links of the map, there is no index to page through. A text search starts from the search index.
+func (b *memoryBackend) List(_ context.Context, filter LinkFilter) ([]Record, error) {
+	var records []Record
+	add := func(key string, values MapValues) {
+		record := NewRecord(key, values)
+		if filter.Matches(record) && (filter.After == nil || cursorLess(*filter.After, record)) {
+			records = append(records, record)
+		}
+	}
+	if filter.Text != "" {
+		for _, key := range Store.Index.Search(filter.Text) {
+			if values, ok := Store.Find(key); ok {
+				add(key, values)
+			}
+		}
+	} else {
+		Store.URLs.Range(func(key, value interface{}) bool {
+			add(key.(string), value.(MapValues))
+			return true
+		})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return cursorLess(LinkCursor{records[i].Domain, records[i].ShortURL}, records[j])
+	})
+	if filter.Limit > 0 && len(records) > filter.Limit {
+		records = records[:filter.Limit]
+	}
+	return records, nil
+}
+
+// cursorLess reports whether the cursor comes before the link
+func cursorLess(c LinkCursor, r Record) bool {
+	if c.Domain != r.Domain {
+		return c.Domain < r.Domain
+	}
+	return c.ShortURL < r.ShortURL
+}
+
+func (b *memoryBackend) Get(_ context.Context, domain, shortURL string) (Record, bool, error) {
+	key := Key(domain, shortURL)
+	values, ok := Store.Find(key)
+	if !ok {
+		return Record{}, false, nil
+	}
+	return NewRecord(key, values), true, nil
+}
+
+func (b *memoryBackend) Update(_ context.Context, domain, shortURL, changedBy string, update func(*Record)) (Record, bool, error) {
+	key := Key(domain, shortURL)
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	for {
+		value, ok := Store.URLs.Load(key)
+		if !ok {
+			return Record{}, false, nil
+		}
+		record := NewRecord(key, value.(MapValues))
+		update(&record)
+		record.Domain, record.ShortURL = domain, shortURL
+		// Retry if a click was counted in the meantime
+		if !Store.URLs.CompareAndSwap(key, value, record.Values()) {
+			continue
+		}
+		Store.Index.Add(key, record.Values())
+		if old := value.(MapValues).Value; old != record.OriginalURL {
+			Store.addVersion(key, old, changedBy)
+			if err := b.saveHistory(); err != nil {
+				return record, true, err
+			}
+		}
+		return record, true, b.saveFile()
+	}
+}
+
+func (b *memoryBackend) Delete(_ context.Context, domain, shortURL string) (bool, error) {
+	key := Key(domain, shortURL)
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	if _, ok := Store.URLs.LoadAndDelete(key); !ok {
+		return false, nil
+	}
+	Store.Index.Remove(key)
+	if _, ok := Store.History.LoadAndDelete(key); ok {
+		if err := b.saveHistory(); err != nil {
+			return true, err
+		}
+	}
+	return true, b.saveFile()
+}
+
+// saveFile saves the in-memory store to the file if set
+func (b *memoryBackend) saveFile() error {
+	if b.opts.FileStore == "" {
+		return nil
+	}
+	return Store.SaveToFile(b.opts.FileStore)
+}
+
+// saveHistory saves the history to the file next to the storage file if set, historyMu must be held
+func (b *memoryBackend) saveHistory() error {
+	if b.opts.FileStore == "" {
+		return nil
+	}
+	return Store.saveHistory(HistoryPath(b.opts.FileStore))
+}
+
+// SQL statements of a single link
+const (
+	selectForUpdateSQL = `SELECT ` + recordColumns + ` FROM urls WHERE domain = $1 AND short_url = $2 FOR UPDATE;`
+	listLinksSQL       = `SELECT ` + recordColumns + ` FROM urls`
+	deleteLinkSQL      = `
+		WITH versions AS (DELETE FROM link_versions WHERE domain = $1 AND short_url = $2)
+		DELETE FROM urls WHERE domain = $1 AND short_url = $2;`
+)
+
+// SQL statement to update every column of a link
+var updateSQL = `UPDATE urls SET (` + recordColumns + `) = ` + placeholders(3, recordFields) + ` WHERE domain = $1 AND short_url = $2;`
+
+// likeEscaper escapes the wildcards of a LIKE pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// listQuery returns the statement and arguments selecting a page of the links matching the filter
+func listQuery(filter LinkFilter) (string, []any) {
+	var conditions []string
+	var args []any
+	param := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if filter.Domain != nil {
+		conditions = append(conditions, "domain = "+param(*filter.Domain))
+	}
+	if filter.Search != "" {
+		pattern := param("%" + likeEscaper.Replace(filter.Search) + "%")
+		conditions = append(conditions, "(short_url ILIKE "+pattern+" OR original_url ILIKE "+pattern+")")
+	}
+	for _, tag := range filter.Tags {
+		conditions = append(conditions, "string_to_array(tags, ',') @> ARRAY["+param(tag)+"::text]")
+	}
+	if filter.Text != "" {
+		conditions = append(conditions, "search @@ plainto_tsquery('simple', regexp_replace(lower("+param(filter.Text)+"), '[^[:alnum:]]+', ' ', 'g'))")
+	}
+	if !filter.CreatedAfter.IsZero() {
+		conditions = append(conditions, "created_at > "+param(filter.CreatedAfter))
+	}
+	if !filter.CreatedBefore.IsZero() {
+		conditions = append(conditions, "created_at < "+param(filter.CreatedBefore))
+	}
+	if filter.After != nil {
+		conditions = append(conditions, "(domain, short_url) > ("+param(filter.After.Domain)+", "+param(filter.After.ShortURL)+")")
+	}
+
+	query := listLinksSQL
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY domain, short_url"
+	if filter.Limit > 0 {
+		query += " LIMIT " + param(filter.Limit)
+	}
+	return query + ";", args
+}
+
+func (b *dbBackend) List(ctx context.Context, filter LinkFilter) ([]Record, error) {
+	query, args := listQuery(filter)
+	var records []Record
+	err := dbCall(func() error {
+		return retryQuery(ctx, func(ctx context.Context) error {
+			records = records[:0]
+			rows, err := b.db.QueryContext(ctx, query, args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				record, err := scanRecord(rows)
+				if err != nil {
+					return err
+				}
+				records = append(records, record)
+			}
+			return rows.Err()
+		})
+	})
+	return records, err
+}
+
+func (b *dbBackend) Get(ctx context.Context, domain, shortURL string) (Record, bool, error) {
+	var record Record
+	err := dbCall(func() error {
+		return retryQuery(ctx, func(ctx context.Context) (err error) {
+			record, err = scanRecord(b.db.QueryRowContext(ctx, selectSQL, domain, shortURL))
+			return err
+		})
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return Record{}, false, nil
+	}
+	return record, err == nil, err
+}
+
+// Update changes the link in a transaction, a transaction failing before the commit is retried
+func (b *dbBackend) Update(ctx context.Context, domain, shortURL, changedBy string, update func(*Record)) (Record, bool, error) {
+	var record Record
+	err := dbCall(func() error {
+		return retryQuery(ctx, func(ctx context.Context) (err error) {
+			record, err = b.update(ctx, domain, shortURL, changedBy, update)
+			return err
+		})
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return Record{}, false, nil
+	}
+	if err != nil {
+		return Record{}, false, err
+	}
+	Cache.Put(record.Key(), record.Values())
+	return record, true, nil
+}
+
+// update runs one attempt of Update
+func (b *dbBackend) update(ctx context.Context, domain, shortURL, changedBy string, update func(*Record)) (record Record, err error) {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return record, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		if err = tx.Commit(); err != nil {
+			err = finalError{err}
+		}
+	}()
+
+	if record, err = scanRecord(tx.QueryRowContext(ctx, selectForUpdateSQL, domain, shortURL)); err != nil {
+		return record, err
+	}
+	old := record.OriginalURL
+	update(&record)
+	if record.OriginalURL != old {
+		if _, err = tx.ExecContext(ctx, insertVersionSQL, domain, shortURL, old, changedBy, Now()); err != nil {
+			return record, err
+		}
+	}
+	record.Domain, record.ShortURL = domain, shortURL
+	_, err = tx.ExecContext(ctx, updateSQL, append([]any{domain, shortURL}, recordArgs(record)...)...)
+	return record, err
+}
+
+// Delete removes the link and its history, it is not retried as the delete may have been applied
+func (b *dbBackend) Delete(ctx context.Context, domain, shortURL string) (bool, error) {
+	var deleted int64
+	err := dbCall(func() error {
+		ctx, cancel := queryContext(ctx)
+		defer cancel()
+		result, err := b.db.ExecContext(ctx, deleteLinkSQL, domain, shortURL)
+		if err != nil {
+			return queryError(ctx, err)
+		}
+		deleted, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	Cache.Delete(Key(domain, shortURL))
+	return deleted > 0, nil
+}
@@ -0,0 +1,80 @@
+package store
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestListQuery(t *testing.T) {
+	domain := "go.example"
+	after := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	query, args := listQuery(LinkFilter{
+		Domain:       &domain,
+		Search:       "50%_off",
+		CreatedAfter: after,
+		After:        &LinkCursor{Domain: domain, ShortURL: "abc"},
+		Limit:        11,
+	})
+	want := listLinksSQL + ` WHERE domain = $1 AND (short_url ILIKE $2 OR original_url ILIKE $2) AND created_at > $3` +
+		` AND (domain, short_url) > ($4, $5) ORDER BY domain, short_url LIMIT $6;`
+	if query != want {
+		t.Errorf("listQuery() = %s\nwant %s", query, want)
+	}
+	if wantArgs := []any{domain, `%50\%\_off%`, after, domain, "abc", 11}; !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("listQuery() args = %v, want %v", args, wantArgs)
+	}
+
+	query, args = listQuery(LinkFilter{Tags: []string{"go", "docs"}, Text: "Style Guide"})
+	want = listLinksSQL + ` WHERE string_to_array(tags, ',') @> ARRAY[$1::text] AND string_to_array(tags, ',') @> ARRAY[$2::text]` +
+		` AND search @@ plainto_tsquery('simple', regexp_replace(lower($3), '[^[:alnum:]]+', ' ', 'g')) ORDER BY domain, short_url;`
+	if query != want {
+		t.Errorf("listQuery() = %s\nwant %s", query, want)
+	}
+	if wantArgs := []any{"go", "docs", "Style Guide"}; !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("listQuery() args = %v, want %v", args, wantArgs)
+	}
+
+	if query, args = listQuery(LinkFilter{}); query != listLinksSQL+` ORDER BY domain, short_url;` || len(args) != 0 {
+		t.Errorf("listQuery() = %s, %v", query, args)
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	if got := Words("Go's Guide: https://go.dev/doc/effective_go, go!"); !reflect.DeepEqual(got,
+		[]string{"go", "s", "guide", "https", "dev", "doc", "effective"}) {
+		t.Errorf("Words() = %q", got)
+	}
+
+	index := NewSearchIndex()
+	index.Add("a", MapValues{Value: "https://go.dev/doc", Title: "Go documentation"})
+	index.Add("b", MapValues{Value: "https://example.com/go"})
+	search := func(query string) []string {
+		keys := index.Search(query)
+		sort.Strings(keys)
+		return keys
+	}
+	if got := search("GO"); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("Search(GO) = %q", got)
+	}
+	if got := search("go documentation"); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("Search(go documentation) = %q", got)
+	}
+	if got := search("..."); got != nil {
+		t.Errorf("Search(...) = %q", got)
+	}
+
+	// Adding a key again replaces its words
+	index.Add("a", MapValues{Value: "https://example.org"})
+	index.Remove("b")
+	if got := search("go"); got != nil {
+		t.Errorf("Search(go) after changes = %q", got)
+	}
+	if got := search("example"); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("Search(example) = %q", got)
+	}
+	if len(index.words) != 3 {
+		t.Errorf("index keeps %d words, want 3", len(index.words))
+	}
+}
@@ -0,0 +1,340 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of copied links between progress log lines
+const backfillLogEvery = 1000
+
+// Number of links read ahead of the new backend while copying
+const backfillChunk = 1000
+
+// BackfillProgress counters of the copy of a storage migration, safe to read while it runs
+type BackfillProgress struct {
+	Total   atomic.Int64
+	Read    atomic.Int64
+	Written atomic.Int64
+	Skipped atomic.Int64
+	// Histories links whose previous targets were copied
+	Histories atomic.Int64
+	Running   atomic.Bool
+	Done      atomic.Bool
+	err       atomic.Value
+}
+
+// BackfillStats a snapshot of the progress of the copy
+type BackfillStats struct {
+	Running   bool   `json:"running"`
+	Done      bool   `json:"done"`
+	Total     int64  `json:"total"`
+	Read      int64  `json:"read"`
+	Written   int64  `json:"written"`
+	Skipped   int64  `json:"skipped"`
+	Histories int64  `json:"histories"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Backfill the progress of the running migration copy
+var Backfill BackfillProgress
+
+// Stats returns the current progress
+func (p *BackfillProgress) Stats() BackfillStats {
+	stats := BackfillStats{
+		Running:   p.Running.Load(),
+		Done:      p.Done.Load(),
+		Total:     p.Total.Load(),
+		Read:      p.Read.Load(),
+		Written:   p.Written.Load(),
+		Skipped:   p.Skipped.Load(),
+		Histories: p.Histories.Load(),
+	}
+	stats.Error, _ = p.err.Load().(string)
+	return stats
+}
+
+// reset clears the progress of a previous copy
+func (p *BackfillProgress) reset() {
+	for _, counter := range []*atomic.Int64{&p.Total, &p.Read, &p.Written, &p.Skipped, &p.Histories} {
+		counter.Store(0)
+	}
+	p.Done.Store(false)
+	p.err.Store("")
+}
+
+var errStopped = errors.New("stopped")
+
+// pull runs each in the background and returns a function reading what it yields, io.EOF at the end.
+// At most backfillChunk values are read ahead. stop ends each early and waits for it.
+func pull[T any](ctx context.Context, each func(ctx context.Context, fn func(T) error) error) (next func() (T, error), stop func()) {
+	values := make(chan T, backfillChunk)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	var err error
+	go func() {
+		defer close(finished)
+		defer close(values)
+		err = each(ctx, func(v T) error {
+			select {
+			case values <- v:
+				return nil
+			case <-done:
+				return errStopped
+			}
+		})
+	}()
+	next = func() (T, error) {
+		v, ok := <-values
+		if ok {
+			return v, nil
+		}
+		<-finished
+		if err != nil {
+			return v, err
+		}
+		return v, io.EOF
+	}
+	var once sync.Once
+	stop = func() {
+		once.Do(func() { close(done) })
+		<-finished
+	}
+	return next, stop
+}
+
+// RunBackfill copies the links missing in the new backend from the old one, then their previous targets.
+// Links written to both backends meanwhile already exist in the new one and are skipped.
+// The links are streamed, only a chunk of them is held in memory.
+func RunBackfill(ctx context.Context, from, to Backend, progress *BackfillProgress) error {
+	progress.reset()
+	progress.Running.Store(true)
+	defer progress.Running.Store(false)
+	err := runBackfill(ctx, from, to, progress)
+	if err != nil {
+		progress.err.Store(err.Error())
+		return err
+	}
+	progress.Done.Store(true)
+	return nil
+}
+
+func runBackfill(ctx context.Context, from, to Backend, progress *BackfillProgress) error {
+	// Count first, so the progress has a total
+	var total int64
+	err := from.Each(ctx, func(Record) error {
+		total++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	progress.Total.Store(total)
+	log.Info().Msgf("Copying %d links to the new storage", total)
+
+	next, stop := pull(ctx, from.Each)
+	stats, err := to.Import(ctx, func() (Record, error) {
+		record, err := next()
+		if err == nil {
+			if read := progress.Read.Add(1); read%backfillLogEvery == 0 {
+				log.Info().Msgf("Read %d of %d links to copy", read, total)
+			}
+		}
+		return record, err
+	}, ConflictSkip)
+	stop()
+	progress.Written.Store(int64(stats.Written))
+	progress.Skipped.Store(int64(stats.Skipped))
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("Copied %d links, %d already existed", stats.Written, stats.Skipped)
+
+	nextHistory, stop := pull(ctx, from.EachHistory)
+	histories, err := to.ImportHistory(ctx, nextHistory)
+	stop()
+	progress.Histories.Store(int64(histories))
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("Copied the previous targets of %d links", histories)
+	return nil
+}
+
+// Difference of a link between two backends
+type Difference struct {
+	Key         string
+	Left, Right *Record // nil if the backend does not have the link
+}
+
+var errDuplicate = errors.New("duplicate link")
+
+// Compare returns the links that are missing in either backend or differ, sorted by key.
+// Click counters are not compared, redirects keep counting while the backends are compared.
+func Compare(ctx context.Context, left, right Backend) ([]Difference, error) {
+	leftRecords, err := collect(ctx, left)
+	if err != nil {
+		return nil, err
+	}
+	rightRecords, err := collect(ctx, right)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []Difference
+	for key, l := range leftRecords {
+		r, ok := rightRecords[key]
+		switch {
+		case !ok:
+			diffs = append(diffs, Difference{Key: key, Left: l})
+		case !sameLink(*l, *r):
+			diffs = append(diffs, Difference{Key: key, Left: l, Right: r})
+		}
+	}
+	for key, r := range rightRecords {
+		if _, ok := leftRecords[key]; !ok {
+			diffs = append(diffs, Difference{Key: key, Right: r})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Key < diffs[j].Key })
+	return diffs, nil
+}
+
+func collect(ctx context.Context, b Backend) (map[string]*Record, error) {
+	records := make(map[string]*Record)
+	err := b.Each(ctx, func(r Record) error {
+		if _, ok := records[r.Key()]; ok {
+			return fmt.Errorf("%w: %s", errDuplicate, r.Key())
+		}
+		records[r.Key()] = &r
+		return nil
+	})
+	return records, err
+}
+
+func sameLink(a, b Record) bool {
+	a.Clicks, b.Clicks = 0, 0
+	return a == b
+}
+
+// Fields returns the JSON names of the fields of the link that differ, clicks left out.
+// Only the names are reported, the values may be secret like the password hash.
+func (d Difference) Fields() []string {
+	if d.Left == nil || d.Right == nil {
+		return nil
+	}
+	return differentFields(reflect.ValueOf(*d.Left), reflect.ValueOf(*d.Right), "clicks")
+}
+
+// differentFields returns the JSON names of the fields of two structs of the same type that differ,
+// embedded structs are compared field by field and times by their instant
+func differentFields(a, b reflect.Value, skip ...string) []string {
+	var fields []string
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		if field.Anonymous {
+			fields = append(fields, differentFields(a.Field(i), b.Field(i), skip...)...)
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if slices.Contains(skip, name) {
+			continue
+		}
+		x, y := a.Field(i).Interface(), b.Field(i).Interface()
+		if t, ok := x.(time.Time); ok {
+			if !t.Equal(y.(time.Time)) {
+				fields = append(fields, name)
+			}
+			continue
+		}
+		if x != y {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// HistoryDifference a link whose previous targets differ between two backends
+type HistoryDifference struct {
+	Key         string
+	Left, Right []Version
+}
+
+// CompareHistory returns the links whose previous targets differ between the backends, sorted by key
+func CompareHistory(ctx context.Context, left, right Backend) ([]HistoryDifference, error) {
+	leftHistory, err := collectHistory(ctx, left)
+	if err != nil {
+		return nil, err
+	}
+	rightHistory, err := collectHistory(ctx, right)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []HistoryDifference
+	for key, l := range leftHistory {
+		if r := rightHistory[key]; !sameHistory(l, r) {
+			diffs = append(diffs, HistoryDifference{Key: key, Left: l, Right: r})
+		}
+	}
+	for key, r := range rightHistory {
+		if _, ok := leftHistory[key]; !ok {
+			diffs = append(diffs, HistoryDifference{Key: key, Right: r})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Key < diffs[j].Key })
+	return diffs, nil
+}
+
+func collectHistory(ctx context.Context, b Backend) (map[string][]Version, error) {
+	history := make(map[string][]Version)
+	err := b.EachHistory(ctx, func(h LinkHistory) error {
+		history[h.Key] = h.Versions
+		return nil
+	})
+	return history, err
+}
+
+// Fields returns what differs between the previous targets: "versions" if their number differs,
+// the JSON names of the fields of the versions that differ otherwise
+func (d HistoryDifference) Fields() []string {
+	if len(d.Left) != len(d.Right) {
+		return []string{"versions"}
+	}
+	var fields []string
+	for i := range d.Left {
+		for _, field := range differentFields(reflect.ValueOf(d.Left[i]), reflect.ValueOf(d.Right[i])) {
+			if !slices.Contains(fields, field) {
+				fields = append(fields, field)
+			}
+		}
+	}
+	return fields
+}
+
+// sameHistory compares the versions, times by their instant as the storages keep them in different locations
+func sameHistory(a, b []Version) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, y := a[i], b[i]
+		if x.ChangedAt.Equal(y.ChangedAt) {
+			x.ChangedAt, y.ChangedAt = time.Time{}, time.Time{}
+		}
+		if x != y {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,137 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"reflect"
+	"shortener/internal/config"
+	"testing"
+	"time"
+)
+
+func TestBackfillAndCompare(t *testing.T) {
+	ctx := context.Background()
+	New()
+	opts := config.Options{FileStore: filepath.Join(t.TempDir(), "new.json")}
+	Store.Save(Key("", "both"), MapValues{Value: "https://example.com/both", UUID: "1"}, &opts)
+
+	old := NewFileBackend(filepath.Join(t.TempDir(), "old.json"))
+	records := []Record{
+		{UUID: "1", ShortURL: "both", OriginalURL: "https://example.com/both", Clicks: 3},
+		{UUID: "2", ShortURL: "old", OriginalURL: "https://example.com/old", Domain: "go.example.com"},
+	}
+	i := 0
+	_, err := old.Import(ctx, func() (Record, error) {
+		i++
+		if i > len(records) {
+			return Record{}, io.EOF
+		}
+		return records[i-1], nil
+	}, ConflictFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An edited link of the old storage has previous targets
+	changedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	history := []Version{{Version: 1, OriginalURL: "https://example.com/older", ChangedBy: "admin", ChangedAt: changedAt}}
+	n := 0
+	written, err := old.ImportHistory(ctx, func() (LinkHistory, error) {
+		n++
+		if n > 1 {
+			return LinkHistory{}, io.EOF
+		}
+		return LinkHistory{Key: "go.example.com/old", Versions: history}, nil
+	})
+	if err != nil || written != 1 {
+		t.Fatalf("ImportHistory() = %d, %v", written, err)
+	}
+
+	memory := NewMemoryBackend(&opts)
+	diffs, err := Compare(ctx, old, memory)
+	if err != nil || len(diffs) != 1 || diffs[0].Key != "go.example.com/old" || diffs[0].Right != nil {
+		t.Fatalf("Compare() before the copy = %+v, %v", diffs, err)
+	}
+
+	var progress BackfillProgress
+	if err = RunBackfill(ctx, old, memory, &progress); err != nil {
+		t.Fatal(err)
+	}
+	if want := (BackfillStats{Done: true, Total: 2, Read: 2, Written: 1, Skipped: 1, Histories: 1}); progress.Stats() != want {
+		t.Errorf("progress = %+v, want %+v", progress.Stats(), want)
+	}
+
+	// The copy is saved to the file, click counters are not compared
+	diffs, err = Compare(ctx, old, NewFileBackend(opts.FileStore))
+	if err != nil || len(diffs) != 0 {
+		t.Errorf("Compare() after the copy = %+v, %v", diffs, err)
+	}
+	// So are the previous targets
+	if got := Store.Versions("go.example.com/old"); !reflect.DeepEqual(got, history) {
+		t.Errorf("copied history = %+v", got)
+	}
+	historyDiffs, err := CompareHistory(ctx, old, NewFileBackend(opts.FileStore))
+	if err != nil || len(historyDiffs) != 0 {
+		t.Errorf("CompareHistory() after the copy = %+v, %v", historyDiffs, err)
+	}
+	Store.History.Store("both", history)
+	historyDiffs, err = CompareHistory(ctx, old, memory)
+	if err != nil || len(historyDiffs) != 1 || historyDiffs[0].Key != "both" || historyDiffs[0].Left != nil {
+		t.Errorf("CompareHistory() of a new history = %+v, %v", historyDiffs, err)
+	}
+}
+
+func TestPull(t *testing.T) {
+	ctx := context.Background()
+	each := func(_ context.Context, fn func(int) error) error {
+		for i := 0; ; i++ {
+			if err := fn(i); err != nil {
+				return err
+			}
+		}
+	}
+	next, stop := pull(ctx, each)
+	for i := 0; i < 3; i++ {
+		if v, err := next(); v != i || err != nil {
+			t.Fatalf("next() = %d, %v, want %d", v, err, i)
+		}
+	}
+	// Stopping ends the endless each
+	stop()
+
+	failing := errors.New("read failed")
+	next, stop = pull(ctx, func(_ context.Context, fn func(int) error) error {
+		if err := fn(1); err != nil {
+			return err
+		}
+		return failing
+	})
+	defer stop()
+	if v, err := next(); v != 1 || err != nil {
+		t.Errorf("next() = %d, %v", v, err)
+	}
+	if _, err := next(); !errors.Is(err, failing) {
+		t.Errorf("next() error = %v, want %v", err, failing)
+	}
+}
+
+func TestDifferenceFields(t *testing.T) {
+	left := Record{ShortURL: "a", OriginalURL: "https://a.example", PasswordHash: "secret", Clicks: 1, CreatedAt: time.Unix(1, 0)}
+	right := left
+	right.PasswordHash, right.Clicks, right.Forward.UTM.Source = "other", 2, "news"
+	right.CreatedAt = time.Unix(1, 0).UTC()
+	if fields := (Difference{Key: "a", Left: &left, Right: &right}).Fields(); !reflect.DeepEqual(fields, []string{"password_hash", "utm_source"}) {
+		t.Errorf("Fields() = %v", fields)
+	}
+
+	versions := []Version{{Version: 1, OriginalURL: "https://a.example"}}
+	if fields := (HistoryDifference{Key: "a", Left: versions}).Fields(); !reflect.DeepEqual(fields, []string{"versions"}) {
+		t.Errorf("Fields() of a missing history = %v", fields)
+	}
+	changed := []Version{{Version: 1, OriginalURL: "https://b.example", ChangedBy: "admin"}}
+	if fields := (HistoryDifference{Key: "a", Left: versions, Right: changed}).Fields(); !reflect.DeepEqual(fields, []string{"original_url", "changed_by"}) {
+		t.Errorf("Fields() = %v", fields)
+	}
+}
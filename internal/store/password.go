@@ -0,0 +1,28 @@
+package store
+
+import (
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxPasswordLength bcrypt ignores everything after 72 bytes
+const maxPasswordLength = 72
+
+var ErrPasswordLength = errors.New("password must be between 1 and 72 bytes long")
+
+// HashPassword returns a salted hash of the link password to be stored instead of the password
+func HashPassword(password string) (string, error) {
+	if password == "" || len(password) > maxPasswordLength {
+		return "", ErrPasswordLength
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CheckPassword reports whether the password matches the stored hash
+func CheckPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
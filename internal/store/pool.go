@@ -0,0 +1,122 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	_ "github.com/jackc/pgx/v5/stdlib" // Registers the pgx driver as "pgx"
+	_ "github.com/lib/pq"              // Registers the lib/pq driver as "postgres"
+	"shortener/internal/config"
+	"strconv"
+	"strings"
+)
+
+// Database drivers by their option names
+var drivers = map[string]string{
+	"pq":  "postgres",
+	"pgx": "pgx",
+}
+
+// Statements of the hot lookups, prepared by InitDB; queries are parsed on every call without them
+var (
+	selectStmt          *sql.Stmt
+	selectShareableStmt *sql.Stmt
+)
+
+// OpenDB opens the connection pool of the configured driver, it does not connect yet
+func OpenDB(opts *config.Options) (*sql.DB, error) {
+	driver, ok := drivers[opts.DBDriver]
+	if !ok {
+		driver = drivers["pq"]
+	}
+	db, err := sql.Open(driver, opts.ConnectionString)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(opts.DBMaxConns)
+	db.SetMaxIdleConns(opts.DBMaxIdleConns)
+	db.SetConnMaxLifetime(opts.DBConnMaxLifetime)
+	return db, nil
+}
+
+// prepareStatements prepares the statements of the hot lookups, database/sql prepares them again on every connection of the pool
+func prepareStatements(db *sql.DB) (err error) {
+	if selectStmt, err = db.Prepare(selectSQL); err != nil {
+		return err
+	}
+	selectShareableStmt, err = db.Prepare(selectShareableSQL)
+	return err
+}
+
+// queryRow runs a query with its prepared statement if there is one
+func queryRow(ctx context.Context, stmt *sql.Stmt, query string, args ...any) *sql.Row {
+	if stmt != nil {
+		return stmt.QueryRowContext(ctx, args...)
+	}
+	return DB.QueryRowContext(ctx, query, args...)
+}
+
+// PoolStats statistics of the connection pool
+type PoolStats struct {
+	MaxOpen   int   `json:"max_open"`
+	Open      int   `json:"open"`
+	InUse     int   `json:"in_use"`
+	Idle      int   `json:"idle"`
+	WaitCount int64 `json:"wait_count"`
+	// WaitMS total time waited for a connection in milliseconds
+	WaitMS            int64 `json:"wait_ms"`
+	MaxIdleClosed     int64 `json:"max_idle_closed"`
+	MaxLifetimeClosed int64 `json:"max_lifetime_closed"`
+}
+
+// Stats returns the statistics of the connection pool
+func Stats() PoolStats {
+	stats := DB.Stats()
+	return PoolStats{
+		MaxOpen:           stats.MaxOpenConnections,
+		Open:              stats.OpenConnections,
+		InUse:             stats.InUse,
+		Idle:              stats.Idle,
+		WaitCount:         stats.WaitCount,
+		WaitMS:            stats.WaitDuration.Milliseconds(),
+		MaxIdleClosed:     stats.MaxIdleClosed,
+		MaxLifetimeClosed: stats.MaxLifetimeClosed,
+	}
+}
+
+// Maximum rows of a multi-row insert, Postgres allows 65535 parameters in a statement
+const maxInsertRows = 65535 / recordFields
+
+// insertRowsSQL returns the statement to insert n links at once
+func insertRowsSQL(n int) string {
+	var b strings.Builder
+	b.WriteString(`INSERT INTO urls (` + recordColumns + `) VALUES `)
+	for row := 0; row < n; row++ {
+		if row > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(placeholders(row*recordFields+1, recordFields))
+	}
+	b.WriteByte(';')
+	return b.String()
+}
+
+// insertMissingRowsSQL returns the statement to insert n links, links conflicting with a stored one are skipped.
+// Returns the keys of the inserted links.
+func insertMissingRowsSQL(n int) string {
+	return strings.TrimSuffix(insertRowsSQL(n), ";") + ` ON CONFLICT (domain, short_url) DO NOTHING RETURNING domain, short_url;`
+}
+
+// placeholders returns the parenthesized list of n parameters starting at $first
+func placeholders(first, n int) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteByte('$')
+		b.WriteString(strconv.Itoa(first + i))
+	}
+	b.WriteByte(')')
+	return b.String()
+}
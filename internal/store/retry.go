@@ -0,0 +1,133 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net"
+	"shortener/internal/config"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Retries how often an idempotent query is repeated after a retriable error
+var Retries = 2
+
+// Backoff of the query retries, doubled on every attempt
+const retryBackoff = 50 * time.Millisecond
+
+// Backoff of the startup connection attempts
+const (
+	connectBackoff    = 500 * time.Millisecond
+	connectMaxBackoff = 5 * time.Second
+)
+
+// Postgres error codes worth retrying besides the connection exception class 08
+var retriableCodes = map[string]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+	"57P01": true, // admin_shutdown
+	"57P03": true, // cannot_connect_now, the server is starting
+}
+
+// Retriable reports whether the error is transient: the connection failed or the transaction lost
+// against another one. Canceled and timed out queries are not retried.
+func Retriable(err error) bool {
+	var final finalError
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.As(err, &final) {
+		return false
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code.Class() == "08" || retriableCodes[string(pqErr.Code)]
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return strings.HasPrefix(pgErr.Code, "08") || retriableCodes[pgErr.Code]
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.As(err, &netErr) || pgconn.SafeToRetry(err)
+}
+
+// finalError marks an error that must not be retried even if it is transient, like a failed commit that may have been applied
+type finalError struct {
+	err error
+}
+
+func (e finalError) Error() string { return e.err.Error() }
+func (e finalError) Unwrap() error { return e.err }
+
+// retry runs an idempotent operation until it succeeds, fails for good or the context is done
+func retry(ctx context.Context, op func(ctx context.Context) error) error {
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := op(ctx)
+		if attempt >= Retries || !Retriable(err) {
+			return err
+		}
+		log.Warn().Err(err).Msgf("Retrying database query, attempt %d", attempt+1)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// retryQuery runs an idempotent query with retries, every attempt within the query timeout
+func retryQuery(ctx context.Context, query func(ctx context.Context) error) error {
+	return retry(ctx, func(ctx context.Context) error {
+		ctx, cancel := queryContext(ctx)
+		defer cancel()
+		return queryError(ctx, query(ctx))
+	})
+}
+
+// RunQuery runs an idempotent query of another package like the ones of the store: through the breaker,
+// with retries and every attempt within the query timeout
+func RunQuery(ctx context.Context, query func(ctx context.Context) error) error {
+	return dbCall(func() error {
+		return retryQuery(ctx, query)
+	})
+}
+
+// ConnectDB opens the database and creates the tables, waiting for a database that is not up yet
+// for at most DBConnectTimeout with a growing backoff
+func ConnectDB(ctx context.Context, opts *config.Options) (*sql.DB, error) {
+	db, err := OpenDB(opts)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, opts.DBConnectTimeout)
+	defer cancel()
+
+	backoff := connectBackoff
+	for attempt := 1; ; attempt++ {
+		if err = db.PingContext(ctx); err == nil {
+			if err = InitDB(db); err == nil {
+				return db, nil
+			}
+		}
+		if !Retriable(err) && ctx.Err() == nil {
+			db.Close()
+			return nil, err
+		}
+		log.Warn().Err(err).Msgf("Database is not available, attempt %d, retrying in %s", attempt, backoff)
+		select {
+		case <-ctx.Done():
+			db.Close()
+			return nil, fmt.Errorf("database is not available after %s: %w", opts.DBConnectTimeout, err)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, connectMaxBackoff)
+	}
+}
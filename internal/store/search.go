@@ -0,0 +1,114 @@
+package store
+
+import (
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// SearchIndex an inverted index of the words of the titles and the URLs of the links in memory,
+// the database searches its own tsvector column instead
+type SearchIndex struct {
+	mu    sync.RWMutex
+	words map[string]map[string]struct{}
+	keys  map[string][]string
+}
+
+// NewSearchIndex creates an empty index
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{words: make(map[string]map[string]struct{}), keys: make(map[string][]string)}
+}
+
+// Words splits the text into the lowercase words that are searched for, anything but letters and digits separates them
+func Words(text string) []string {
+	seen := make(map[string]bool)
+	var words []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		if !seen[word] {
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// Add indexes the link stored under the key, replacing what was indexed for it before
+func (i *SearchIndex) Add(key string, values MapValues) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.remove(key)
+	words := Words(values.Title + " " + values.Value)
+	for _, word := range words {
+		if i.words[word] == nil {
+			i.words[word] = make(map[string]struct{})
+		}
+		i.words[word][key] = struct{}{}
+	}
+	i.keys[key] = words
+}
+
+// Remove drops the link stored under the key from the index
+func (i *SearchIndex) Remove(key string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.remove(key)
+}
+
+func (i *SearchIndex) remove(key string) {
+	for _, word := range i.keys[key] {
+		delete(i.words[word], key)
+		if len(i.words[word]) == 0 {
+			delete(i.words, word)
+		}
+	}
+	delete(i.keys, key)
+}
+
+// Search returns the keys of the links having every word of the query, none if it has no words
+func (i *SearchIndex) Search(query string) []string {
+	words := Words(query)
+	if len(words) == 0 {
+		return nil
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	// Start with the rarest word, every other one can only remove keys
+	rarest := words[0]
+	for _, word := range words[1:] {
+		if len(i.words[word]) < len(i.words[rarest]) {
+			rarest = word
+		}
+	}
+	var keys []string
+	for key := range i.words[rarest] {
+		found := true
+		for _, word := range words {
+			if _, ok := i.words[word][key]; !ok {
+				found = false
+				break
+			}
+		}
+		if found {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// hasWords reports whether the text has every word of the query, as the index would find it
+func hasWords(text, query string) bool {
+	words := Words(query)
+	if len(words) == 0 {
+		return false
+	}
+	found := make(map[string]bool)
+	for _, word := range Words(text) {
+		found[word] = true
+	}
+	for _, word := range words {
+		if !found[word] {
+			return false
+		}
+	}
+	return true
+}
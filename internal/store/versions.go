@@ -0,0 +1,386 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version a previous target of a link, kept when the target is changed. Versions are numbered from 1,
+// the current target of a link is the version after its last previous one.
+type Version struct {
+	Version     int    `json:"version"`
+	OriginalURL string `json:"original_url"`
+	// ChangedBy and ChangedAt who replaced the target and when
+	ChangedBy string    `json:"changed_by,omitempty"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// historyMu serializes the changes of the in-memory history, so versions are numbered in order
+var historyMu sync.Mutex
+
+// HistoryPath returns the file keeping the history of the links of the storage file
+func HistoryPath(fileStore string) string {
+	return fileStore + ".versions"
+}
+
+// Versions returns the previous targets of the link stored under the key, oldest first
+func (s *URLStore) Versions(key string) []Version {
+	versions, ok := s.History.Load(key)
+	if !ok {
+		return nil
+	}
+	return append([]Version(nil), versions.([]Version)...)
+}
+
+// addVersion keeps the replaced target of the link stored under the key, historyMu must be held
+func (s *URLStore) addVersion(key, originalURL, changedBy string) {
+	versions := s.Versions(key)
+	versions = append(versions, Version{Version: len(versions) + 1, OriginalURL: originalURL, ChangedBy: changedBy, ChangedAt: Now()})
+	s.History.Store(key, versions)
+}
+
+// LoadHistory loads the history of the links from the file, a missing file has none
+func (s *URLStore) LoadHistory(filePath string) error {
+	history, err := readHistory(filePath)
+	if err != nil {
+		return err
+	}
+	for key, versions := range history {
+		s.History.Store(key, versions)
+	}
+	return nil
+}
+
+// saveHistory saves the history of the links to the file, historyMu must be held
+func (s *URLStore) saveHistory(filePath string) error {
+	history := make(map[string][]Version)
+	s.History.Range(func(key, value interface{}) bool {
+		history[key.(string)] = value.([]Version)
+		return true
+	})
+	return writeHistory(filePath, history)
+}
+
+// History returns the previous targets of the link, oldest first
+func (b *memoryBackend) History(_ context.Context, domain, shortURL string) ([]Version, error) {
+	return Store.Versions(Key(domain, shortURL)), nil
+}
+
+// SQL statement to create the table of the previous targets
+const createVersionsTableSQL = `
+		CREATE TABLE IF NOT EXISTS link_versions (
+			domain TEXT NOT NULL,
+			short_url TEXT NOT NULL,
+			version INTEGER NOT NULL,
+			original_url TEXT NOT NULL,
+			changed_by TEXT NOT NULL DEFAULT '',
+			changed_at TIMESTAMPTZ NOT NULL,
+			PRIMARY KEY (domain, short_url, version)
+		);`
+
+// SQL statement to keep a replaced target as the next version, the link row has to be locked
+const insertVersionSQL = `
+		INSERT INTO link_versions (domain, short_url, version, original_url, changed_by, changed_at)
+		SELECT $1::text, $2::text, COALESCE(MAX(version), 0) + 1, $3::text, $4::text, $5::timestamptz
+		FROM link_versions WHERE domain = $1 AND short_url = $2;`
+
+// SQL statement to select the previous targets of a link
+const selectVersionsSQL = `
+		SELECT version, original_url, changed_by, changed_at FROM link_versions
+		WHERE domain = $1 AND short_url = $2 ORDER BY version;`
+
+func (b *dbBackend) History(ctx context.Context, domain, shortURL string) ([]Version, error) {
+	var versions []Version
+	err := dbCall(func() error {
+		return retryQuery(ctx, func(ctx context.Context) error {
+			versions = versions[:0]
+			rows, err := b.db.QueryContext(ctx, selectVersionsSQL, domain, shortURL)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var v Version
+				if err = rows.Scan(&v.Version, &v.OriginalURL, &v.ChangedBy, &v.ChangedAt); err != nil {
+					return err
+				}
+				v.ChangedAt = v.ChangedAt.UTC()
+				versions = append(versions, v)
+			}
+			return rows.Err()
+		})
+	})
+	return versions, err
+}
+
+// LinkHistory the previous targets of the link stored under the key, oldest first
+type LinkHistory struct {
+	Key      string
+	Versions []Version
+}
+
+// splitKey returns the domain and the short URL of a URLStore.URLs key
+func splitKey(key string) (string, string) {
+	i := strings.LastIndex(key, "/")
+	if i < 0 {
+		return "", key
+	}
+	return key[:i], key[i+1:]
+}
+
+// importHistory stores the histories returned by next into the map, skipping the links that already have one.
+// Returns the number of links that got a history.
+func importHistory(history map[string][]Version, next func() (LinkHistory, error)) (int, error) {
+	written := 0
+	for {
+		h, err := next()
+		if errors.Is(err, io.EOF) {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+		if _, ok := history[h.Key]; ok || len(h.Versions) == 0 {
+			continue
+		}
+		history[h.Key] = h.Versions
+		written++
+	}
+}
+
+// EachHistory calls fn for the links of the file that have previous targets, in order of their keys
+func (b *fileBackend) EachHistory(_ context.Context, fn func(LinkHistory) error) error {
+	history, err := readHistory(HistoryPath(b.path))
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(history))
+	for key := range history {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err = fn(LinkHistory{Key: key, Versions: history[key]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportHistory merges the histories into the history file of the storage file
+func (b *fileBackend) ImportHistory(_ context.Context, next func() (LinkHistory, error)) (int, error) {
+	path := HistoryPath(b.path)
+	history, err := readHistory(path)
+	if err != nil {
+		return 0, err
+	}
+	written, err := importHistory(history, next)
+	if err != nil || written == 0 {
+		return written, err
+	}
+	return written, writeHistory(path, history)
+}
+
+// EachHistory calls fn for the links in memory that have previous targets, in no particular order
+func (b *memoryBackend) EachHistory(_ context.Context, fn func(LinkHistory) error) error {
+	var err error
+	Store.History.Range(func(key, value interface{}) bool {
+		err = fn(LinkHistory{Key: key.(string), Versions: value.([]Version)})
+		return err == nil
+	})
+	return err
+}
+
+// ImportHistory stores the histories in memory, the history file is saved once at the end
+func (b *memoryBackend) ImportHistory(_ context.Context, next func() (LinkHistory, error)) (int, error) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	history := make(map[string][]Version)
+	Store.History.Range(func(key, value interface{}) bool {
+		history[key.(string)] = value.([]Version)
+		return true
+	})
+	written, err := importHistory(history, next)
+	// The links that had a history keep it, historyMu is held
+	for key, versions := range history {
+		Store.History.Store(key, versions)
+	}
+	if err != nil || written == 0 || b.opts.FileStore == "" {
+		return written, err
+	}
+	return written, Store.saveHistory(HistoryPath(b.opts.FileStore))
+}
+
+// SQL statements of the histories of every link
+const (
+	selectVersionsPageSQL = `
+		SELECT domain, short_url, version, original_url, changed_by, changed_at FROM link_versions
+		WHERE (domain, short_url, version) > ($1, $2, $3) ORDER BY domain, short_url, version LIMIT $4;`
+	historyExistsSQL   = `SELECT EXISTS (SELECT 1 FROM link_versions WHERE domain = $1 AND short_url = $2);`
+	insertVersionAsSQL = `
+		INSERT INTO link_versions (domain, short_url, version, original_url, changed_by, changed_at)
+		VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (domain, short_url, version) DO NOTHING;`
+)
+
+// versionRow a row of link_versions
+type versionRow struct {
+	domain, shortURL string
+	Version
+}
+
+// EachHistory streams the histories of the table in order of domain and short URL, the versions are read
+// a page at a time like the links of Each
+func (b *dbBackend) EachHistory(ctx context.Context, fn func(LinkHistory) error) error {
+	var current LinkHistory
+	var last versionRow
+	for {
+		var page []versionRow
+		err := dbCall(func() error {
+			return retryQuery(ctx, func(ctx context.Context) error {
+				page = page[:0]
+				rows, err := b.db.QueryContext(ctx, selectVersionsPageSQL, last.domain, last.shortURL, last.Version.Version, eachPageRows)
+				if err != nil {
+					return err
+				}
+				defer rows.Close()
+				for rows.Next() {
+					var row versionRow
+					v := &row.Version
+					if err = rows.Scan(&row.domain, &row.shortURL, &v.Version, &v.OriginalURL, &v.ChangedBy, &v.ChangedAt); err != nil {
+						return err
+					}
+					v.ChangedAt = v.ChangedAt.UTC()
+					page = append(page, row)
+				}
+				return rows.Err()
+			})
+		})
+		if err != nil {
+			return err
+		}
+		for _, row := range page {
+			if key := Key(row.domain, row.shortURL); key != current.Key {
+				if current.Key != "" {
+					if err = fn(current); err != nil {
+						return err
+					}
+				}
+				current = LinkHistory{Key: key}
+			}
+			current.Versions = append(current.Versions, row.Version)
+		}
+		if len(page) < eachPageRows {
+			break
+		}
+		last = page[len(page)-1]
+	}
+	if current.Key == "" {
+		return nil
+	}
+	return fn(current)
+}
+
+// ImportHistory inserts the histories of the links that have none, in transactions of maxInsertRows links.
+// A running server may change links meanwhile, the versions it saved are kept. Chunks are retried, importing again resumes.
+func (b *dbBackend) ImportHistory(ctx context.Context, next func() (LinkHistory, error)) (written int, err error) {
+	chunk := make([]LinkHistory, 0, maxInsertRows)
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		var n int
+		err := dbCall(func() error {
+			return retryQuery(ctx, func(ctx context.Context) (err error) {
+				n, err = b.insertHistories(ctx, chunk)
+				return err
+			})
+		})
+		if err != nil {
+			return err
+		}
+		written += n
+		chunk = chunk[:0]
+		return nil
+	}
+
+	for {
+		var h LinkHistory
+		h, err = next()
+		if errors.Is(err, io.EOF) {
+			return written, flush()
+		}
+		if err != nil {
+			return written, err
+		}
+		if len(h.Versions) == 0 {
+			continue
+		}
+		if chunk = append(chunk, h); len(chunk) == maxInsertRows {
+			if err = flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+}
+
+// insertHistories inserts the histories of the links that have none in a single transaction, returns how many
+func (b *dbBackend) insertHistories(ctx context.Context, histories []LinkHistory) (written int, err error) {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	for _, h := range histories {
+		domain, shortURL := splitKey(h.Key)
+		var exists bool
+		if err = tx.QueryRowContext(ctx, historyExistsSQL, domain, shortURL).Scan(&exists); err != nil {
+			return 0, err
+		}
+		if exists {
+			continue
+		}
+		for _, v := range h.Versions {
+			if _, err = tx.ExecContext(ctx, insertVersionAsSQL, domain, shortURL, v.Version, v.OriginalURL, v.ChangedBy, v.ChangedAt); err != nil {
+				return 0, err
+			}
+		}
+		written++
+	}
+	return written, nil
+}
+
+// readHistory reads a history file, a missing file has none
+func readHistory(path string) (map[string][]Version, error) {
+	history := make(map[string][]Version)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return history, json.Unmarshal(data, &history)
+}
+
+// writeHistory writes a history file
+func writeHistory(path string, history map[string][]Version) error {
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
@@ -0,0 +1,350 @@
+// Package transfer reads and writes links in the export formats
+package transfer
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"shortener/internal/store"
+	"strconv"
+	"time"
+)
+
+// Export formats
+const (
+	FormatCSV   = "csv"
+	FormatJSONL = "jsonl"
+	FormatJSON  = "json" // The JSON array of the file store
+)
+
+var ErrFormat = errors.New("unknown format")
+
+// Columns of the CSV format, the reader takes their order from the header
+var csvColumns = []string{
+	"uuid", "short_url", "original_url", "domain", "redirect_status", "cache_control", "referrer_policy", "robots_tag",
+	"password_hash", "max_clicks", "clicks", "forward_query", "forward_path",
+	"utm_source", "utm_medium", "utm_campaign", "utm_term", "utm_content", "created_at", "disabled",
+	"title", "description", "tags", "versions",
+}
+
+// Link an exported link with its previous targets, the CSV format holds them as a JSON array
+type Link struct {
+	store.Record
+	Versions []store.Version `json:"versions,omitempty"`
+}
+
+// Export writes every link of the backend to w with its previous targets, returns the number of links written.
+// The previous targets are read first and held in memory, the links are streamed.
+func Export(ctx context.Context, backend store.Backend, w io.Writer, format string) (int, error) {
+	writer, err := newWriter(w, format)
+	if err != nil {
+		return 0, err
+	}
+	history := make(map[string][]store.Version)
+	err = backend.EachHistory(ctx, func(h store.LinkHistory) error {
+		history[h.Key] = h.Versions
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	err = backend.Each(ctx, func(r store.Record) error {
+		n++
+		return writer.write(Link{Record: r, Versions: history[r.Key()]})
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, writer.close()
+}
+
+// Import reads links from r into the backend, then their previous targets. Like the backfill of a migration,
+// previous targets are only imported for the links that have none. They are held in memory until the links are stored.
+func Import(ctx context.Context, backend store.Backend, r io.Reader, format string, policy store.ConflictPolicy) (store.ImportStats, error) {
+	next, err := newReader(r, format)
+	if err != nil {
+		return store.ImportStats{}, err
+	}
+	var histories []store.LinkHistory
+	stats, err := backend.Import(ctx, func() (store.Record, error) {
+		link, err := next()
+		if err == nil && len(link.Versions) > 0 {
+			histories = append(histories, store.LinkHistory{Key: link.Key(), Versions: link.Versions})
+		}
+		return link.Record, err
+	}, policy)
+	if err != nil || len(histories) == 0 {
+		return stats, err
+	}
+	i := 0
+	stats.Histories, err = backend.ImportHistory(ctx, func() (store.LinkHistory, error) {
+		if i == len(histories) {
+			return store.LinkHistory{}, io.EOF
+		}
+		i++
+		return histories[i-1], nil
+	})
+	return stats, err
+}
+
+// linkWriter writes links one by one
+type linkWriter interface {
+	write(Link) error
+	close() error
+}
+
+func newWriter(w io.Writer, format string) (linkWriter, error) {
+	switch format {
+	case FormatCSV:
+		cw := &csvWriter{w: csv.NewWriter(w)}
+		return cw, cw.w.Write(csvColumns)
+	case FormatJSONL:
+		return &jsonlWriter{encoder: json.NewEncoder(w)}, nil
+	case FormatJSON:
+		return &jsonWriter{w: w}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrFormat, format)
+}
+
+// newReader returns a function reading the next link, io.EOF when there are no more
+func newReader(r io.Reader, format string) (func() (Link, error), error) {
+	switch format {
+	case FormatCSV:
+		return csvReader(r)
+	case FormatJSONL:
+		decoder := json.NewDecoder(r)
+		return func() (link Link, err error) {
+			err = decoder.Decode(&link)
+			return link, err
+		}, nil
+	case FormatJSON:
+		return jsonReader(r)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrFormat, format)
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvWriter) write(l Link) error {
+	versions := ""
+	if len(l.Versions) > 0 {
+		data, err := json.Marshal(l.Versions)
+		if err != nil {
+			return err
+		}
+		versions = string(data)
+	}
+	r := l.Record
+	return c.w.Write([]string{
+		r.UUID, r.ShortURL, r.OriginalURL, r.Domain, strconv.Itoa(r.Redirect.Status), r.Redirect.CacheControl,
+		r.Redirect.ReferrerPolicy, r.Redirect.RobotsTag, r.PasswordHash, strconv.Itoa(r.MaxClicks),
+		strconv.Itoa(r.Clicks), strconv.FormatBool(r.Forward.Query), strconv.FormatBool(r.Forward.Path),
+		r.Forward.Source, r.Forward.Medium, r.Forward.Campaign, r.Forward.Term, r.Forward.Content,
+		formatTime(r.CreatedAt), strconv.FormatBool(r.Disabled), r.Title, r.Description, r.Tags, versions,
+	})
+}
+
+func (c *csvWriter) close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func csvReader(r io.Reader) (func() (Link, error), error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return func() (Link, error) { return Link{}, io.EOF }, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	reader.FieldsPerRecord = len(header)
+	for _, column := range header {
+		if !isCSVColumn(column) {
+			return nil, fmt.Errorf("unknown CSV column %q", column)
+		}
+	}
+
+	return func() (Link, error) {
+		var link Link
+		row, err := reader.Read()
+		if err != nil {
+			return link, err
+		}
+		for i, column := range header {
+			if err = setCSVColumn(&link, column, row[i]); err != nil {
+				line, _ := reader.FieldPos(i)
+				return link, fmt.Errorf("line %d: %s: %w", line, column, err)
+			}
+		}
+		return link, nil
+	}, nil
+}
+
+func isCSVColumn(column string) bool {
+	for _, c := range csvColumns {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+// setCSVColumn sets the field of the column, empty numbers, booleans and versions are left zero
+func setCSVColumn(l *Link, column, value string) (err error) {
+	r := &l.Record
+	switch column {
+	case "uuid":
+		r.UUID = value
+	case "short_url":
+		r.ShortURL = value
+	case "original_url":
+		r.OriginalURL = value
+	case "domain":
+		r.Domain = value
+	case "redirect_status":
+		r.Redirect.Status, err = parseInt(value)
+	case "cache_control":
+		r.Redirect.CacheControl = value
+	case "referrer_policy":
+		r.Redirect.ReferrerPolicy = value
+	case "robots_tag":
+		r.Redirect.RobotsTag = value
+	case "password_hash":
+		r.PasswordHash = value
+	case "max_clicks":
+		r.MaxClicks, err = parseInt(value)
+	case "clicks":
+		r.Clicks, err = parseInt(value)
+	case "forward_query":
+		r.Forward.Query, err = parseBool(value)
+	case "forward_path":
+		r.Forward.Path, err = parseBool(value)
+	case "utm_source":
+		r.Forward.Source = value
+	case "utm_medium":
+		r.Forward.Medium = value
+	case "utm_campaign":
+		r.Forward.Campaign = value
+	case "utm_term":
+		r.Forward.Term = value
+	case "utm_content":
+		r.Forward.Content = value
+	case "created_at":
+		r.CreatedAt, err = parseTime(value)
+	case "disabled":
+		r.Disabled, err = parseBool(value)
+	case "title":
+		r.Title = value
+	case "description":
+		r.Description = value
+	case "tags":
+		r.Tags = value
+	case "versions":
+		if value != "" {
+			err = json.Unmarshal([]byte(value), &l.Versions)
+		}
+	}
+	return err
+}
+
+func parseInt(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// formatTime formats a time as RFC 3339, empty if it is zero
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t.UTC(), err
+}
+
+func parseBool(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+type jsonlWriter struct {
+	encoder *json.Encoder
+}
+
+func (j *jsonlWriter) write(l Link) error {
+	return j.encoder.Encode(l)
+}
+
+func (j *jsonlWriter) close() error {
+	return nil
+}
+
+// jsonWriter streams the links as the indented JSON array of the file store, with their versions
+type jsonWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (j *jsonWriter) write(l Link) error {
+	data, err := json.MarshalIndent(l, "  ", "  ")
+	if err != nil {
+		return err
+	}
+	sep := ",\n  "
+	if j.count == 0 {
+		sep = "[\n  "
+	}
+	j.count++
+	if _, err = io.WriteString(j.w, sep); err != nil {
+		return err
+	}
+	_, err = j.w.Write(data)
+	return err
+}
+
+func (j *jsonWriter) close() error {
+	end := "\n]\n"
+	if j.count == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(j.w, end)
+	return err
+}
+
+func jsonReader(r io.Reader) (func() (Link, error), error) {
+	decoder := json.NewDecoder(r)
+	token, err := decoder.Token()
+	if errors.Is(err, io.EOF) || (err == nil && token == nil) {
+		return func() (Link, error) { return Link{}, io.EOF }, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return nil, errors.New("expected a JSON array")
+	}
+	return func() (link Link, err error) {
+		if !decoder.More() {
+			return link, io.EOF
+		}
+		err = decoder.Decode(&link)
+		return link, err
+	}, nil
+}
@@ -0,0 +1,129 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"reflect"
+	"shortener/internal/config"
+	"shortener/internal/store"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fileBackend(t *testing.T) store.Backend {
+	backend, err := store.OpenBackend(&config.Options{FileStore: filepath.Join(t.TempDir(), "urls.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	records := []store.Record{
+		{UUID: "1", ShortURL: "abc", OriginalURL: "https://example.com/a,b", Redirect: store.Redirect{Status: 301}},
+		{UUID: "2", ShortURL: "def", OriginalURL: "https://example.com", Domain: "go.example.com",
+			MaxClicks: 3, Clicks: 1, Forward: store.Forward{Query: true, UTM: store.UTM{Source: "news"}},
+			CreatedAt: time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC), Disabled: true,
+			Title: "Example, \"quoted\"", Description: "Two\nlines", Tags: "docs,go"},
+	}
+	history := store.LinkHistory{Key: "go.example.com/def", Versions: []store.Version{
+		{Version: 1, OriginalURL: "https://example.com/old", ChangedBy: "admin", ChangedAt: time.Date(2024, 4, 1, 8, 0, 0, 0, time.UTC)},
+	}}
+
+	for _, format := range []string{FormatCSV, FormatJSONL, FormatJSON} {
+		t.Run(format, func(t *testing.T) {
+			source := fileBackend(t)
+			i := 0
+			_, err := source.Import(ctx, func() (store.Record, error) {
+				if i == len(records) {
+					return store.Record{}, io.EOF
+				}
+				i++
+				return records[i-1], nil
+			}, store.ConflictFail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			imported := false
+			_, err = source.ImportHistory(ctx, func() (store.LinkHistory, error) {
+				if imported {
+					return store.LinkHistory{}, io.EOF
+				}
+				imported = true
+				return history, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			n, err := Export(ctx, source, &buf, format)
+			if err != nil || n != len(records) {
+				t.Fatalf("Export() = %d, %v", n, err)
+			}
+
+			target := fileBackend(t)
+			stats, err := Import(ctx, target, &buf, format, store.ConflictFail)
+			if err != nil || stats.Written != len(records) || stats.Histories != 1 {
+				t.Fatalf("Import() = %+v, %v", stats, err)
+			}
+			var got []store.Record
+			_ = target.Each(ctx, func(r store.Record) error {
+				got = append(got, r)
+				return nil
+			})
+			if len(got) != len(records) {
+				t.Fatalf("got %d records, want %d", len(got), len(records))
+			}
+			for i := range records {
+				if got[i] != records[i] {
+					t.Errorf("record %d = %+v, want %+v", i, got[i], records[i])
+				}
+			}
+			// So are the previous targets, a rollback after the import has them
+			var histories []store.LinkHistory
+			_ = target.EachHistory(ctx, func(h store.LinkHistory) error {
+				histories = append(histories, h)
+				return nil
+			})
+			if len(histories) != 1 || !reflect.DeepEqual(histories[0], history) {
+				t.Errorf("histories = %+v, want %+v", histories, history)
+			}
+		})
+	}
+}
+
+func TestImportConflicts(t *testing.T) {
+	ctx := context.Background()
+	backend := fileBackend(t)
+	if _, err := Import(ctx, backend, strings.NewReader("short_url,original_url\nabc,https://a.example\n"), FormatCSV, store.ConflictFail); err != nil {
+		t.Fatal(err)
+	}
+	update := "short_url,original_url\nabc,https://b.example\nnew,https://c.example\n"
+
+	if _, err := Import(ctx, backend, strings.NewReader(update), FormatCSV, store.ConflictFail); !errors.Is(err, store.ErrConflict) {
+		t.Errorf("fail policy: err = %v, want ErrConflict", err)
+	}
+	stats, err := Import(ctx, backend, strings.NewReader(update), FormatCSV, store.ConflictSkip)
+	if err != nil || stats.Written != 1 || stats.Skipped != 1 {
+		t.Errorf("skip policy: %+v, %v", stats, err)
+	}
+	stats, err = Import(ctx, backend, strings.NewReader(update), FormatCSV, store.ConflictOverwrite)
+	if err != nil || stats.Written != 2 || stats.Overwritten != 2 {
+		t.Errorf("overwrite policy: %+v, %v", stats, err)
+	}
+
+	urls := map[string]string{}
+	_ = backend.Each(ctx, func(r store.Record) error {
+		urls[r.ShortURL] = r.OriginalURL
+		return nil
+	})
+	if urls["abc"] != "https://b.example" || urls["new"] != "https://c.example" {
+		t.Errorf("stored %v", urls)
+	}
+}
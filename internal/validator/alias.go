@@ -0,0 +1,39 @@
+package validator
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrAlias         = errors.New("alias may only contain letters, digits, '-', '_', '.' and '~'")
+	ErrAliasLength   = errors.New("alias must be 1 to 64 characters long")
+	ErrAliasReserved = errors.New("alias is reserved")
+)
+
+// Maximum length of a custom short URL
+const maxAliasLength = 64
+
+// Paths used by the service itself
+var reservedAliases = []string{"api", "ping", "healthz", "readyz"}
+
+// Alias validates a custom short URL, it has to be a single path segment that needs no escaping
+func Alias(alias string) error {
+	if alias == "" || len(alias) > maxAliasLength {
+		return ErrAliasLength
+	}
+	for _, c := range alias {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.~", c)) {
+			return ErrAlias
+		}
+	}
+	if alias == "." || alias == ".." {
+		return ErrAlias
+	}
+	for _, reserved := range reservedAliases {
+		if strings.EqualFold(alias, reserved) {
+			return ErrAliasReserved
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package validator
+
+import (
+	"errors"
+	"fmt"
+	"shortener/internal/store"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits of the metadata of a link
+const (
+	maxTitleLength       = 200
+	maxDescriptionLength = 1000
+	maxTags              = 10
+	maxTagLength         = 32
+)
+
+var (
+	ErrTitleLength       = fmt.Errorf("title must be at most %d characters long", maxTitleLength)
+	ErrDescriptionLength = fmt.Errorf("description must be at most %d characters long", maxDescriptionLength)
+	ErrTooManyTags       = fmt.Errorf("a link can have at most %d tags", maxTags)
+	ErrTag               = fmt.Errorf("tags must be 1 to %d letters, digits, '-' or '_'", maxTagLength)
+	ErrControlCharacter  = errors.New("text contains control characters")
+)
+
+// Title validates the title of a link
+func Title(title string) error {
+	if utf8.RuneCountInString(title) > maxTitleLength {
+		return ErrTitleLength
+	}
+	if strings.ContainsFunc(title, unicode.IsControl) {
+		return ErrControlCharacter
+	}
+	return nil
+}
+
+// Description validates the description of a link, it may span lines
+func Description(description string) error {
+	if utf8.RuneCountInString(description) > maxDescriptionLength {
+		return ErrDescriptionLength
+	}
+	if strings.ContainsFunc(description, func(r rune) bool { return unicode.IsControl(r) && r != '\n' && r != '\t' }) {
+		return ErrControlCharacter
+	}
+	return nil
+}
+
+// Tags validates the tags of a link and returns them as stored: lowercase, sorted, without duplicates
+func Tags(tags []string) (string, error) {
+	seen := make(map[string]bool, len(tags))
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = NormalizeTag(tag)
+		if tag == "" || utf8.RuneCountInString(tag) > maxTagLength ||
+			strings.ContainsFunc(tag, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' }) {
+			return "", ErrTag
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) > maxTags {
+		return "", ErrTooManyTags
+	}
+	sort.Strings(normalized)
+	return store.JoinTags(normalized), nil
+}
+
+// NormalizeTag returns the tag as it is stored and searched for
+func NormalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
@@ -0,0 +1,71 @@
+package validator
+
+import (
+	"errors"
+	"golang.org/x/net/http/httpguts"
+	"net/http"
+	"shortener/internal/store"
+)
+
+var (
+	ErrRedirectStatus = errors.New("redirect status must be one of 301, 302, 303, 307, 308")
+	ErrHeaderValue    = errors.New("header value contains invalid characters")
+	ErrReferrerPolicy = errors.New("unknown referrer policy")
+)
+
+// redirectStatuses status codes a link can redirect with
+var redirectStatuses = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusSeeOther:          true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+// referrerPolicies values allowed in the Referrer-Policy header
+var referrerPolicies = map[string]bool{
+	"no-referrer":                     true,
+	"no-referrer-when-downgrade":      true,
+	"origin":                          true,
+	"origin-when-cross-origin":        true,
+	"same-origin":                     true,
+	"strict-origin":                   true,
+	"strict-origin-when-cross-origin": true,
+	"unsafe-url":                      true,
+}
+
+// RedirectError an invalid redirect option, Field is its JSON name
+type RedirectError struct {
+	Field string
+	Err   error
+}
+
+func (e *RedirectError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RedirectError) Unwrap() error {
+	return e.Err
+}
+
+// Redirect validates the per link redirect behavior, zero values are always valid.
+// The error is a *RedirectError naming the invalid option.
+func Redirect(redirect store.Redirect) error {
+	if redirect.Status != 0 && !redirectStatuses[redirect.Status] {
+		return &RedirectError{Field: "redirect_status", Err: ErrRedirectStatus}
+	}
+	headers := []struct{ field, value string }{
+		{"cache_control", redirect.CacheControl},
+		{"referrer_policy", redirect.ReferrerPolicy},
+		{"robots_tag", redirect.RobotsTag},
+	}
+	for _, header := range headers {
+		if !httpguts.ValidHeaderFieldValue(header.value) {
+			return &RedirectError{Field: header.field, Err: ErrHeaderValue}
+		}
+	}
+	if redirect.ReferrerPolicy != "" && !referrerPolicies[redirect.ReferrerPolicy] {
+		return &RedirectError{Field: "referrer_policy", Err: ErrReferrerPolicy}
+	}
+	return nil
+}
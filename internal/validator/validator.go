@@ -0,0 +1,175 @@
+package validator
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/idna"
+	"net"
+	"net/url"
+	"shortener/internal/config"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrEmpty       = errors.New("URL is empty")
+	ErrTooLong     = errors.New("URL is too long")
+	ErrScheme      = errors.New("only http and https URLs are allowed")
+	ErrNoHost      = errors.New("URL has no host")
+	ErrInvalidHost = errors.New("URL host is invalid")
+	ErrPrivateHost = errors.New("URL points at a loopback or private address")
+)
+
+// defaultPorts ports that are dropped from the normalized URL
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// NormalizeURL validates a URL to be shortened and returns its normalized form.
+// Every shorten endpoint stores the normalized form, so the same link written differently is deduplicated.
+func NormalizeURL(rawURL string, opts *config.Options) (string, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	if rawURL == "" {
+		return "", ErrEmpty
+	}
+	if opts.MaxURLLength > 0 && len(rawURL) > opts.MaxURLLength {
+		return "", ErrTooLong
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL: %w", err)
+	}
+
+	// Only absolute web links can be shortened
+	u.Scheme = strings.ToLower(u.Scheme)
+	if _, ok := defaultPorts[u.Scheme]; !ok {
+		return "", ErrScheme
+	}
+	if u.Opaque != "" || u.Hostname() == "" {
+		return "", ErrNoHost
+	}
+
+	host, err := normalizeHost(u.Hostname())
+	if err != nil {
+		return "", err
+	}
+	if opts.DenyPrivate && isPrivateHost(host) {
+		return "", ErrPrivateHost
+	}
+
+	// Drop the port if it is the default one for the scheme
+	port := u.Port()
+	if port == defaultPorts[u.Scheme] {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host = host + ":" + port
+	}
+	u.Host = host
+
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	if opts.URLFragment == "strip" {
+		u.Fragment = ""
+		u.RawFragment = ""
+	}
+
+	normalized := u.String()
+	if opts.MaxURLLength > 0 && len(normalized) > opts.MaxURLLength {
+		return "", ErrTooLong
+	}
+	return normalized, nil
+}
+
+// normalizeHost lowercases the host and converts international domain names to punycode.
+// A host ending in a number is an IPv4 address like browsers read it, written the usual way.
+func normalizeHost(host string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+	if endsInNumber(host) {
+		ip, ok := parseIPv4(host)
+		if !ok {
+			return "", ErrInvalidHost
+		}
+		return ip.String(), nil
+	}
+	ascii, err := idna.Lookup.ToASCII(strings.TrimSuffix(host, "."))
+	if err != nil || ascii == "" {
+		return "", ErrInvalidHost
+	}
+	return strings.ToLower(ascii), nil
+}
+
+// endsInNumber reports whether the last label of the host is a decimal or hexadecimal number
+func endsInNumber(host string) bool {
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	last := labels[len(labels)-1]
+	if hex, ok := cutHexPrefix(last); ok {
+		return strings.Trim(hex, "0123456789abcdefABCDEF") == ""
+	}
+	return last != "" && strings.Trim(last, "0123456789") == ""
+}
+
+// parseIPv4 parses an IPv4 address the way inet_aton does: one to four parts, each decimal, octal with a leading 0
+// or hexadecimal with 0x, the last one filling the remaining bytes. So 127.1, 0x7f.1 and 2130706433 are 127.0.0.1.
+func parseIPv4(host string) (net.IP, bool) {
+	parts := strings.Split(strings.TrimSuffix(host, "."), ".")
+	if len(parts) > 4 {
+		return nil, false
+	}
+	var ip uint64
+	for i, part := range parts {
+		base := 10
+		if hex, ok := cutHexPrefix(part); ok {
+			part, base = hex, 16
+			if part == "" {
+				part = "0"
+			}
+		} else if len(part) > 1 && part[0] == '0' {
+			part, base = part[1:], 8
+		}
+		n, err := strconv.ParseUint(part, base, 32)
+		if err != nil {
+			return nil, false
+		}
+		// Every part but the last is a byte, the last one fills the bytes left
+		bits := 8
+		if i == len(parts)-1 {
+			bits = 8 * (4 - i)
+		}
+		if n >= 1<<bits {
+			return nil, false
+		}
+		ip = ip<<bits | n
+	}
+	return net.IPv4(byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip)), true
+}
+
+// cutHexPrefix returns the label without its 0x prefix, if it has one
+func cutHexPrefix(label string) (string, bool) {
+	if len(label) >= 2 && label[0] == '0' && (label[1] == 'x' || label[1] == 'X') {
+		return label[2:], true
+	}
+	return label, false
+}
+
+// isPrivateHost reports whether the host is localhost or an IP literal that is not publicly routable.
+// Host names are not resolved, so a public name pointing at a private address is not detected.
+func isPrivateHost(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()
+}
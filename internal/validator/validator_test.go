@@ -0,0 +1,87 @@
+package validator
+
+import (
+	"errors"
+	"shortener/internal/config"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	opts := config.Options{MaxURLLength: 64, DenyPrivate: true, URLFragment: "strip"}
+
+	tests := []struct {
+		name    string
+		rawURL  string
+		want    string
+		wantErr error
+	}{
+		{name: "already normal", rawURL: "http://example.com/very/long/url", want: "http://example.com/very/long/url"},
+		{name: "case and default port", rawURL: "HTTPS://Example.COM:443/Path", want: "https://example.com/Path"},
+		{name: "custom port kept", rawURL: "http://example.com:8080", want: "http://example.com:8080/"},
+		{name: "idn", rawURL: "http://пример.рф/", want: "http://xn--e1afmkfd.xn--p1ai/"},
+		{name: "fragment stripped", rawURL: "http://example.com/a?b=c#d", want: "http://example.com/a?b=c"},
+		{name: "mailto", rawURL: "mailto:x@example.com", wantErr: ErrScheme},
+		{name: "javascript", rawURL: "javascript:alert(1)", wantErr: ErrScheme},
+		{name: "relative", rawURL: "/relative", wantErr: ErrScheme},
+		{name: "no host", rawURL: "http:///path", wantErr: ErrNoHost},
+		{name: "loopback", rawURL: "http://127.0.0.1/", wantErr: ErrPrivateHost},
+		{name: "private v6", rawURL: "http://[fd00::1]/", wantErr: ErrPrivateHost},
+		{name: "localhost", rawURL: "http://localhost:8080/", wantErr: ErrPrivateHost},
+		{name: "decimal loopback", rawURL: "http://2130706433/", wantErr: ErrPrivateHost},
+		{name: "hex loopback", rawURL: "http://0x7f.1/", wantErr: ErrPrivateHost},
+		{name: "short loopback", rawURL: "http://127.1/", wantErr: ErrPrivateHost},
+		{name: "octal private", rawURL: "http://012.0.0.1/", wantErr: ErrPrivateHost},
+		{name: "numeric public", rawURL: "http://0x5db8d822./", want: "http://93.184.216.34/"},
+		{name: "invalid numeric", rawURL: "http://1.2.3.256/", wantErr: ErrInvalidHost},
+		{name: "too many parts", rawURL: "http://1.2.3.4.5/", wantErr: ErrInvalidHost},
+		{name: "name with digits", rawURL: "http://a.123x/", want: "http://a.123x/"},
+		{name: "too long", rawURL: "http://example.com/" + string(make([]byte, 64)), wantErr: ErrTooLong},
+		{name: "empty", rawURL: "  ", wantErr: ErrEmpty},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeURL(tt.rawURL, &opts)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NormalizeURL(%q) error = %v, want %v", tt.rawURL, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("NormalizeURL(%q) = %q, want %q", tt.rawURL, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTags(t *testing.T) {
+	tests := []struct {
+		tags    []string
+		want    string
+		wantErr error
+	}{
+		{tags: nil, want: ""},
+		{tags: []string{"Go", " docs ", "go", "ü_x-1"}, want: "docs,go,ü_x-1"},
+		{tags: []string{""}, wantErr: ErrTag},
+		{tags: []string{"a,b"}, wantErr: ErrTag},
+		{tags: []string{strings.Repeat("x", 33)}, wantErr: ErrTag},
+		{tags: []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11"}, wantErr: ErrTooManyTags},
+	}
+	for _, tt := range tests {
+		got, err := Tags(tt.tags)
+		if !errors.Is(err, tt.wantErr) || got != tt.want {
+			t.Errorf("Tags(%q) = %q, %v, want %q, %v", tt.tags, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	if err := Title(strings.Repeat("é", 200)); err != nil {
+		t.Errorf("Title() = %v", err)
+	}
+	if err := Title("two\nlines"); !errors.Is(err, ErrControlCharacter) {
+		t.Errorf("Title() = %v", err)
+	}
+	if err := Description("two\nlines"); err != nil {
+		t.Errorf("Description() = %v", err)
+	}
+	if err := Description(strings.Repeat("x", 1001)); !errors.Is(err, ErrDescriptionLength) {
+		t.Errorf("Description() = %v", err)
+	}
+}